@@ -8,7 +8,7 @@
 //  download and send the image itself to the chat.
 //
 // A tip - if you wish to see all commands it can be given,
-//  I suggest grep -R'ing for 'commands.Table,' in this directory.
+//  send it the message "!help", or "!help <command>" for the details of one.
 
 package main
 
@@ -19,11 +19,17 @@ import "github.com/zorodc/maobot/commands"
 import logs "github.com/zorodc/maobot/loggers"
 import "github.com/zorodc/maobot/eventstream"
 
-//import "flag"
+import "github.com/zorodc/maobot/config"
+import "github.com/zorodc/maobot/certs"
+import "github.com/zorodc/maobot/scheduler"
+import "github.com/zorodc/maobot/outbox"
+
+import "flag"
 import "fmt"
 import "os"
 import "net"
 import "crypto/tls"
+import "crypto/x509"
 import "time"
 import "errors"
 import "strings"
@@ -32,47 +38,247 @@ import "unicode"
 import "unicode/utf8"
 
 import _ "layeh.com/gumble/opus"
-import _ "github.com/zorodc/maobot/modules"
+import "github.com/zorodc/maobot/modules"
 import "github.com/zorodc/maobot/imgfetch"
 
-const (
-	// Maximum reconnection tries. 
-	kDMaxTries = uint(8)
-	kDTimeout = 4*time.Second
-	kDPort    = "64738"
-)
-
 const Usage =
-	`maobot: username[:password] address[:port] [-insecure] 
+	`maobot: [flags] [username[:password] address[:port]]
+Settings are read from the -config file, if given, then overridden by the
+positional arguments, then by the flags. Flags:
 `
-// Mandatory parameters returned, optional parameters taken as pointers.
-func ParseArgs(defaultPort string, confarg *gumble.Config,
-	dialer *net.Dialer, tlsConf *tls.Config,
-	file **os.File) (addr string, conf *gumble.Config, err error) {
-	conf = confarg // Allow the client to provide the config object.
-
-	pullPair := func(s string, opt *string) string {
-		idx := strings.LastIndex(s, ":")
-		if idx == -1 {
-			idx = len(s)
-		} else {
-			*opt = s[idx+1:]
+
+// A flag naming a list, which replaces any list read from the config file.
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (this *listFlag) String() string {
+	if this.list == nil { return ""; }
+	return strings.Join(*this.list, ",")
+}
+
+func (this *listFlag) Set(value string) error {
+	if !this.set {
+		*this.list, this.set = nil, true
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*this.list = append(*this.list, item)
+		}
+	}; return nil
+}
+
+// Define the flags, storing their values in `settings`.
+// The current values of the settings are used as the defaults.
+func defineFlags(flags *flag.FlagSet, settings *config.Config) (path *string) {
+	path = flags.String("config", "", "read settings from a .json, .toml or .yaml `file`")
+	flags.StringVar(&settings.Server, "server", settings.Server,
+		"the server's `address[:port]`")
+	flags.StringVar(&settings.Username, "username", settings.Username,
+		"the bot's username")
+	flags.StringVar(&settings.Password, "password", settings.Password,
+		"the server's password")
+	flags.StringVar(&settings.Cert, "cert", settings.Cert,
+		"a PEM client certificate `file`, generated if it and the key don't exist")
+	flags.StringVar(&settings.Key, "key", settings.Key,
+		"the PEM private key `file` of the client certificate")
+	flags.StringVar(&settings.CA, "ca", settings.CA,
+		"a PEM `file` of certificate authorities to verify the server with")
+	flags.BoolVar(&settings.Insecure, "insecure", settings.Insecure,
+		"skip verification of the server's certificate")
+	flags.StringVar(&settings.KnownServers, "known-servers", settings.KnownServers,
+		"the `file` of server certificates pinned on first use\n"+
+		"(default "+certs.DefaultPinPath()+")")
+	flags.DurationVar((*time.Duration)(&settings.Timeout), "timeout",
+		time.Duration(settings.Timeout), "give up connecting after this long")
+	flags.StringVar(&settings.DebugLog, "debuglog", settings.DebugLog,
+		"write debug logs to this `file`, rather than stdout")
+	flags.StringVar(&settings.LogLevel, "log-level", settings.LogLevel,
+		"the least `level` logged: debug, info, warn or error")
+	flags.StringVar(&settings.JSONLog, "json-log", settings.JSONLog,
+		"also write every log entry as a line of JSON to this `file` (- for stdout)")
+	flags.StringVar(&settings.Prefix, "prefix", settings.Prefix,
+		"the text which marks a message as a command")
+	flags.StringVar(&settings.Channel, "channel", settings.Channel,
+		"join the channel at this `path` (e.g. Music/Lounge) once connected")
+	flags.Var(&listFlag{list:&settings.Owners}, "owners",
+		"comma-separated registered `names` of the bot's owners")
+	flags.UintVar(&settings.History, "history", settings.History,
+		"the number of finished tracks remembered for !prev")
+	flags.StringVar(&settings.JobsFile, "jobs-file", settings.JobsFile,
+		"the `file` scheduled reminders and commands are kept in\n"+
+		"(default "+scheduler.DefaultPath()+")")
+	flags.StringVar(&settings.ScriptsFile, "scripts-file", settings.ScriptsFile,
+		"the `file` scripts defined with !script are kept in\n"+
+		"(default "+commands.DefaultScriptsPath()+")")
+	flags.UintVar(&settings.Reconnect.Tries, "reconnect-tries",
+		settings.Reconnect.Tries,
+		"reconnection attempts after an error, or 0 to keep trying")
+	flags.DurationVar((*time.Duration)(&settings.Reconnect.Delay),
+		"reconnect-delay", time.Duration(settings.Reconnect.Delay),
+		"the wait after the first failed reconnection attempt")
+	flags.DurationVar((*time.Duration)(&settings.Reconnect.MaxDelay),
+		"reconnect-max-delay", time.Duration(settings.Reconnect.MaxDelay),
+		"the longest wait between reconnection attempts")
+	return
+}
+
+// Apply the positional arguments, username[:password] address[:port].
+func positionalArgs(args []string, settings *config.Config) error {
+	switch len(args) {
+	case 0:
+		return nil
+	case 2:
+		settings.Username = args[0]
+		if idx := strings.Index(args[0], ":"); idx != -1 {
+			settings.Username, settings.Password = args[0][:idx], args[0][idx+1:]
+		}
+		settings.Server = args[1]
+		return nil
+	}
+	return errors.New("Expected both username and address, or neither.")
+}
+
+// Configure the TLS connection from the settings.
+// The server's certificate is verified against the CAs given, or if none are,
+// pinned on first use. The client certificate is created if need be.
+func configureTLS(settings *config.Config, tlsConf *tls.Config) error {
+	switch {
+	case settings.Insecure:
+		tlsConf.InsecureSkipVerify = true
+	case settings.CA != "":
+		pem, err := os.ReadFile(settings.CA)
+		if err != nil {
+			return &config.FieldError{Field:"ca", Err:err}
 		}
-		return s[:idx]
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return &config.FieldError{Field:"ca",
+				Err:errors.New("no PEM certificates found")}
+		}
+	default:
+		path := settings.KnownServers
+		if path == "" { path = certs.DefaultPinPath(); }
+		certs.PinOnFirstUse(tlsConf, certs.NewPinStore(path), settings.Address())
 	}
 
-	if len(os.Args) < 3 {
-		err = errors.New("Not enough arguments.")
-		return
+	if settings.Cert != "" {
+		cert, err := certs.LoadOrCreate(settings.Cert, settings.Key,
+			settings.Username)
+		if err != nil {
+			return &config.FieldError{Field:"cert", Err:err}
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
 	}
+	return nil
+}
+
+// Mandatory parameters returned, optional parameters taken as pointers.
+func ParseArgs(args []string, conf *gumble.Config,
+	dialer *net.Dialer, tlsConf *tls.Config) (addr string,
+	settings *config.Config, err error) {
+	// Parse once to find the config file, and again over its settings.
+	flags := flag.NewFlagSet("maobot", flag.ContinueOnError)
+	path := defineFlags(flags, config.Default())
+	if err = flags.Parse(args[1:]); err != nil { return; }
 
-	conf.Username = pullPair(os.Args[1], &conf.Password)
-	url := pullPair(os.Args[2], &defaultPort)
-	addr = url + ":" + defaultPort
+	settings = config.Default()
+	if *path != "" {
+		if settings, err = config.Load(*path); err != nil { return; }
+	}
+	if err = positionalArgs(flags.Args(), settings); err != nil { return; }
 
+	flags = flag.NewFlagSet("maobot", flag.ContinueOnError)
+	defineFlags(flags, settings)
+	if err = flags.Parse(args[1:]); err != nil { return; }
+	if err = settings.Validate(); err != nil { return; }
+
+	conf.Username, conf.Password = settings.Username, settings.Password
+	dialer.Timeout = time.Duration(settings.Timeout)
+	if err = configureTLS(settings, tlsConf); err != nil { return; }
+
+	addr = settings.Address()
 	return
 }
 
+// The most messages whose images are fetched at once. Those of messages sent
+// while all are busy aren't posted.
+const kMaxImageFetches = 4
+
+// Holds a slot for each message whose images are being fetched.
+var gImageFetches = make(chan struct{}, kMaxImageFetches)
+
+// Run `work` in the background, holding one of the `slots` until it's done.
+// Returns false, having run nothing, if every slot is taken.
+func tryInBackground(slots chan struct{}, work func()) bool {
+	select {
+	case slots <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-slots; }()
+		work()
+	}()
+	return true
+}
+
+// Post up to `max` of the images linked in a message.
+func postImages(to outbox.Recipient, message string, max int) {
+	for _, image := range imgfetch.FetchImages(message, max) {
+		outbox.Send(to, imgfetch.Message(image.Data, image.Mimetype), 0, outbox.High)
+	}
+}
+
+// Where to post the images linked in a message: back to its sender if it was
+// sent privately, else in the bot's channel. False if it's nowhere.
+func imagesRecipient(e *gumble.TextMessageEvent) (outbox.Recipient, bool) {
+	switch {
+	case len(e.Channels) > 0 || len(e.Trees) > 0:
+		if e.Client.Self == nil { return outbox.Recipient{}, false; }
+		return outbox.ToChannel(e.Client.Self.Channel), true
+	case e.Sender != nil:
+		return outbox.ToUser(e.Sender), true
+	}
+	return outbox.Recipient{}, false
+}
+
+// Open the configured log files, which are reopened on SIGHUP.
+func openLogFiles(settings *config.Config) (map[logs.LogKind]*logs.FileLogger, error) {
+	files := map[logs.LogKind]*logs.FileLogger{}
+	var all []*logs.FileLogger
+	for name, file := range settings.Logs() {
+		kind, _ := logs.ParseLogKind(name) // Validated already.
+		logger, err := logs.NewFileLogger(file.Path, logs.RotateOptions{
+			MaxSize:int64(file.MaxSizeMB) << 20,
+			Daily:file.Daily,
+			Keep:int(file.Keep),
+			JSON:file.Format == "json",
+		})
+		if err != nil {
+			return nil, &config.FieldError{Field:"log_files." + name, Err:err}
+		}
+		files[kind] = logger
+		all = append(all, logger)
+	}
+	logs.ReopenOnSIGHUP(all...)
+	return files, nil
+}
+
+// Move to the channel at `path`, as in Music/Lounge. The client's state is
+// read while holding it, since its event goroutine is already running.
+func joinChannel(client *gumble.Client, path string) {
+	client.Do(func() {
+		channel := client.Channels.Find(strings.Split(path, "/")...)
+		if channel == nil {
+			logs.Logf(logs.ErrorLogs, "No such channel `%s` to join.", path)
+			return
+		}
+		client.Self.Move(channel)
+	})
+}
+
 func skipWhiteSpace(msg string) string {
 	for len(msg) > 0 {
 		r, size := utf8.DecodeRuneInString(msg)
@@ -82,42 +288,89 @@ func skipWhiteSpace(msg string) string {
 	return msg
 }
 
-// Attempt connection/reconnection `tries` number of times.
-func TryReconn(tries uint,
-	dialer *net.Dialer, tlsConf *tls.Config, address string,
-	config *gumble.Config) (client *gumble.Client, err error) {
-	for i := uint(0); i < tries; i++ {
-		logs.Logf(logs.ErrorLogs, "Reconnecting... Try: %d", i+1)
-		client, err = gumble.DialWithDialer(dialer, address, config, tlsConf)
-
-		if err == nil { break; }
-		time.Sleep(300 * time.Millisecond)
-	}; return
-}
-
 func main() { /* youtube-dl -x -f opus/bestaudio -o - '...' */
 	/* Persistent objects. */
 	// MessageLogger: configured w/ setters once a connection is established.
 	messagelogger := logs.NewMessageLogger(nil)
 	conf          := gumble.NewConfig()
-	dialer        := net.Dialer{Timeout: kDTimeout}
-	tlsConf       := tls.Config{InsecureSkipVerify:true}
-	address       := ""
+	dialer        := net.Dialer{}
+	tlsConf       := tls.Config{}
 	sigExit       := make(chan int)
 
 	/* Parse arguments. */
-	debugOut           := os.Stdout // default
-	address, conf, err := ParseArgs(kDPort, conf, &dialer, &tlsConf, &debugOut)
-	if err != nil {
+	address, settings, err  := ParseArgs(os.Args, conf, &dialer, &tlsConf)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
 		fmt.Println(err.Error())
 		fmt.Print(Usage)
 		os.Exit(1);}
 
+	commands.SetPrefix(settings.Prefix)
+	commands.SetOwners(settings.Owners...)
+	modules.SetHistoryLen(settings.History)
+
 	/* Setup loggers. */
-	logs.AddLogger(logs.NewWriterLogger(os.Stdout), logs.InterractionLogs)
-	logs.AddLogger(logs.NewWriterLogger(debugOut),  logs.DebugLogs)
-	logs.AddLogger(logs.NewWriterLogger(os.Stderr), logs.ErrorLogs)
+	var jsonOut *os.File
+	switch settings.JSONLog {
+	case "":
+	case "-":
+		jsonOut = os.Stdout
+	default:
+		jsonOut, err = os.OpenFile(settings.JSONLog,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't open the JSON log: ", err)
+			os.Exit(1)
+		}
+	}
+	level, _ := logs.ParseLevel(settings.LogLevel) // Validated already.
+	files, err := openLogFiles(settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't open log file: ", err)
+		os.Exit(1)
+	}
+	consoles := map[logs.LogKind]*os.File{logs.InterractionLogs:os.Stdout,
+		logs.DebugLogs:os.Stdout, logs.ErrorLogs:os.Stderr}
+	for kind, console := range consoles {
+		if file, ok := files[kind]; ok {
+			logs.AddLogger(file, kind).MinLevel(level)
+		} else {
+			logs.AddLogger(logs.NewWriterLogger(console), kind).MinLevel(level)
+		}
+	}
 	logs.AddLogger(&messagelogger, logs.ErrorLogs, logs.InterractionLogs)
+	if jsonOut != nil {
+		logs.AddLogger(logs.NewJSONLogger(jsonOut),
+			logs.ErrorLogs, logs.DebugLogs, logs.InterractionLogs).MinLevel(level)
+	}
+	commands.MaxMsgLen = messagelogger.MaxMsgLen
+	outbox.SetLimits(settings.Outbox.Burst, time.Duration(settings.Outbox.Interval),
+		settings.Outbox.MaxQueued)
+	maxImages := int(settings.Images.MaxPerMessage)
+	imgfetch.SetMaxDownload(int64(settings.Images.MaxDownloadKB) << 10)
+	imgfetch.SetPolicy(imgfetch.Policy{
+		Allow:settings.Images.Allow,
+		Deny:settings.Images.Deny,
+		AllowPrivate:settings.Images.AllowPrivate,
+		MaxRedirects:int(settings.Images.MaxRedirects),
+		Timeout:time.Duration(settings.Images.Timeout),
+	})
+	for name, verbosity := range settings.EventLogs {
+		level, _ := logs.ParseVerbosity(verbosity) // Validated already.
+		logs.SetEventVerbosity(name, level)
+	}
+
+	jobsFile := settings.JobsFile
+	if jobsFile == "" { jobsFile = scheduler.DefaultPath(); }
+	if err := modules.SetJobsFile(jobsFile); err != nil {
+		logs.Logf(logs.ErrorLogs, "Couldn't load scheduled jobs: %s.", err.Error())
+	}
+	scriptsFile := settings.ScriptsFile
+	if scriptsFile == "" { scriptsFile = commands.DefaultScriptsPath(); }
+	if err := commands.SetScriptsFile(scriptsFile); err != nil {
+		logs.Logf(logs.ErrorLogs, "Couldn't load scripts: %s.", err.Error())
+	}
 
 	/* Attach event listeners. */
 	// Main listener
@@ -129,36 +382,55 @@ func main() { /* youtube-dl -x -f opus/bestaudio -o - '...' */
 		case *gumble.ServerConfigEvent:
 			if (e.MaximumMessageLength != nil) {
 				messagelogger.SetMaxMsgLen(uint(*e.MaximumMessageLength)); }
+			if (e.MaximumImageMessageLength != nil) {
+				imgfetch.SetMaxMessageLen(uint(*e.MaximumImageMessageLength)); }
 
 		case *gumble.TextMessageEvent:
 			// Skip the leading whitespace that mobile clients add.
 			plaintext := skipWhiteSpace(gutil.PlainText(&e.TextMessage))
-			commands.Dispatch(plaintext, e.Client)
+			err := commands.Dispatch(plaintext, commands.NewContext(e))
 
-			// Fetch images from plain links sent by mobile users.
-			b64, mt, ok := imgfetch.FetchImage(plaintext)
-			if ok == nil {
-				e.Client.Self.Channel.Send(
-					`<img src="data:`+mt+`;base64,`+string(b64)+`"/>`, false)
+			// Post the images linked in messages other than commands, without
+			// holding up the events which follow.
+			to, ok := imagesRecipient(e)
+			if err == commands.ErrNotCommand && maxImages > 0 && ok {
+				message := e.Message
+				if !tryInBackground(gImageFetches,
+					func() { postImages(to, message, maxImages); }) {
+					logs.Logf(logs.DebugLogs, "Not posting images: those of %d messages are being fetched already.",
+						kMaxImageFetches)
+				}
 			}
 
 		case *gumble.ConnectEvent:
 			messagelogger.SetClient(e.Client)
 		}}))
 
+	dial := func() (*gumble.Client, error) {
+		return gumble.DialWithDialer(&dialer, address, conf, &tlsConf)
+	}
+	backoff := Backoff{
+		Initial:time.Duration(settings.Reconnect.Delay),
+		Max:time.Duration(settings.Reconnect.MaxDelay),
+		Tries:settings.Reconnect.Tries,
+	}
+
 	// Disconnect listener.
 	conf.Attach(gutil.Listener{Disconnect:func(e *gumble.DisconnectEvent) {
 		switch e.Type {
 		case gumble.DisconnectError:
 			// Gumble sometimes sends a DisconnectError while the connction is on.
 			// So, we disconnect manually to "fix" this.
+			state := saveState(e.Client)
 			e.Client.Disconnect()
-			_, err := TryReconn(kDMaxTries, &dialer, &tlsConf, address, conf)
+			client, err := TryReconn(dial, backoff)
 			if err != nil {
-				logs.Logf(logs.ErrorLogs, "Couldn't reconnect after %d tries: %s.",
-					kDMaxTries, err.Error())
+				logs.Logf(logs.ErrorLogs, "Couldn't reconnect: %s.", err.Error())
 				sigExit <- 1
-			} else { logs.Logf(logs.DebugLogs, "Reconnection successful."); }
+			} else {
+				logs.Logf(logs.DebugLogs, "Reconnection successful.")
+				state.restore(client)
+			}
 
 		case gumble.DisconnectKicked, gumble.DisconnectBanned:
 			// Exit with failure code on kick or ban.
@@ -169,11 +441,14 @@ func main() { /* youtube-dl -x -f opus/bestaudio -o - '...' */
 		}}})
 
 	/* Setup connection. */
-	_, err = gumble.DialWithDialer(&dialer, address, conf, &tlsConf)
+	client, err := dial()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failure to connect: ", err)
 		os.Exit(1)
 	}
+	if settings.Channel != "" {
+		joinChannel(client, settings.Channel)
+	}
 	
 	// Wait on an exit signal.
 	os.Exit(<-sigExit)
@@ -0,0 +1,68 @@
+package main
+
+import "layeh.com/gumble/gumble"
+import "github.com/zorodc/maobot/outbox"
+
+import "sync"
+import "testing"
+import "time"
+
+// Work is dropped while every slot is taken, and taken again once one frees.
+func TestTryInBackground(t *testing.T) {
+	slots := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var running sync.WaitGroup
+	running.Add(2)
+	for i := 0; i < 2; i++ {
+		if !tryInBackground(slots, func() { running.Done(); <-release; }) {
+			t.Fatalf("work %d was dropped with a slot free", i+1)
+		}
+	}
+	running.Wait()
+	if tryInBackground(slots, func() { t.Error("ran with every slot taken"); }) {
+		t.Error("took work with every slot taken")
+	}
+
+	close(release)
+	ran := make(chan struct{})
+	deadline := time.Now().Add(5 * time.Second)
+	for !tryInBackground(slots, func() { close(ran); }) {
+		if time.Now().After(deadline) {
+			t.Fatal("no slot freed after the work finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the work taken didn't run")
+	}
+}
+
+// Images linked privately are sent back privately, not to the channel.
+func TestImagesRecipient(t *testing.T) {
+	lobby := &gumble.Channel{ID:1, Name:"Lobby"}
+	alice := &gumble.User{Name:"alice", Channel:lobby}
+	client := &gumble.Client{Self:&gumble.User{Name:"bot", Channel:lobby}}
+	message := func(channels, trees []*gumble.Channel, sender *gumble.User) *gumble.TextMessageEvent {
+		return &gumble.TextMessageEvent{Client:client, TextMessage:gumble.TextMessage{
+			Sender:sender, Channels:channels, Trees:trees, Message:"http://a.test/x.png"}}
+	}
+
+	tests := []struct {
+		name  string
+		event *gumble.TextMessageEvent
+		want  outbox.Recipient
+		ok    bool
+	}{
+		{"channel", message([]*gumble.Channel{lobby}, nil, alice), outbox.ToChannel(lobby), true},
+		{"tree", message(nil, []*gumble.Channel{lobby}, alice), outbox.ToChannel(lobby), true},
+		{"private", message(nil, nil, alice), outbox.ToUser(alice), true},
+		{"private, from nobody", message(nil, nil, nil), outbox.Recipient{}, false},
+	}
+	for _, test := range tests {
+		if to, ok := imagesRecipient(test.event); to != test.want || ok != test.ok {
+			t.Errorf("%s: got %v, %t, want %v, %t", test.name, to, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/* Manages the bot's identity, a client certificate the server registers users
+   by, and remembers the certificates of servers, so that a server presenting
+   a different certificate than it did before is refused. */
+package certs
+
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/hex"
+import "encoding/pem"
+import "errors"
+import "fmt"
+import "math/big"
+import "os"
+import "path/filepath"
+import "time"
+
+// How long a generated identity is valid for.
+const kValidity = 20 * 365 * 24 * time.Hour
+
+// Load the PEM certificate and key, or if neither file exists, generate a
+// self-signed identity for `name` and save it there first. If only one exists,
+// it's left alone, and an error returned.
+func LoadOrCreate(certFile, keyFile, name string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr  := os.Stat(keyFile)
+	switch {
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		certPEM, keyPEM, err := Generate(name)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := writeNew(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		// Without its key, the certificate would stop the next start from
+		// generating both again.
+		if err := writeNew(keyFile, keyPEM, 0600); err != nil {
+			os.Remove(certFile)
+			return tls.Certificate{}, err
+		}
+	case os.IsNotExist(certErr):
+		return tls.Certificate{}, fmt.Errorf("%s exists, but not the certificate %s "+
+			"that goes with it", keyFile, certFile)
+	case os.IsNotExist(keyErr):
+		return tls.Certificate{}, fmt.Errorf("%s exists, but not the key %s "+
+			"that goes with it", certFile, keyFile)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// Write a file which must not already exist, creating its directory if need be.
+// Nothing is left behind if it can't be written whole.
+func writeNew(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Generate a self-signed client certificate and its key, PEM-encoded.
+// RSA is used, as that's what mumble's own clients generate.
+func Generate(name string) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:serial,
+		Subject:pkix.Name{CommonName:name},
+		NotBefore:now.Add(-time.Hour),
+		NotAfter:now.Add(kValidity),
+		KeyUsage:x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type:"CERTIFICATE", Bytes:der})
+	keyPEM  = pem.EncodeToMemory(&pem.Block{Type:"RSA PRIVATE KEY",
+		Bytes:x509.MarshalPKCS1PrivateKey(key)})
+	return
+}
+
+// The SHA-256 fingerprint of a DER-encoded certificate, in hex.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returned when a server presents a certificate other than the one pinned.
+type MismatchError struct {
+	Address  string
+	Expected string // Fingerprints.
+	Got      string
+	Store    string // The file the pin was read from.
+}
+
+func (this *MismatchError) Error() string {
+	return fmt.Sprintf("the certificate of %s has changed! "+
+		"Expected SHA-256 fingerprint %s, but got %s. "+
+		"If the change is expected, remove %s from %s.",
+		this.Address, this.Expected, this.Got, this.Address, this.Store)
+}
+
+// Pin the certificate `address` presents on first use, then refuse any other.
+// Pins are kept in the PinStore file. This replaces the usual verification,
+// since mumble servers mostly use self-signed certificates.
+func PinOnFirstUse(tlsConf *tls.Config, store *PinStore, address string) {
+	tlsConf.InsecureSkipVerify = true
+	tlsConf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("the server presented no certificate")
+		}
+		return store.Check(address, Fingerprint(raw[0]))
+	}
+}
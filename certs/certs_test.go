@@ -0,0 +1,185 @@
+package certs
+
+import "crypto/tls"
+import "errors"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestLoadOrCreate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "sub", "bot.pem")
+	keyFile  := filepath.Join(dir, "sub", "bot.key")
+
+	created, err := LoadOrCreate(certFile, keyFile, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the key file is %v, %v, want readable by its owner alone", info, err)
+	}
+	// The identity is kept, not generated again.
+	loaded, err := LoadOrCreate(certFile, keyFile, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(loaded.Certificate[0]) != Fingerprint(created.Certificate[0]) {
+		t.Error("a second identity was generated")
+	}
+}
+
+// Half an identity is an error, and is left as it is.
+func TestLoadOrCreateHalf(t *testing.T) {
+	certPEM, keyPEM, err := Generate("bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, only := range []string{"cert", "key"} {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "bot.pem"), filepath.Join(dir, "bot.key")
+		present, missing, data := certFile, keyFile, certPEM
+		if only == "key" {
+			present, missing, data = keyFile, certFile, keyPEM
+		}
+		os.WriteFile(present, data, 0600)
+
+		if _, err := LoadOrCreate(certFile, keyFile, "bot"); err == nil ||
+			!strings.Contains(err.Error(), missing) {
+			t.Errorf("only the %s: got %v, want an error naming %s", only, err, missing)
+		}
+		if _, err := os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("only the %s: the other was created", only)
+		}
+		if kept, _ := os.ReadFile(present); string(kept) != string(data) {
+			t.Errorf("only the %s: it was changed", only)
+		}
+	}
+}
+
+// If the key can't be written, the certificate isn't left behind either, so
+// that the next start tries again rather than failing for want of the key.
+func TestLoadOrCreateKeyFails(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "bot.pem")
+	blocker  := filepath.Join(dir, "file")
+	os.WriteFile(blocker, nil, 0600)
+	keyFile  := filepath.Join(blocker, "bot.key") // Within a file, so unwritable.
+
+	if _, err := LoadOrCreate(certFile, keyFile, "bot"); err == nil {
+		t.Fatal("no error writing the key")
+	}
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		t.Error("the certificate was left without its key")
+	}
+	if _, err := LoadOrCreate(certFile, filepath.Join(dir, "bot.key"), "bot"); err != nil {
+		t.Errorf("trying again: %v", err)
+	}
+}
+
+func TestPinStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "known_servers")
+	store := NewPinStore(path)
+
+	if err := store.Check("a:64738", "aaaa"); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := store.Check("b:64738", "bbbb"); err != nil {
+		t.Fatalf("another server's first use: %v", err)
+	}
+	if err := store.Check("a:64738", "aaaa"); err != nil {
+		t.Errorf("the same certificate: %v", err)
+	}
+
+	// Pins last, as in a new run.
+	err := NewPinStore(path).Check("a:64738", "cccc")
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("a changed certificate: got %v, want a MismatchError", err)
+	}
+	want := MismatchError{Address:"a:64738", Expected:"aaaa", Got:"cccc", Store:path}
+	if *mismatch != want {
+		t.Errorf("got %+v, want %+v", *mismatch, want)
+	}
+	// The pin isn't replaced by the certificate refused.
+	if err := store.Check("a:64738", "aaaa"); err != nil {
+		t.Errorf("the pinned certificate after a mismatch: %v", err)
+	}
+}
+
+// A store that can't be read refuses every server, rather than pinning anew.
+func TestPinStoreBad(t *testing.T) {
+	dir := t.TempDir()
+	malformed := filepath.Join(dir, "malformed")
+	os.WriteFile(malformed, []byte("# comment\n\na:64738 aaaa\nb:64738\n"), 0600)
+	unreadable := filepath.Join(dir, "directory")
+	os.Mkdir(unreadable, 0700)
+
+	for _, path := range []string{malformed, unreadable} {
+		store := NewPinStore(path)
+		if err := store.Check("c:64738", "cccc"); err == nil {
+			t.Errorf("%s: a server was accepted", filepath.Base(path))
+		}
+	}
+	if data, _ := os.ReadFile(malformed); strings.Contains(string(data), "cccc") {
+		t.Error("a server was pinned in a malformed store")
+	}
+}
+
+// Serve TLS with an identity of `name` until the test ends, returning the
+// address.
+func serveTLS(t *testing.T, name string) string {
+	t.Helper()
+	certPEM, keyPEM, err := Generate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates:[]tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close(); })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil { return; }
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func handshake(address string, store *PinStore, pinAs string) error {
+	var conf tls.Config
+	PinOnFirstUse(&conf, store, pinAs)
+	conn, err := tls.Dial("tcp", address, &conf)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestPinOnFirstUse(t *testing.T) {
+	store := NewPinStore(filepath.Join(t.TempDir(), "known_servers"))
+	first  := serveTLS(t, "server")
+	second := serveTLS(t, "impostor")
+
+	if err := handshake(first, store, "mumble.test:64738"); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	if err := handshake(first, store, "mumble.test:64738"); err != nil {
+		t.Errorf("the same certificate: %v", err)
+	}
+	// Another server answering at the same address is refused.
+	err := handshake(second, store, "mumble.test:64738")
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("a different certificate: got %v, want a MismatchError", err)
+	}
+}
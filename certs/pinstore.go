@@ -0,0 +1,86 @@
+/* A file of pinned server certificates, one "address fingerprint" per line. */
+package certs
+
+import "bufio"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+
+type PinStore struct {
+	sync.Mutex
+	path string
+}
+
+func NewPinStore(path string) *PinStore {
+	return &PinStore{path:path}
+}
+
+// The default place to keep pins: in the user's configuration directory.
+func DefaultPinPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "maobot", "known_servers")
+}
+
+func (this *PinStore) load() (map[string]string, error) {
+	pins := map[string]string{}
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return pins, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") { continue; }
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `address fingerprint`", this.path, n)
+		}
+		pins[fields[0]] = fields[1]
+	}
+	return pins, scanner.Err()
+}
+
+func (this *PinStore) add(address, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Dir(this.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(file, "%s %s\n", address, fingerprint); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Check the fingerprint of the certificate `address` presented against the
+// one pinned, pinning it if there was none.
+func (this *PinStore) Check(address, fingerprint string) error {
+	this.Lock()
+	defer this.Unlock()
+
+	pins, err := this.load()
+	if err != nil {
+		return err
+	}
+	pinned, ok := pins[address]
+	switch {
+	case !ok:
+		return this.add(address, fingerprint)
+	case pinned != fingerprint:
+		return &MismatchError{Address:address, Expected:pinned, Got:fingerprint,
+			Store:this.path}
+	}
+	return nil
+}
@@ -1,115 +1,268 @@
-/* Implements a synchronized queue. */
+/* Implements a synchronized queue, as a ring buffer that grows as needed,
+   and shrinks again once mostly empty. A limit on its length may be set. */
 
 package syncqueue
 
+import "context"
 import "sync"
 
-type Queue struct {
-	sync.Mutex
-	items []interface{}
-	idx     uint // start index
+// The smallest the buffer shrinks to, once it has been allocated.
+const kMinCapacity = 8
+
+// The zero value is an empty, unbounded queue, ready for use.
+type Queue[T any] struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // Signalled whenever an item is added.
+	items []T        // The ring buffer.
+	head  int        // Index of the front item in items.
+	count int        // Number of items in the queue.
+	limit int        // Maximum number of items; unbounded if 0.
 }
 
-// Return the number of elements in the queue.
-func (this *Queue) Count() uint {
-	this.Lock()
-	defer this.Unlock()
+// Create a queue holding at most `limit` items, or any number if 0.
+func New[T any](limit uint) *Queue[T] {
+	return &Queue[T]{limit:int(limit)}
+}
+
+/* Internal operations. The lock must be held when calling these. */
 
-	return uint(len(this.items)) - this.idx
+// The index in the buffer of the item `i` places from the front.
+func (this *Queue[T]) slot(i int) int {
+	return (this.head + i) % len(this.items)
 }
 
-func (this *Queue) Clear() {
-	this.Lock()
-	defer this.Unlock()
+// Copy the items out in order into a new buffer of the given size.
+func (this *Queue[T]) resize(size int) {
+	items := make([]T, size)
+	for i := 0; i < this.count; i++ {
+		items[i] = this.items[this.slot(i)]
+	}
+	this.items, this.head = items, 0
+}
 
-	this.items = nil
+// Make room for another item. Returns false if the queue is at its limit.
+func (this *Queue[T]) grow() bool {
+	if this.limit > 0 && this.count >= this.limit {
+		return false
+	}
+	if this.count == len(this.items) {
+		size := 2 * len(this.items)
+		if size < kMinCapacity { size = kMinCapacity; }
+		this.resize(size)
+	}
+	return true
 }
 
-func (this *Queue) Empty() bool {
-	return this.Count() == 0
+// Release memory once the queue is mostly empty.
+// Halving only at a quarter full keeps resizes amortized O(1).
+func (this *Queue[T]) shrink() {
+	if len(this.items) > kMinCapacity && this.count <= len(this.items)/4 {
+		this.resize(len(this.items) / 2)
+	}
 }
 
-// Get the front (leftmost) item, or nil if the queue is empty.
-func (this *Queue) Front() interface{} {
-	if this.Empty() {
-		return nil
+func (this *Queue[T]) added() {
+	if this.cond != nil {
+		this.cond.Signal()
 	}
+}
 
-	this.Lock()
-	defer this.Unlock()
-	
-	return this.items[this.idx]
+func (this *Queue[T]) popFront() T {
+	var zero T
+	elem := this.items[this.head]
+	this.items[this.head] = zero // Let the item be collected.
+	this.head = this.slot(1)
+	this.count--
+	this.shrink()
+	return elem
 }
 
-// Get the back (rightmost) item, or nil if the queue is empty.
-func (this *Queue) Back() interface{} {
-	if this.Empty() {
-		return nil
+func (this *Queue[T]) removeAt(i int) T {
+	elem := this.items[this.slot(i)]
+	// Shift the items after it forward a place.
+	for j := i; j < this.count-1; j++ {
+		this.items[this.slot(j)] = this.items[this.slot(j+1)]
 	}
+	var zero T
+	this.items[this.slot(this.count-1)] = zero
+	this.count--
+	this.shrink()
+	return elem
+}
 
-	this.Lock()
-	defer this.Unlock()
+/* Exported operations. */
 
-	return this.items[len(this.items)-1]
+// Return the number of elements in the queue.
+func (this *Queue[T]) Count() uint {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return uint(this.count)
+}
+
+func (this *Queue[T]) Empty() bool {
+	return this.Count() == 0
 }
 
-// Prepends the last popped item.
-func (this *Queue) Rollback() {
-	this.Lock()
-	defer this.Unlock()
+func (this *Queue[T]) Clear() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 
-	if this.idx > 0 {
-		this.idx--
-	}
+	this.items = nil
+	this.head  = 0
+	this.count = 0
+}
+
+// Get the front (leftmost) item, or false if the queue is empty.
+func (this *Queue[T]) Front() (elem T, ok bool) {
+	return this.At(0)
+}
+
+// Get the back (rightmost) item, or false if the queue is empty.
+func (this *Queue[T]) Back() (elem T, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.count == 0 { return; }
+	return this.items[this.slot(this.count-1)], true
+}
+
+// Get the item `i` places from the front, or false if there is none.
+func (this *Queue[T]) At(i uint) (elem T, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if i >= uint(this.count) { return; }
+	return this.items[this.slot(int(i))], true
 }
 
 // Push an item to the front (left) of the queue.
-func (this *Queue) Prepend(elem interface{}) {
-	this.Lock()
-	defer this.Unlock()
-
-	if this.idx > 0 {
-		this.idx--
-		this.items[this.idx] = elem
-	} else {
-		// Perform a CONS operation. Expensive.
-		this.items = append([]interface{}{elem}, this.items)
-	}
+// Returns false if the queue is full.
+func (this *Queue[T]) Prepend(elem T) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.grow() { return false; }
+	this.head = this.slot(len(this.items) - 1)
+	this.items[this.head] = elem
+	this.count++
+	this.added()
+	return true
 }
 
 // Push an item to the back (right) of the queue.
-func (this *Queue) Append(elem interface{}) {
-	this.Lock()
-	defer this.Unlock()
+// Returns false if the queue is full.
+func (this *Queue[T]) Append(elem T) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 
-	this.items = append(this.items, elem)
+	if !this.grow() { return false; }
+	this.items[this.slot(this.count)] = elem
+	this.count++
+	this.added()
+	return true
 }
 
-// Pop an item from the front (left) of the queue, or nil if the queue is empty.
-func (this *Queue) PopFront() interface{} {
-	if this.Empty() {
-		return nil
+// Insert an item so that it is `i` places from the front.
+// Indices past the back of the queue insert at the back.
+// Returns false if the queue is full.
+func (this *Queue[T]) InsertAt(i uint, elem T) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.grow() { return false; }
+	at := this.count
+	if i < uint(at) { at = int(i); }
+	// Shift the items from `at` onwards back a place.
+	for j := this.count; j > at; j-- {
+		this.items[this.slot(j)] = this.items[this.slot(j-1)]
 	}
+	this.items[this.slot(at)] = elem
+	this.count++
+	this.added()
+	return true
+}
+
+// Pop an item from the front (left) of the queue, or false if it's empty.
+func (this *Queue[T]) PopFront() (elem T, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.count == 0 { return; }
+	return this.popFront(), true
+}
+
+// Pop an item from the back (right) of the queue, or false if it's empty.
+func (this *Queue[T]) PopBack() (elem T, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.count == 0 { return; }
+	return this.removeAt(this.count-1), true
+}
+
+// Remove and return the item `i` places from the front, or false if none.
+func (this *Queue[T]) RemoveAt(i uint) (elem T, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if i >= uint(this.count) { return; }
+	return this.removeAt(int(i)), true
+}
 
-	this.Lock()
-	defer this.Unlock()
+// Move the item `from` places from the front so that it is `to` places from
+// the front, shifting those between. Returns false if either is out of range.
+func (this *Queue[T]) Move(from, to uint) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 
-	old_idx := this.idx
-	this.idx++
-	return this.items[old_idx]
+	if from >= uint(this.count) || to >= uint(this.count) {
+		return false
+	}
+	elem := this.items[this.slot(int(from))]
+	for j := int(from); j < int(to); j++ {
+		this.items[this.slot(j)] = this.items[this.slot(j+1)]
+	}
+	for j := int(from); j > int(to); j-- {
+		this.items[this.slot(j)] = this.items[this.slot(j-1)]
+	}
+	this.items[this.slot(int(to))] = elem
+	return true
 }
 
-// Pop an item from the back (right) of the queue, or nil if the queue is empty.
-func (this *Queue) PopBack() interface{} {
-	if this.Empty() {
-		return nil
+// Copy out the items of the queue, from front to back.
+func (this *Queue[T]) Snapshot() []T {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	items := make([]T, this.count)
+	for i := range items {
+		items[i] = this.items[this.slot(i)]
 	}
+	return items
+}
 
-	this.Lock()
-	defer this.Unlock()
+// Pop an item from the front of the queue, waiting for one if it's empty.
+// Gives up with the context's error if it is done first.
+func (this *Queue[T]) PopWait(ctx context.Context) (elem T, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 
-	old_items := this.items
-	// Cut off the last element.
-	this.items = this.items[0:len(this.items)-1]
-	return old_items[len(old_items)-1]
+	if this.cond == nil {
+		this.cond = sync.NewCond(&this.mu)
+	}
+	// Wake every waiter once the context is done, so that they may check it.
+	cond := this.cond
+	stop := context.AfterFunc(ctx, func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		cond.Broadcast()
+	})
+	defer stop()
+
+	for this.count == 0 {
+		if err = ctx.Err(); err != nil { return; }
+		cond.Wait()
+	}
+	return this.popFront(), nil
 }
@@ -0,0 +1,261 @@
+package syncqueue
+
+import "context"
+import "math/rand"
+import "slices"
+import "sync"
+import "testing"
+import "time"
+
+// Apply random operations to a queue and to a plain slice modelling it,
+// checking after each that they agree.
+func checkAgainstModel(t *testing.T, seed int64, limit uint) {
+	random := rand.New(rand.NewSource(seed))
+	queue := New[int](limit)
+	var model []int
+	full := func() bool { return limit > 0 && uint(len(model)) >= limit; }
+	// Indices sometimes fall past the back, to test the range checks.
+	index := func() uint { return uint(random.Intn(len(model) + 2)); }
+
+	for step := 0; step < 2000; step++ {
+		// Lean towards adding, then removing, so the buffer grows and shrinks.
+		adding := (step / 250) % 2 == 0
+		op := random.Intn(11)
+		if !adding && op < 3 { op += 4; }
+
+		elem := random.Int()
+		var desc string
+		switch op {
+		case 0:
+			desc = "Append"
+			ok := queue.Append(elem)
+			if ok != !full() {
+				t.Fatalf("seed %d step %d: Append returned %v", seed, step, ok)
+			}
+			if ok { model = append(model, elem); }
+		case 1:
+			desc = "Prepend"
+			ok := queue.Prepend(elem)
+			if ok != !full() {
+				t.Fatalf("seed %d step %d: Prepend returned %v", seed, step, ok)
+			}
+			if ok { model = append([]int{elem}, model...); }
+		case 2:
+			i := index()
+			desc = "InsertAt"
+			ok := queue.InsertAt(i, elem)
+			if ok != !full() {
+				t.Fatalf("seed %d step %d: InsertAt returned %v", seed, step, ok)
+			}
+			if ok { model = slices.Insert(model, min(int(i), len(model)), elem); }
+		case 3, 4:
+			desc = "PopFront"
+			got, ok := queue.PopFront()
+			if ok != (len(model) > 0) || (ok && got != model[0]) {
+				t.Fatalf("seed %d step %d: PopFront = %d, %v", seed, step, got, ok)
+			}
+			if ok { model = model[1:]; }
+		case 5:
+			desc = "PopBack"
+			got, ok := queue.PopBack()
+			if ok != (len(model) > 0) || (ok && got != model[len(model)-1]) {
+				t.Fatalf("seed %d step %d: PopBack = %d, %v", seed, step, got, ok)
+			}
+			if ok { model = model[:len(model)-1]; }
+		case 6:
+			i := index()
+			desc = "RemoveAt"
+			got, ok := queue.RemoveAt(i)
+			inRange := int(i) < len(model)
+			if ok != inRange || (ok && got != model[i]) {
+				t.Fatalf("seed %d step %d: RemoveAt(%d) = %d, %v", seed, step, i, got, ok)
+			}
+			if ok { model = slices.Delete(model, int(i), int(i)+1); }
+		case 7:
+			from, to := index(), index()
+			desc = "Move"
+			ok := queue.Move(from, to)
+			inRange := int(from) < len(model) && int(to) < len(model)
+			if ok != inRange {
+				t.Fatalf("seed %d step %d: Move(%d, %d) returned %v",
+					seed, step, from, to, ok)
+			}
+			if ok {
+				moved := model[from]
+				model = slices.Delete(model, int(from), int(from)+1)
+				model = slices.Insert(model, int(to), moved)
+			}
+		case 8:
+			i := index()
+			desc = "At"
+			got, ok := queue.At(i)
+			if ok != (int(i) < len(model)) || (ok && got != model[i]) {
+				t.Fatalf("seed %d step %d: At(%d) = %d, %v", seed, step, i, got, ok)
+			}
+		case 9:
+			desc = "Front and Back"
+			front, okFront := queue.Front()
+			back,  okBack  := queue.Back()
+			if okFront != (len(model) > 0) || okBack != (len(model) > 0) ||
+				(okFront && (front != model[0] || back != model[len(model)-1])) {
+				t.Fatalf("seed %d step %d: Front = %d, %v, Back = %d, %v",
+					seed, step, front, okFront, back, okBack)
+			}
+		case 10:
+			// Rarely, so that the queue gets the chance to fill.
+			if random.Intn(20) != 0 { continue; }
+			desc = "Clear"
+			queue.Clear()
+			model = nil
+		}
+
+		if queue.Count() != uint(len(model)) || queue.Empty() != (len(model) == 0) {
+			t.Fatalf("seed %d step %d: after %s, Count = %d, want %d",
+				seed, step, desc, queue.Count(), len(model))
+		}
+		if got := queue.Snapshot(); !slices.Equal(got, model) {
+			t.Fatalf("seed %d step %d: after %s, queue holds %v, want %v",
+				seed, step, desc, got, model)
+		}
+	}
+}
+
+func TestQueueMatchesModel(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		checkAgainstModel(t, seed, 0)
+	}
+}
+
+func TestLimitedQueueMatchesModel(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		checkAgainstModel(t, seed, uint(1 + seed % 12))
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var queue Queue[string]
+	if _, ok := queue.PopFront(); ok {
+		t.Error("popped from an empty queue")
+	}
+	queue.Prepend("b")
+	queue.Prepend("a")
+	queue.Append("c")
+	if got := queue.Snapshot(); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestPopWaitWaits(t *testing.T) {
+	queue := New[int](0)
+	got := make(chan int)
+	go func() {
+		elem, err := queue.PopWait(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- elem
+	}()
+
+	select {
+	case elem := <-got:
+		t.Fatalf("PopWait returned %d from an empty queue", elem)
+	case <-time.After(20 * time.Millisecond):
+	}
+	queue.Append(42)
+	select {
+	case elem := <-got:
+		if elem != 42 {
+			t.Errorf("PopWait = %d, want 42", elem)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PopWait didn't wake for an appended item")
+	}
+	if !queue.Empty() {
+		t.Error("PopWait left its item in the queue")
+	}
+}
+
+func TestPopWaitReturnsQueued(t *testing.T) {
+	queue := New[int](0)
+	queue.Append(1)
+	queue.Append(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// An item already queued is returned, even if the context is done.
+	if elem, err := queue.PopWait(ctx); elem != 1 || err != nil {
+		t.Errorf("PopWait = %d, %v, want 1", elem, err)
+	}
+}
+
+func TestPopWaitCancelled(t *testing.T) {
+	queue := New[int](0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := queue.PopWait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("PopWait returned %v, want the context's error", err)
+	}
+
+	// The queue still works after a waiter gave up.
+	queue.Append(7)
+	if elem, err := queue.PopWait(context.Background()); elem != 7 || err != nil {
+		t.Errorf("PopWait = %d, %v, want 7", elem, err)
+	}
+}
+
+// Many waiters and producers at once: every item is popped exactly once.
+func TestPopWaitConcurrent(t *testing.T) {
+	const kProducers, kItems = 4, 500
+	queue := New[int](0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu   sync.Mutex
+	seen := make(map[int]int)
+	var consumers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for {
+				elem, err := queue.PopWait(ctx)
+				if err != nil { return; }
+				mu.Lock()
+				seen[elem]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var producers sync.WaitGroup
+	for p := 0; p < kProducers; p++ {
+		producers.Add(1)
+		go func(p int) {
+			defer producers.Done()
+			for i := 0; i < kItems; i++ {
+				if i % 2 == 0 {
+					queue.Append(p * kItems + i)
+				} else {
+					queue.Prepend(p * kItems + i)
+				}
+			}
+		}(p)
+	}
+	producers.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !queue.Empty() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	consumers.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != kProducers * kItems {
+		t.Errorf("%d distinct items popped, want %d", len(seen), kProducers * kItems)
+	}
+	for elem, n := range seen {
+		if n != 1 {
+			t.Errorf("item %d popped %d times", elem, n)
+		}
+	}
+}
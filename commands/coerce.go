@@ -0,0 +1,149 @@
+/* Coerces the string arguments of a command into the types taken by the
+   function implementing it, so that commands may be written naturally, as in
+   func(c *gumble.Client, vol float32), rather than parsing strings by hand. */
+package commands
+
+import "github.com/zorodc/maobot/dynamic"
+
+import "fmt"
+import "reflect"
+import "strconv"
+import "time"
+
+// Custom argument types implement ArgParser to be parsed from a command.
+// ParseArg is called on a pointer to a new zero value of the type.
+type ArgParser interface {
+	ParseArg(arg string) error
+}
+
+var argParserType = reflect.TypeOf((*ArgParser)(nil)).Elem()
+var durationType  = reflect.TypeOf(time.Duration(0))
+
+// Describes an argument that couldn't be parsed into the type required.
+type ArgError struct {
+	Index uint   // 1-based position of the argument in the command
+	Arg   string
+	Type  reflect.Type
+	Err   error
+}
+
+func (this *ArgError) Error() string {
+	reason := this.Err
+	// Users needn't know which strconv function rejected their input.
+	if numErr, ok := reason.(*strconv.NumError); ok {
+		reason = numErr.Err
+	}
+	return fmt.Sprintf("argument %d (`%s`) is not %s: %s",
+		this.Index, this.Arg, typeName(this.Type), reason.Error())
+}
+
+// A human name for the kinds of types a user may be asked to provide.
+func typeName(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "a duration (e.g. 1m30s)"
+	case reflect.PtrTo(t).Implements(argParserType),
+		t.Implements(argParserType):
+		// Parsers are usually taken by pointer, which has no name of its own.
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Name() == "" { return "a valid " + t.String(); }
+		return "a valid " + t.Name()
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	}
+	return "a " + t.String()
+}
+
+// Parse a single argument into a value of the type `t`.
+func coerce(arg string, t reflect.Type) (reflect.Value, error) {
+	// Custom parsers come first, so that they may override the builtin kinds.
+	if reflect.PtrTo(t).Implements(argParserType) {
+		v := reflect.New(t)
+		err := v.Interface().(ArgParser).ParseArg(arg)
+		return v.Elem(), err
+	}
+	if t.Kind() == reflect.Ptr && t.Implements(argParserType) {
+		v := reflect.New(t.Elem())
+		err := v.Interface().(ArgParser).ParseArg(arg)
+		return v, err
+	}
+
+	v := reflect.New(t).Elem()
+	if t == durationType {
+		d, err := time.ParseDuration(arg)
+		v.SetInt(int64(d))
+		return v, err
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(arg)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(arg, 0, t.Bits())
+		if err != nil { return v, err; }
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		u, err := strconv.ParseUint(arg, 0, t.Bits())
+		if err != nil { return v, err; }
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(arg, t.Bits())
+		if err != nil { return v, err; }
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(arg)
+		if err != nil { return v, err; }
+		v.SetBool(b)
+	case reflect.Interface:
+		// e.g. interface{}, which a plain string satisfies.
+		if !reflect.TypeOf(arg).Implements(t) {
+			return v, fmt.Errorf("no conversion from text to %s", t)
+		}
+		v.Set(reflect.ValueOf(arg))
+	default:
+		return v, fmt.Errorf("no conversion from text to %s", t)
+	}
+	return v, nil
+}
+
+// Translate the strings into instances of the types taken by `function`.
+// The first `skip` formal parameters are not considered, as they are supplied
+// by the dispatcher rather than the user.
+// Extra or missing arguments are left for dynamic.Call to report.
+func evalType(function dynamic.RtFunc, skip int,
+	ss []string) ([]interface{}, error) {
+	funcType := reflect.TypeOf(function)
+
+	is := make([]interface{}, len(ss))
+	for i := range ss {
+		var formal reflect.Type
+		switch n := i + skip; {
+		case funcType.IsVariadic() && n >= funcType.NumIn()-1:
+			formal = funcType.In(funcType.NumIn() - 1).Elem()
+		case n < funcType.NumIn():
+			formal = funcType.In(n)
+		default:
+			is[i] = ss[i] // Surplus argument; an arity mismatch.
+			continue
+		}
+
+		v, err := coerce(ss[i], formal)
+		if err != nil {
+			return nil, &ArgError{Index:uint(i+1), Arg:ss[i], Type:formal, Err:err}
+		}
+		is[i] = v.Interface()
+	}; return is, nil
+}
@@ -0,0 +1,104 @@
+package commands
+
+import "errors"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// A custom argument, taken by pointer as parsers usually are.
+type testLevel int
+
+func (this *testLevel) ParseArg(arg string) error {
+	switch arg {
+	case "low":  *this = 1
+	case "high": *this = 2
+	default:     return errors.New("not low or high")
+	}
+	return nil
+}
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		arg  string
+		typ  interface{}
+		want interface{}
+	}{
+		{"x y", "", "x y"},
+		{"-12", int(0), -12},
+		{"0x10", int16(0), int16(16)},
+		{"127", int8(0), int8(127)},
+		{"255", uint8(0), uint8(255)},
+		{"1.5", float32(0), float32(1.5)},
+		{"-2e3", float64(0), -2000.0},
+		{"true", false, true},
+		{"0", false, false},
+		{"1m30s", time.Duration(0), 90 * time.Second},
+		{"high", testLevel(0), testLevel(2)},
+	}
+	for _, test := range tests {
+		v, err := coerce(test.arg, reflect.TypeOf(test.typ))
+		if err != nil || v.Interface() != test.want {
+			t.Errorf("coerce(%q, %T) = %v, %v, want %v",
+				test.arg, test.typ, v.Interface(), err, test.want)
+		}
+	}
+
+	// Parsers taken by pointer get a pointer to the value parsed.
+	v, err := coerce("low", reflect.TypeOf((*testLevel)(nil)))
+	if level, ok := v.Interface().(*testLevel); err != nil || !ok || *level != 1 {
+		t.Errorf("coerce(%q, *testLevel) = %v, %v", "low", v.Interface(), err)
+	}
+}
+
+func TestCoerceErrors(t *testing.T) {
+	tests := []struct {
+		arg  string
+		typ  interface{}
+		want string // The error, as the user sees it.
+	}{
+		{"128", int8(0), "argument 1 (`128`) is not an integer: value out of range"},
+		{"99999999999999999999", int(0), "is not an integer: value out of range"},
+		{"1.5", int(0), "is not an integer: invalid syntax"},
+		{"-1", uint(0), "is not a non-negative integer: invalid syntax"},
+		{"256", uint8(0), "is not a non-negative integer: value out of range"},
+		{"1e400", float64(0), "is not a number: value out of range"},
+		{"loud", float32(0), "is not a number: invalid syntax"},
+		{"yes", false, "is not true or false: invalid syntax"},
+		{"90", time.Duration(0), "is not a duration (e.g. 1m30s)"},
+		{"max", testLevel(0), "is not a valid testLevel: not low or high"},
+		{"max", (*testLevel)(nil), "is not a valid testLevel: not low or high"},
+		{"x", []string{}, "is not a []string: no conversion"},
+	}
+	for _, test := range tests {
+		function := reflect.MakeFunc(reflect.FuncOf(
+			[]reflect.Type{reflect.TypeOf(test.typ)}, nil, false),
+			func([]reflect.Value) []reflect.Value { return nil; }).Interface()
+		_, err := evalType(function, 0, []string{test.arg})
+		var argErr *ArgError
+		if !errors.As(err, &argErr) {
+			t.Errorf("%q as %T: got %v, want an ArgError", test.arg, test.typ, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q as %T: got %q, want it to contain %q",
+				test.arg, test.typ, err.Error(), test.want)
+		}
+	}
+}
+
+func TestEvalTypeSkipsAndVariadics(t *testing.T) {
+	function := func(ctx *Context, n int, rest ...uint8) {}
+	args, err := evalType(function, 1, []string{"3", "4", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []interface{}{3, uint8(4), uint8(5)}) {
+		t.Errorf("got %#v", args)
+	}
+	// The index reported is of the argument, not of the parameter.
+	_, err = evalType(function, 1, []string{"3", "4", "300"})
+	if argErr, ok := err.(*ArgError); !ok || argErr.Index != 3 {
+		t.Errorf("got %v, want an error about argument 3", err)
+	}
+}
@@ -13,6 +13,12 @@ import      "github.com/zorodc/maobot/dynamic"
 
 import "strings"
 import "bytes"
+import "errors"
+import "fmt"
+import "html"
+import "sync"
+import "time"
+import "unicode/utf8"
 
 /*	"ytsearch":todo,
 	// pandora commands
@@ -58,15 +64,17 @@ import "bytes"
 	"fortune":todo,*/
 
 // Parses from a start quote to an end quote, allowing escaping of the " and \.
+// Returns the number of bytes read, including both quotes.
 func parseQuotedString(quoted string) (uint, string) {
 	var buffer bytes.Buffer
 	var sawslash bool
 	var nread uint
-	for _, rune := range quoted {
-		nread++
+	for i, rune := range quoted {
+		nread = uint(i + utf8.RuneLen(rune))
 		switch {
+		case i == 0: // The opening quote.
 		case !sawslash && rune == '\\': sawslash = true
-		case !sawslash && rune == '"' : break
+		case !sawslash && rune == '"' : return nread, buffer.String()
 		default:
 			sawslash = false
 			buffer.WriteRune(rune)
@@ -75,55 +83,181 @@ func parseQuotedString(quoted string) (uint, string) {
 	return nread, buffer.String()
 }
 
-// Translate the strings into instances of some type.
-func evalType(ss []string) []interface{}{
-	is := make([]interface{}, len(ss))
-	for i := range ss {
-		is[i] = ss[i]
-	}; return is
+// Split the first argument off of `msg`, returning it and what follows it.
+func nextArgument(msg string) (arg, rest string) {
+	if msg[0] == '"' {
+		nread, parsed := parseQuotedString(msg)
+		return parsed, strings.TrimLeft(msg[nread:], " ")
+	} else if idx := strings.IndexRune(msg, ' '); idx != -1 {
+		// Skip spaces
+		return msg[:idx], strings.TrimLeft(msg[idx:], " ")
+	}
+	return msg, ""
 }
 
 func ParseArguments(msg string) (arguments []string) {
 	for len(msg) > 0 {
-		if msg[0] == '"' {
-			nread, parsed := parseQuotedString(msg)
-			arguments = append(arguments, parsed)
-			msg = msg[nread:]
-		} else if idx := strings.IndexRune(msg, ' '); idx != -1 {
-			arguments = append(arguments, msg[:idx])
-			// Skip spaces
-			var i uint
-			for i = uint(idx); i < uint(len(msg)) && msg[i] == ' '; i++ {}
-			msg = msg[i:]
-		} else {
-			arguments = append(arguments, msg)
-			break
-		}
+		var arg string
+		arg, msg = nextArgument(msg)
+		arguments = append(arguments, arg)
 	}
 	return
 }
 
-func Dispatch(msg string, param interface{}) {
-	if !strings.HasPrefix(msg, "!") { return; } 
+// The text of `msg` after its first `n` arguments, left as it was written.
+func SkipArguments(msg string, n int) string {
+	for ; n > 0 && len(msg) > 0; n-- {
+		_, msg = nextArgument(msg)
+	}
+	return msg
+}
+
+// The inverse of ParseArguments: join arguments back into a message, quoting
+// those which wouldn't otherwise survive being parsed again.
+func JoinArguments(args []string) string {
+	return quoteArguments(args, " \"")
+}
+
+// Join arguments as JoinArguments does, also quoting those containing any of
+// the characters in `special`.
+func quoteArguments(args []string, special string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, special) {
+			arg = `"` + escapeQuoted(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Escape text to be put between quotes.
+func escapeQuoted(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, `\`, `\\`), `"`, `\"`)
+}
+
+var (
+	ErrNotCommand    = errors.New("not a command")
+	ErrNoSuchCommand = errors.New("no such command")
+	ErrDenied        = errors.New("permission denied")
+)
+
+// Check that the sender may run the command, telling them if they may not.
+func authorize(cmd string, command Command, ctx *Context) error {
+	var caller Caller // An unregistered nobody, if there's no sender.
+	if ctx.Sender != nil {
+		caller = CallerOf(ctx.Sender)
+	}
+
+	ok, err := Permitted(caller, command.Permission)
+	switch {
+	case err == ErrACLPending:
+		RequestACLs(ctx.Sender)
+		ctx.Replyf("Can't tell yet whether %s may use %s; %s. Try again shortly.",
+			caller.Name, cmd, err.Error())
+	case err == ErrACLUnavailable:
+		ctx.Replyf("Permission denied: can't tell whether %s may use %s, as %s.",
+			caller.Name, cmd, err.Error())
+		err = ErrDenied
+	case !ok:
+		ctx.Replyf("Permission denied: only %s may use %s.",
+			command.Permission, cmd)
+		err = ErrDenied
+	}
+	return err
+}
+
+// Check that the sender may run the command named `name`, without its prefix,
+// telling them if they may not; e.g. before scheduling it to run later.
+func Authorize(name string, ctx *Context) error {
+	command, ok := Table[name]
+	if !ok { return fmt.Errorf("%w `%s`", ErrNoSuchCommand, name); }
+	return authorize(Prefix()+name, command, ctx)
+}
+
+// The text which marks a message as a command.
+var gPrefix = "!"
+var gPrefixMu sync.Mutex
+
+func Prefix() string {
+	gPrefixMu.Lock()
+	defer gPrefixMu.Unlock()
+	return gPrefix
+}
+
+func SetPrefix(prefix string) {
+	gPrefixMu.Lock()
+	defer gPrefixMu.Unlock()
+	gPrefix = prefix
+}
+
+// Run the command in `msg`, if it is one. Functions implementing commands
+// are given `ctx` if they take a *Context as their first parameter, and may
+// report failure by returning an error last.
+// Problems are replied to the sender, and returned too.
+func Dispatch(msg string, ctx *Context) (err error) {
+	if !strings.HasPrefix(msg, Prefix()) { return ErrNotCommand; }
 	lst := ParseArguments(msg)
 	logs.Logf(logs.DebugLogs, "Attempting call to: %#v", lst)
 
-	cmd  := lst[0]
-	args := append([]interface{}{param}, evalType(lst[1:])...)
-	logs.Logf(logs.DebugLogs, "ARGS:%#v", args)
+	ctx.line = msg
+	cmd := lst[0]
+	defer logCommand(ctx, cmd, time.Now(), &err)
 
-	if command, ok := Table[cmd[1:]]; ok {
-		_, err := dynamic.Call(command.Function, args...)
-		if err != nil {
-			logs.Logf(logs.ErrorLogs, "Improper call: %s.", err.Error())
-			logs.Log(logs.InterractionLogs, "Usage: " + cmd + " " + command.Usage)
-		}
-	} else {
+	command, ok := Table[cmd[len(Prefix()):]]
+	if !ok {
 		logs.Logf(logs.DebugLogs,
-			"Nonexistent command `%s` called with arguments %#v.", cmd, args)
-		logs.Logf(logs.InterractionLogs, "No such command `%s`.", cmd)
-		// logs.Log(CommandList(),logs.InterractionLogs)
+			"Nonexistent command `%s` called with arguments %#v.", cmd, lst[1:])
+		ctx.Replyf("No such command `%s`. Try %shelp.",
+			html.EscapeString(cmd), html.EscapeString(Prefix()))
+		return fmt.Errorf("%w `%s`", ErrNoSuchCommand, cmd)
+	}
+	if err = authorize(cmd, command, ctx); err != nil { return; }
+
+	// Parse the arguments into the types the command's function takes.
+	skip := 0
+	if dynamic.TakesFirst(command.Function, ctx) {
+		skip = 1
+	}
+	var results []interface{}
+	var args []interface{}
+	args, err = evalType(command.Function, skip, lst[1:])
+	if err == nil {
+		logs.Logf(logs.DebugLogs, "ARGS:%#v", args)
+		results, err = dynamic.CallWith(ctx, command.Function, args...)
+	}
+	if err != nil {
+		logs.Logf(logs.DebugLogs, "Improper call to %s: %s.", cmd, err.Error())
+		ctx.Replyf("Improper call to %s: %s.<br/>Usage: %s %s",
+			cmd, html.EscapeString(err.Error()), cmd,
+			html.EscapeString(command.Usage))
+		return err
+	}
+
+	if n := len(results); n > 0 {
+		if failure, ok := results[n-1].(error); ok && failure != nil {
+			logs.Logf(logs.DebugLogs, "%s failed: %s.", cmd, failure.Error())
+			ctx.Replyf("%s failed: %s.", cmd, html.EscapeString(failure.Error()))
+			return failure
+		}
+	}
+	return nil
+}
+
+// Log a command once it's run, with who ran it, where, and how long it took.
+func logCommand(ctx *Context, cmd string, start time.Time, err *error) {
+	fields := logs.Fields{logs.FieldCommand:cmd,
+		logs.FieldLatency:time.Since(start)}
+	if ctx.Sender != nil {
+		fields[logs.FieldUser] = ctx.Sender.Name
+	}
+	if ctx.Channel != nil {
+		fields[logs.FieldChannel] = ctx.Channel.Name
+	}
+	if *err != nil {
+		fields[logs.FieldError] = (*err).Error()
 	}
+	logs.LogFields(logs.DebugLogs, "Ran command.", fields)
 }
 
 /*var todo dynamic.RtFunc = dynamic.New(todo_)
@@ -0,0 +1,111 @@
+/* The context of a command's invocation: who sent it, where, and how to reply.
+   Command functions receive it by taking a *Context as their first parameter;
+   functions that don't need it simply leave it out. */
+package commands
+
+import logs "github.com/zorodc/maobot/loggers"
+import "github.com/zorodc/maobot/outbox"
+import "layeh.com/gumble/gumble"
+
+import "fmt"
+import "time"
+
+type Context struct {
+	Client  *gumble.Client
+	Sender  *gumble.User    // nil if the server sent the message.
+	Channel *gumble.Channel // Where the message was sent, or the sender's channel.
+	Private bool            // Whether it was sent directly to the bot.
+	Message string          // The message as received, HTML and all.
+
+	line     string    // The command, as Dispatch was given it.
+	depth    uint      // How many batches and scripts deep the command runs.
+	deadline time.Time // When the outermost batch or script must stop by.
+	budget   *uint     // How many more commands the outermost may run.
+}
+
+// Reports the maximum message length the server accepts, or 0 if unknown.
+// Set by the main package to read the limit tracked by its MessageLogger.
+var MaxMsgLen = func() uint { return 0 }
+
+// Create the context of a command sent in the given message.
+func NewContext(e *gumble.TextMessageEvent) *Context {
+	ctx := &Context{Client:e.Client, Sender:e.Sender, Message:e.Message}
+
+	switch {
+	case len(e.Channels) > 0:
+		ctx.Channel = e.Channels[0]
+	case len(e.Trees) > 0:
+		ctx.Channel = e.Trees[0]
+	default:
+		// Sent only to users, of which the bot must be one.
+		ctx.Private = true
+		if e.Sender != nil {
+			ctx.Channel = e.Sender.Channel
+		}
+	}
+	return ctx
+}
+
+func init() {
+	Table["more"] = Command{
+		Function:more,
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Show the next page of a reply too long to send at once.",
+		Usage:"",}
+	Table["outbox"] = Command{
+		Function:func(ctx *Context) {
+			stats := outbox.Stats()
+			ctx.Replyf("%d messages waiting to be sent; %d sent, %d merged and %d dropped so far.",
+				stats.Pending, stats.Sent, stats.Merged, stats.Dropped)
+		},
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Show how many messages are waiting to be sent, and have been dropped.",
+		Usage:"",
+		Permission:BotOwner,}
+
+	outbox.MoreHint = func(left int) string {
+		return fmt.Sprintf("<br/><i>(%d more; send %smore)</i>", left, Prefix())
+	}
+}
+
+// Where replies to the context go, or false if there's nowhere.
+func (this *Context) recipient() (outbox.Recipient, bool) {
+	switch {
+	case this.Private && this.Sender != nil:
+		return outbox.ToUser(this.Sender), true
+	case this.Channel != nil:
+		return outbox.ToChannel(this.Channel), true
+	}
+	return outbox.Recipient{}, false
+}
+
+// Reply to the sender, privately if they messaged the bot privately, otherwise
+// in the channel the command came from. Long replies are split into pages,
+// the rest of which are shown with !more.
+// Without anywhere to reply, the reply goes to the interraction logs instead.
+func (this *Context) Reply(message string) {
+	switch {
+	case this.Private && this.Sender != nil:
+		logs.Logf(logs.DebugLogs, "Reply to {%s}: {`%s`}", this.Sender.Name, message)
+	case this.Channel != nil:
+		logs.Logf(logs.DebugLogs, "Reply in {%s}: {`%s`}", this.Channel.Name, message)
+	}
+	if to, ok := this.recipient(); ok {
+		outbox.Send(to, message, MaxMsgLen(), outbox.High)
+	} else {
+		logs.Log(logs.InterractionLogs, message)
+	}
+}
+
+func more(ctx *Context) {
+	to, ok := ctx.recipient()
+	if !ok || !outbox.More(to, MaxMsgLen()) {
+		ctx.Reply("There's nothing more to show.")
+	}
+}
+
+func (this *Context) Replyf(format string, args ...interface{}) {
+	this.Reply(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,120 @@
+/* The !help command, generated from the metadata in the command table. */
+package commands
+
+import "fmt"
+import "html"
+import "reflect"
+import "sort"
+import "strings"
+
+// A command and every name it is registered under.
+type helpEntry struct {
+	names   []string // sorted; the first is treated as the primary name
+	command Command
+}
+
+// Collapse aliases (e.g. next, skip and pop) into a single entry each.
+// Aliases are copies of the same Command, so share a function and description.
+func helpEntries() []*helpEntry {
+	type key struct {
+		fn   uintptr
+		desc string
+	}
+	byKey := map[key]*helpEntry{}
+	for name, command := range Table {
+		k := key{reflect.ValueOf(command.Function).Pointer(), command.Description}
+		if entry, ok := byKey[k]; ok {
+			entry.names = append(entry.names, name)
+		} else {
+			byKey[k] = &helpEntry{names:[]string{name}, command:command}
+		}
+	}
+
+	var entries []*helpEntry
+	for _, entry := range byKey {
+		sort.Strings(entry.names)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].names[0] < entries[j].names[0]
+	})
+	return entries
+}
+
+// Find the entry for the command registered under `name`, or nil.
+func findEntry(entries []*helpEntry, name string) *helpEntry {
+	for _, entry := range entries {
+		for _, alias := range entry.names {
+			if alias == name { return entry; }
+		}
+	}; return nil
+}
+
+func (this *helpEntry) aliases() string {
+	if len(this.names) < 2 { return ""; }
+	return " (" + strings.Join(this.names[1:], ", ") + ")"
+}
+
+// One line summarizing the command.
+func (this *helpEntry) summary() string {
+	line := "<b>" + html.EscapeString(Prefix() + this.names[0]) + "</b>" +
+		html.EscapeString(this.aliases())
+	if this.command.Description != "" {
+		line += ": " + html.EscapeString(this.command.Description)
+	}
+	return line
+}
+
+// Everything known about the command.
+func (this *helpEntry) detail() string {
+	usage := Prefix() + this.names[0]
+	if this.command.Usage != "" {
+		usage += " " + this.command.Usage
+	}
+	text := "<b>" + html.EscapeString(usage) + "</b>"
+	if this.command.Description != "" {
+		text += "<br/>" + html.EscapeString(this.command.Description)
+	}
+	if len(this.names) > 1 {
+		text += "<br/>Aliases: " + html.EscapeString(strings.Join(this.names[1:], ", "))
+	}
+	if this.command.Permission != Anyone {
+		text += "<br/>Only usable by " + this.command.Permission.String() + "."
+	}
+	return text
+}
+
+// The commands' summaries, or the details of those named in `topic`, as one
+// message, which Reply splits into pages if it's too long.
+func helpText(topic []string) string {
+	entries := helpEntries()
+	var lines []string
+	if len(topic) == 0 {
+		lines = append(lines, fmt.Sprintf("<b>%d commands:</b>", len(entries)))
+		for _, entry := range entries {
+			lines = append(lines, entry.summary())
+		}
+	}
+	for _, name := range topic {
+		name = strings.TrimPrefix(name, Prefix())
+		if entry := findEntry(entries, name); entry != nil {
+			lines = append(lines, entry.detail())
+		} else {
+			lines = append(lines, fmt.Sprintf("No such command `%s`.", html.EscapeString(name)))
+		}
+	}
+	return strings.Join(lines, "<br/>")
+}
+
+func help(ctx *Context, topic ...string) {
+	ctx.Reply(helpText(topic))
+}
+
+func init() {
+	Table["help"] = Command{
+		Function:help,
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"List the commands, or describe the commands given.",
+		Usage:"[command...]",}
+}
@@ -0,0 +1,74 @@
+package commands
+
+import "reflect"
+import "strings"
+import "testing"
+
+func skip() {}
+func stop() {}
+
+// Replace the command table with a small one of aliased commands.
+func withTable(t *testing.T) {
+	old := Table
+	Table = map[string]Command{
+		"skip":Command{Function:skip, Description:"Skip the track.", Usage:"[n]"},
+		"next":Command{Function:skip, Description:"Skip the track.", Usage:"[n]"},
+		"pop": Command{Function:skip, Description:"Skip the track.", Usage:"[n]"},
+		"stop":Command{Function:stop, Description:"Stop <now>.", Permission:ChannelAdmin},
+		// The same function described differently is a command of its own.
+		"halt":Command{Function:stop, Description:"Halt."},
+	}
+	t.Cleanup(func() { Table = old; })
+}
+
+func TestHelpEntries(t *testing.T) {
+	withTable(t)
+	var names [][]string
+	for _, entry := range helpEntries() {
+		names = append(names, entry.names)
+	}
+	want := [][]string{{"halt"}, {"next", "pop", "skip"}, {"stop"}}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries named %q, want %q", names, want)
+	}
+}
+
+func TestHelpDetail(t *testing.T) {
+	withTable(t)
+	entries := helpEntries()
+	tests := map[string]string{
+		"pop": "<b>!next [n]</b><br/>Skip the track.<br/>Aliases: pop, skip",
+		"stop":"<b>!stop</b><br/>Stop &lt;now&gt;.<br/>Only usable by a channel admin.",
+		"halt":"<b>!halt</b><br/>Halt.",
+	}
+	for name, want := range tests {
+		entry := findEntry(entries, name)
+		if entry == nil {
+			t.Errorf("no entry for %s", name)
+		} else if got := entry.detail(); got != want {
+			t.Errorf("detail of %s = %q, want %q", name, got, want)
+		}
+	}
+	if findEntry(entries, "nonsense") != nil {
+		t.Error("found an entry for a command that doesn't exist")
+	}
+}
+
+// Help is one message, however long, for Reply to split into pages.
+func TestHelpText(t *testing.T) {
+	withTable(t)
+	want := strings.Join([]string{
+		"<b>3 commands:</b>",
+		"<b>!halt</b>: Halt.",
+		"<b>!next</b> (pop, skip): Skip the track.",
+		"<b>!stop</b>: Stop &lt;now&gt;.",
+	}, "<br/>")
+	if got := helpText(nil); got != want {
+		t.Errorf("helpText() = %q, want %q", got, want)
+	}
+
+	got := helpText([]string{"!halt", "<nope>"})
+	if want := "<b>!halt</b><br/>Halt.<br/>No such command `&lt;nope&gt;`."; got != want {
+		t.Errorf("helpText(halt, <nope>) = %q, want %q", got, want)
+	}
+}
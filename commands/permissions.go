@@ -0,0 +1,226 @@
+/* Permission levels for commands, checked against the registration state of
+   the caller, their membership in the server's "admin" group, and the list of
+   bot owners. Group membership is learned from the ACLs the server sends. */
+package commands
+
+import "layeh.com/gumble/gumble"
+import "github.com/zorodc/maobot/eventstream"
+
+import "errors"
+import "sync"
+import "time"
+
+type Permission int
+
+const (
+	Anyone         Permission = iota // The default.
+	RegisteredUser                   // Registered with the server.
+	ChannelAdmin                     // A member of the "admin" group.
+	BotOwner                         // Registered under an owner's name.
+)
+
+func (this Permission) String() string {
+	switch this {
+	case Anyone:         return "anyone"
+	case RegisteredUser: return "a registered user"
+	case ChannelAdmin:   return "a channel admin"
+	case BotOwner:       return "the bot's owner"
+	}; return "unknown"
+}
+
+// The name of the mumble group whose members count as channel admins.
+const kAdminGroup = "admin"
+
+// How long to wait for the ACLs asked for before giving up on them. Servers
+// don't answer bots which aren't permitted to read ACLs at all.
+const kACLWait = 10 * time.Second
+
+// Returned when the ACLs needed to answer a permission check aren't known yet.
+var ErrACLPending = errors.New("permissions are still being loaded")
+
+// Returned when the ACLs were asked for, but never arrived.
+var ErrACLUnavailable = errors.New("the server hasn't sent its ACLs, which the bot may not be permitted to read")
+
+// The time, swapped for a fake when testing.
+var now = time.Now
+
+// The identity of whoever issued a command, as far as permissions go.
+type Caller struct {
+	Name       string
+	UserID     uint32 // Only meaningful if Registered.
+	Registered bool
+	Channel    uint32 // The ID of the caller's channel.
+	Root       uint32 // The ID of the server's root channel.
+}
+
+func CallerOf(user *gumble.User) Caller {
+	caller := Caller{Name:user.Name, UserID:user.UserID,
+		Registered:user.IsRegistered()}
+	if user.Channel != nil {
+		caller.Channel = user.Channel.ID
+		root := user.Channel
+		for root.Parent != nil {
+			root = root.Parent
+		}
+		caller.Root = root.ID
+	}
+	return caller
+}
+
+// The members of each group, by channel ID, as of the latest ACLs.
+type groupCache struct {
+	sync.Mutex
+	channels  map[uint32]map[string]map[uint32]struct{}
+	requested map[uint32]time.Time // When ACLs not yet received were asked for.
+}
+
+var gGroups  groupCache
+var gOwners  = map[string]struct{}{}
+var gOwnerMu sync.Mutex
+
+// Record the group memberships of a channel's ACL.
+func RecordACL(acl *gumble.ACL) {
+	if acl == nil || acl.Channel == nil { return; }
+
+	groups := map[string]map[uint32]struct{}{}
+	for _, group := range acl.Groups {
+		members := map[uint32]struct{}{}
+		for id := range group.UsersInherited {
+			members[id] = struct{}{}
+		}
+		for id := range group.UsersAdd {
+			members[id] = struct{}{}
+		}
+		for id := range group.UsersRemove {
+			delete(members, id)
+		}
+		groups[group.Name] = members
+	}
+
+	gGroups.Lock()
+	defer gGroups.Unlock()
+	if gGroups.channels == nil {
+		gGroups.channels = map[uint32]map[string]map[uint32]struct{}{}
+	}
+	gGroups.channels[acl.Channel.ID] = groups
+	delete(gGroups.requested, acl.Channel.ID)
+}
+
+// Forget all recorded ACLs, e.g. after connecting to a different server.
+func ForgetACLs() {
+	gGroups.Lock()
+	defer gGroups.Unlock()
+	gGroups.channels, gGroups.requested = nil, nil
+}
+
+// Note that a channel's ACL was asked for, unless it already was.
+func noteRequested(channel uint32) {
+	gGroups.Lock()
+	defer gGroups.Unlock()
+	if gGroups.requested == nil {
+		gGroups.requested = map[uint32]time.Time{}
+	}
+	if _, asked := gGroups.requested[channel]; !asked {
+		gGroups.requested[channel] = now()
+	}
+}
+
+// Whether a channel's ACL was asked for long enough ago to give up on it.
+func overdue(channel uint32) bool {
+	gGroups.Lock()
+	defer gGroups.Unlock()
+	asked, ok := gGroups.requested[channel]
+	return ok && now().Sub(asked) >= kACLWait
+}
+
+// Report whether a user is in a group of a channel, and if the ACL is known.
+func inGroup(channel uint32, group string, userID uint32) (in, known bool) {
+	gGroups.Lock()
+	defer gGroups.Unlock()
+
+	groups, known := gGroups.channels[channel]
+	if !known { return false, false; }
+	_, in = groups[group][userID]
+	return in, true
+}
+
+// Replace the set of owners, who are identified by their registered names.
+func SetOwners(names ...string) {
+	gOwnerMu.Lock()
+	defer gOwnerMu.Unlock()
+
+	gOwners = map[string]struct{}{}
+	for _, name := range names {
+		gOwners[name] = struct{}{}
+	}
+}
+
+func isOwner(caller Caller) bool {
+	gOwnerMu.Lock()
+	defer gOwnerMu.Unlock()
+
+	// Anyone may take an unregistered name, so it can't confer ownership.
+	_, in := gOwners[caller.Name]
+	return in && caller.Registered
+}
+
+// Determine whether `caller` holds the permission `required`.
+// Owners hold every permission, and admins every one but ownership.
+// ErrACLPending is returned if the caller's groups are not yet known, and
+// ErrACLUnavailable, with a denial, if they were asked for too long ago.
+func Permitted(caller Caller, required Permission) (bool, error) {
+	switch {
+	case required <= Anyone:
+		return true, nil
+	case isOwner(caller):
+		return true, nil
+	case required == BotOwner || !caller.Registered:
+		return false, nil
+	case required == RegisteredUser:
+		return true, nil
+	}
+
+	// The admin group is usually defined at the root and inherited.
+	inChannel, knownChannel := inGroup(caller.Channel, kAdminGroup, caller.UserID)
+	inRoot, knownRoot       := inGroup(caller.Root, kAdminGroup, caller.UserID)
+	if inChannel || inRoot {
+		return true, nil
+	}
+	if !knownChannel && !knownRoot {
+		if overdue(caller.Channel) || overdue(caller.Root) {
+			return false, ErrACLUnavailable
+		}
+		return false, ErrACLPending
+	}
+	return false, nil
+}
+
+// Ask the server for the ACLs needed to check the permissions of `user`.
+func RequestACLs(user *gumble.User) {
+	if user == nil || user.Channel == nil { return; }
+	noteRequested(user.Channel.ID)
+	user.Channel.RequestACL()
+
+	root := user.Channel
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	if root != user.Channel {
+		noteRequested(root.ID)
+		root.RequestACL()
+	}
+}
+
+func init() {
+	// Subscribers run on goroutines of their own, so must hold the client to
+	// look at its channels and users.
+	eventstream.Subscribe(func(e *gumble.ACLEvent) {
+		e.Client.Do(func() { RecordACL(e.ACL); })
+	})
+	eventstream.Subscribe(func(e *gumble.ConnectEvent) {
+		e.Client.Do(func() {
+			ForgetACLs()
+			RequestACLs(e.Client.Self)
+		})
+	})
+}
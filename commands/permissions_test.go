@@ -0,0 +1,133 @@
+package commands
+
+import "layeh.com/gumble/gumble"
+
+import "errors"
+import "testing"
+import "time"
+
+// A server with an admin group defined at the root, channel 0, holding the
+// user with ID 7, and a subchannel, 1, with an admin group of its own holding
+// the user with ID 8.
+func withACLs(t *testing.T) {
+	ForgetACLs()
+	t.Cleanup(ForgetACLs)
+	root := &gumble.Channel{ID:0}
+	sub  := &gumble.Channel{ID:1, Parent:root}
+	RecordACL(&gumble.ACL{Channel:root, Groups:[]*gumble.ACLGroup{{Name:kAdminGroup,
+		UsersAdd:map[uint32]*gumble.ACLUser{7:{UserID:7}}}}})
+	RecordACL(&gumble.ACL{Channel:sub, Groups:[]*gumble.ACLGroup{{Name:kAdminGroup,
+		UsersAdd:map[uint32]*gumble.ACLUser{8:{UserID:8}}}}})
+
+	SetOwners("boss")
+	t.Cleanup(func() { SetOwners(); })
+}
+
+func TestPermitted(t *testing.T) {
+	withACLs(t)
+
+	guest      := Caller{Name:"guest", Channel:1, Root:0}
+	registered := Caller{Name:"reg", UserID:3, Registered:true, Channel:1, Root:0}
+	rootAdmin  := Caller{Name:"radmin", UserID:7, Registered:true, Channel:1, Root:0}
+	subAdmin   := Caller{Name:"sadmin", UserID:8, Registered:true, Channel:1, Root:0}
+	owner      := Caller{Name:"boss", UserID:9, Registered:true, Channel:1, Root:0}
+	fakeOwner  := Caller{Name:"boss", Channel:1, Root:0} // Unregistered.
+
+	tests := []struct {
+		caller   Caller
+		required Permission
+		want     bool
+	}{
+		{guest, Anyone, true},
+		{guest, RegisteredUser, false},
+		{guest, ChannelAdmin, false},
+		{guest, BotOwner, false},
+
+		{registered, Anyone, true},
+		{registered, RegisteredUser, true},
+		{registered, ChannelAdmin, false},
+		{registered, BotOwner, false},
+
+		{rootAdmin, ChannelAdmin, true},
+		{rootAdmin, BotOwner, false},
+		{subAdmin, ChannelAdmin, true},
+		{subAdmin, BotOwner, false},
+
+		{owner, RegisteredUser, true},
+		{owner, ChannelAdmin, true},
+		{owner, BotOwner, true},
+
+		{fakeOwner, RegisteredUser, false},
+		{fakeOwner, BotOwner, false},
+	}
+	for _, test := range tests {
+		got, err := Permitted(test.caller, test.required)
+		if err != nil {
+			t.Errorf("Permitted(%s, %s): unexpected error %v",
+				test.caller.Name, test.required, err)
+		}
+		if got != test.want {
+			t.Errorf("Permitted(%s, %s) = %v, want %v",
+				test.caller.Name, test.required, got, test.want)
+		}
+	}
+}
+
+func TestPermittedACLPending(t *testing.T) {
+	ForgetACLs()
+	t.Cleanup(ForgetACLs)
+	clock := time.Unix(1000, 0)
+	now = func() time.Time { return clock; }
+	t.Cleanup(func() { now = time.Now; })
+
+	caller := Caller{Name:"reg", UserID:3, Registered:true, Channel:4, Root:0}
+	if _, err := Permitted(caller, ChannelAdmin); err != ErrACLPending {
+		t.Fatalf("before asking: got %v, want ErrACLPending", err)
+	}
+
+	root := &gumble.Channel{ID:0}
+	RequestACLs(&gumble.User{Channel:&gumble.Channel{ID:4, Parent:root}})
+	clock = clock.Add(kACLWait / 2)
+	if _, err := Permitted(caller, ChannelAdmin); err != ErrACLPending {
+		t.Fatalf("while waiting: got %v, want ErrACLPending", err)
+	}
+
+	clock = clock.Add(kACLWait)
+	ok, err := Permitted(caller, ChannelAdmin)
+	if ok || err != ErrACLUnavailable {
+		t.Fatalf("after waiting: got %v, %v, want a denial with ErrACLUnavailable", ok, err)
+	}
+
+	// ACLs arriving late are still used.
+	RecordACL(&gumble.ACL{Channel:root, Groups:[]*gumble.ACLGroup{{Name:kAdminGroup,
+		UsersAdd:map[uint32]*gumble.ACLUser{3:{UserID:3}}}}})
+	if ok, err := Permitted(caller, ChannelAdmin); !ok || err != nil {
+		t.Fatalf("once received: got %v, %v, want permission", ok, err)
+	}
+}
+
+func TestCallerOf(t *testing.T) {
+	root := &gumble.Channel{ID:0}
+	user := &gumble.User{Name:"reg", UserID:3,
+		Channel:&gumble.Channel{ID:5, Parent:&gumble.Channel{ID:2, Parent:root}}}
+	want := Caller{Name:"reg", UserID:3, Registered:true, Channel:5, Root:0}
+	if got := CallerOf(user); got != want {
+		t.Errorf("CallerOf = %+v, want %+v", got, want)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	withTable(t)
+	withACLs(t)
+
+	guest := &Context{} // Without a sender, or anywhere to reply.
+	if err := Authorize("skip", guest); err != nil {
+		t.Errorf("skip, for anyone: got %v", err)
+	}
+	if err := Authorize("stop", guest); err != ErrDenied {
+		t.Errorf("stop, for admins: got %v, want ErrDenied", err)
+	}
+	if err := Authorize("nonesuch", guest); !errors.Is(err, ErrNoSuchCommand) {
+		t.Errorf("nonesuch: got %v, want ErrNoSuchCommand", err)
+	}
+}
@@ -0,0 +1,378 @@
+/* Running several commands from one message: !batch runs commands separated by
+   semicolons, and !script keeps named batches, which take parameters $1, $2...
+   Batches and scripts may run each other, to a limited depth, and for a limited
+   time and number of commands in total. */
+package commands
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "html"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	kMaxDepth    = 4                // Batches and scripts nested within another.
+	kMaxRuntime  = 30 * time.Second // The longest the outermost may run for.
+	kMaxCommands = 64               // The most it may run, however nested.
+)
+
+var (
+	ErrTooDeep   = errors.New("batches and scripts are nested too deeply")
+	ErrTimeLimit = errors.New("ran out of time")
+	ErrTooMany   = errors.New("ran too many commands")
+)
+
+// A named batch of commands.
+type Script struct {
+	Owner string `json:"owner"` // The name of whoever defined it.
+	Body  string `json:"body"`
+}
+
+var gScripts struct {
+	sync.Mutex
+	path    string // Where scripts are saved, or "" to not save them.
+	scripts map[string]Script
+}
+
+func init() {
+	Table["batch"] = Command{
+		Function:batch,
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Run commands separated by semicolons, stopping at the first " +
+			"to fail unless -k is given.",
+		Usage:"[-k] command; command...",}
+	Table["script"] = Command{
+		Function:script,
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Define, run, show, delete or list named batches of commands. " +
+			"$1, $2... in a script are replaced by the arguments it's run with, " +
+			"and $@ by all of them.",
+		Usage:"define name command; command... | run name [args...] | " +
+			"show name | delete name | list",}
+}
+
+// The default place to keep scripts: in the user's configuration directory.
+func DefaultScriptsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "maobot", "scripts.json")
+}
+
+// Keep scripts in the file at `path` from now on, loading any already in it.
+func SetScriptsFile(path string) error {
+	gScripts.Lock()
+	defer gScripts.Unlock()
+
+	gScripts.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	scripts := map[string]Script{}
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	gScripts.scripts = scripts
+	return nil
+}
+
+// Write the scripts to the file, if any. The lock must be held.
+func saveScripts() error {
+	if gScripts.path == "" { return nil; }
+
+	data, err := json.MarshalIndent(gScripts.scripts, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(gScripts.path), 0700); err != nil {
+		return err
+	}
+	tmp := gScripts.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, gScripts.path)
+}
+
+// The context for commands run by a batch or script run in `this` one.
+func (this *Context) nest() (*Context, error) {
+	if this.depth >= kMaxDepth {
+		return nil, ErrTooDeep
+	}
+	nested := *this
+	nested.depth++
+	if nested.deadline.IsZero() {
+		nested.deadline = time.Now().Add(kMaxRuntime)
+	}
+	if nested.budget == nil {
+		budget := uint(kMaxCommands)
+		nested.budget = &budget
+	}
+	return &nested, nil
+}
+
+// Split text into the commands separated by semicolons outside quotes.
+func splitCommands(text string) (cmds []string) {
+	var quoted, escaped bool
+	start := 0
+	for i, rune := range text {
+		switch {
+		case escaped:            escaped = false
+		case rune == '\\':       escaped = quoted
+		case rune == '"':        quoted = !quoted
+		case rune == ';' && !quoted:
+			cmds = append(cmds, text[start:i])
+			start = i + 1
+		}
+	}
+	cmds = append(cmds, text[start:])
+
+	// Drop the empty commands left by stray semicolons.
+	kept := cmds[:0]
+	for _, cmd := range cmds {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			kept = append(kept, cmd)
+		}
+	}
+	return kept
+}
+
+// Run commands in order through Dispatch, which replies to any that fail.
+// Stops at the first failure, unless `keepGoing`.
+func runAll(ctx *Context, cmds []string, keepGoing bool) error {
+	nested, err := ctx.nest()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i, cmd := range cmds {
+		if time.Now().After(nested.deadline) {
+			return fmt.Errorf("%w after %d of %d commands", ErrTimeLimit, i, len(cmds))
+		}
+		// Shared with every batch and script within the outermost, so that
+		// nesting can't multiply how many commands are run.
+		if *nested.budget == 0 {
+			return fmt.Errorf("%w: the most is %d", ErrTooMany, kMaxCommands)
+		}
+		*nested.budget--
+		err := Dispatch(cmd, nested)
+		if err == ErrNotCommand {
+			ctx.Replyf("`%s` isn't a command.", html.EscapeString(cmd))
+		}
+		if err == nil { continue; }
+
+		failed++
+		if !keepGoing {
+			return fmt.Errorf("stopped at command %d of %d", i+1, len(cmds))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, len(cmds))
+	}
+	return nil
+}
+
+// Commands are split from the message as it was written, rather than from
+// the arguments parsed from it, so that quotes are kept.
+func batch(ctx *Context, words ...string) error {
+	keepGoing := len(words) > 0 && (words[0] == "-k" || words[0] == "--keep-going")
+	skip := 1
+	if keepGoing { skip = 2; }
+	cmds := splitCommands(SkipArguments(ctx.line, skip))
+	if len(cmds) == 0 {
+		return errors.New("no commands given")
+	}
+	return runAll(ctx, cmds, keepGoing)
+}
+
+// Replace $1, $2... in a script's body with the arguments it's run with,
+// $@ with all of them, and $$ with $. Arguments are quoted as need be, so that
+// each stays whole and none can end the command it's in, and escaped if the
+// parameter is already within quotes.
+func substitute(body string, args []string) (string, error) {
+	var buffer bytes.Buffer
+	var quoted, escaped bool
+	insert := func(args []string) {
+		if quoted {
+			buffer.WriteString(escapeQuoted(strings.Join(args, " ")))
+		} else {
+			buffer.WriteString(quoteArguments(args, " \";"))
+		}
+	}
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case escaped:   escaped = false
+		case c == '\\': escaped = quoted
+		case c == '"':  quoted = !quoted
+		}
+		if c != '$' || escaped || i+1 == len(body) {
+			buffer.WriteByte(c)
+			continue
+		}
+
+		switch next := body[i+1]; {
+		case next == '$':
+			buffer.WriteByte('$')
+			i++
+		case next == '@':
+			insert(args)
+			i++
+		case '0' <= next && next <= '9':
+			end := i + 1
+			for end < len(body) && '0' <= body[end] && body[end] <= '9' {
+				end++
+			}
+			n, _ := strconv.Atoi(body[i+1:end])
+			if n < 1 || n > len(args) {
+				return "", fmt.Errorf("no argument $%d was given", n)
+			}
+			insert(args[n-1:n])
+			i = end - 1
+		default:
+			buffer.WriteByte('$')
+		}
+	}
+	return buffer.String(), nil
+}
+
+// Whether the sender may replace or delete a script `owner` defined.
+func mayManage(ctx *Context, owner string) bool {
+	if ctx.Sender == nil { return false; }
+	if ctx.Sender.Name == owner { return true; }
+	ok, _ := Permitted(CallerOf(ctx.Sender), ChannelAdmin)
+	return ok
+}
+
+func script(ctx *Context, action string, args ...string) error {
+	switch action {
+	case "define":
+		if len(args) < 2 {
+			return errors.New("a script needs a name and commands")
+		}
+		return defineScript(ctx, args[0], SkipArguments(ctx.line, 3))
+	case "run":
+		if len(args) < 1 {
+			return errors.New("no script named")
+		}
+		return runScript(ctx, args[0], args[1:])
+	case "show":
+		if len(args) != 1 {
+			return errors.New("name one script to show")
+		}
+		gScripts.Lock()
+		script, ok := gScripts.scripts[args[0]]
+		gScripts.Unlock()
+		if !ok {
+			return fmt.Errorf("no such script `%s`", args[0])
+		}
+		ctx.Replyf("<b>%s</b>, by %s: <code>%s</code>", html.EscapeString(args[0]),
+			html.EscapeString(script.Owner), html.EscapeString(script.Body))
+		return nil
+	case "delete":
+		if len(args) != 1 {
+			return errors.New("name one script to delete")
+		}
+		return deleteScript(ctx, args[0])
+	case "list":
+		listScripts(ctx)
+		return nil
+	}
+	return fmt.Errorf("unknown action `%s`", action)
+}
+
+func defineScript(ctx *Context, name, body string) error {
+	var caller Caller
+	if ctx.Sender != nil {
+		caller = CallerOf(ctx.Sender)
+	}
+	if ok, _ := Permitted(caller, RegisteredUser); !ok {
+		return fmt.Errorf("only %s may define scripts", RegisteredUser)
+	}
+	for _, cmd := range splitCommands(body) {
+		if !strings.HasPrefix(cmd, Prefix()) {
+			return fmt.Errorf("`%s` isn't a command", cmd)
+		}
+	}
+
+	gScripts.Lock()
+	defer gScripts.Unlock()
+
+	if old, ok := gScripts.scripts[name]; ok && !mayManage(ctx, old.Owner) {
+		return fmt.Errorf("`%s` belongs to %s", name, old.Owner)
+	}
+	if gScripts.scripts == nil {
+		gScripts.scripts = map[string]Script{}
+	}
+	gScripts.scripts[name] = Script{Owner:caller.Name, Body:body}
+	if err := saveScripts(); err != nil {
+		return fmt.Errorf("couldn't save scripts: %w", err)
+	}
+	ctx.Replyf("Defined script %s.", html.EscapeString(name))
+	return nil
+}
+
+func runScript(ctx *Context, name string, args []string) error {
+	gScripts.Lock()
+	script, ok := gScripts.scripts[name]
+	gScripts.Unlock()
+	if !ok {
+		return fmt.Errorf("no such script `%s`", name)
+	}
+
+	body, err := substitute(script.Body, args)
+	if err != nil {
+		return err
+	}
+	return runAll(ctx, splitCommands(body), false)
+}
+
+func deleteScript(ctx *Context, name string) error {
+	gScripts.Lock()
+	defer gScripts.Unlock()
+
+	script, ok := gScripts.scripts[name]
+	if !ok {
+		return fmt.Errorf("no such script `%s`", name)
+	}
+	if !mayManage(ctx, script.Owner) {
+		return fmt.Errorf("`%s` belongs to %s", name, script.Owner)
+	}
+	delete(gScripts.scripts, name)
+	if err := saveScripts(); err != nil {
+		return fmt.Errorf("couldn't save scripts: %w", err)
+	}
+	ctx.Replyf("Deleted script %s.", html.EscapeString(name))
+	return nil
+}
+
+func listScripts(ctx *Context) {
+	gScripts.Lock()
+	names := make([]string, 0, len(gScripts.scripts))
+	for name := range gScripts.scripts {
+		names = append(names, html.EscapeString(name))
+	}
+	gScripts.Unlock()
+
+	if len(names) == 0 {
+		ctx.Reply("No scripts are defined.")
+		return
+	}
+	sort.Strings(names)
+	ctx.Reply("<b>Scripts:</b> " + strings.Join(names, ", "))
+}
@@ -0,0 +1,152 @@
+package commands
+
+import "errors"
+import "slices"
+import "strings"
+import "testing"
+
+// A command recording the arguments of each call, for the scripts under test.
+func withRecorder(t *testing.T) *[]string {
+	var calls []string
+	Table["record"] = Command{
+		Function:func(args ...string) { calls = append(calls, strings.Join(args, "|")); },
+		Arity:0,}
+	t.Cleanup(func() { delete(Table, "record"); })
+	return &calls
+}
+
+func withScripts(t *testing.T, scripts map[string]Script) {
+	gScripts.Lock()
+	old := gScripts.scripts
+	gScripts.scripts = scripts
+	gScripts.Unlock()
+	t.Cleanup(func() {
+		gScripts.Lock()
+		gScripts.scripts = old
+		gScripts.Unlock()
+	})
+}
+
+func TestSplitCommands(t *testing.T) {
+	tests := map[string][]string{
+		"!a; !b":         {"!a", "!b"},
+		" ;;!a x ;":      {"!a x"},
+		`!a "x;y"; !b`:   {`!a "x;y"`, "!b"},
+		`!a "x\";y"; !b`: {`!a "x\";y"`, "!b"},
+		`!a x\;y`:        {`!a x\`, "y"},
+	}
+	for text, want := range tests {
+		if got := splitCommands(text); !slices.Equal(got, want) {
+			t.Errorf("splitCommands(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	tests := []struct {
+		body string
+		args []string
+		want string
+	}{
+		{"!add $1", []string{"x"}, "!add x"},
+		{"!add $1", []string{"a b"}, `!add "a b"`},
+		{"!add $2 $1", []string{"a", "b"}, "!add b a"},
+		{"!say $@", []string{"a", "b c"}, `!say a "b c"`},
+		{"!cost $$1", []string{"x"}, "!cost $1"},
+		{`!say "<$1>"`, []string{`a "b"`}, `!say "<a \"b\">"`},
+		{"!add $1", []string{""}, `!add ""`},
+		// Separators in arguments are quoted, so they can't start a new command.
+		{"!add $1; !volume 1", []string{"x;!clear"}, `!add "x;!clear"; !volume 1`},
+		{"!say $@", []string{";", "!clear"}, `!say ";" !clear`},
+	}
+	for _, test := range tests {
+		got, err := substitute(test.body, test.args)
+		if err != nil || got != test.want {
+			t.Errorf("substitute(%q, %q) = %q, %v, want %q",
+				test.body, test.args, got, err, test.want)
+		}
+	}
+	if _, err := substitute("!add $2", []string{"x"}); err == nil {
+		t.Error("no error substituting a missing argument")
+	}
+}
+
+// Running a script never runs more commands than it holds, whatever it's
+// given as arguments.
+func TestScriptArgumentsCantInject(t *testing.T) {
+	calls := withRecorder(t)
+	withScripts(t, map[string]Script{"s":{Owner:"a", Body:"!record $1; !record end"}})
+
+	for _, arg := range []string{"x;!record injected", `x";!record injected;"`,
+		`x\;!record injected`, "x; !record injected"} {
+		*calls = nil
+		if err := Dispatch("!script run s "+JoinArguments([]string{arg}), &Context{}); err != nil {
+			t.Errorf("%q: %v", arg, err)
+			continue
+		}
+		if len(*calls) != 2 || (*calls)[0] != arg || (*calls)[1] != "end" {
+			t.Errorf("%q: ran %q", arg, *calls)
+		}
+	}
+}
+
+func TestBatchBudget(t *testing.T) {
+	calls := withRecorder(t)
+	line := "!batch" + strings.Repeat(" !record;", kMaxCommands + 10)
+	err := Dispatch(line, &Context{})
+	if !errors.Is(err, ErrTooMany) {
+		t.Errorf("got %v, want ErrTooMany", err)
+	}
+	if len(*calls) != kMaxCommands {
+		t.Errorf("ran %d commands, want %d", len(*calls), kMaxCommands)
+	}
+
+	// The budget is per invocation.
+	*calls = nil
+	if err := Dispatch("!batch !record; !record", &Context{}); err != nil {
+		t.Errorf("a later batch: %v", err)
+	}
+	if len(*calls) != 2 {
+		t.Errorf("a later batch ran %d commands, want 2", len(*calls))
+	}
+}
+
+// Scripts each running the next ten times over would run a thousand commands
+// without a budget shared between them.
+func TestNestedBudget(t *testing.T) {
+	calls := withRecorder(t)
+	fanOut := func(cmd string) Script {
+		return Script{Owner:"a", Body:strings.Repeat(cmd + ";", 10)}
+	}
+	withScripts(t, map[string]Script{
+		"a":fanOut("!script run b"),
+		"b":fanOut("!script run c"),
+		"c":fanOut("!record"),
+	})
+
+	var ran int
+	original := Table["script"]
+	Table["script"] = Command{
+		Function:func(ctx *Context, action string, args ...string) error {
+			ran++
+			return script(ctx, action, args...)
+		},
+		Arity:1,}
+	t.Cleanup(func() { Table["script"] = original; })
+
+	Dispatch("!script run a", &Context{})
+	if total := ran - 1 + len(*calls); total > kMaxCommands {
+		t.Errorf("ran %d commands, more than the %d allowed", total, kMaxCommands)
+	}
+	if len(*calls) == 0 {
+		t.Error("no commands ran at all")
+	}
+}
+
+func TestNestedTooDeep(t *testing.T) {
+	withScripts(t, map[string]Script{"loop":{Owner:"a", Body:"!script run loop"}})
+	err := Dispatch("!script run loop", &Context{})
+	if err == nil {
+		t.Error("a script running itself didn't fail")
+	}
+}
@@ -10,6 +10,7 @@ type Command struct {
 	OptionalArgs []interface{}
 	Description  string
 	Usage        string
+	Permission   Permission // Who may use the command; anyone by default.
 }
 
 var Table = map[string]Command{}
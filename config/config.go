@@ -0,0 +1,309 @@
+/* Describes the bot's settings, and loads them from a configuration file.
+   Files may be written in JSON, TOML or YAML, as told by their extension. */
+package config
+
+import "github.com/BurntSushi/toml"
+import "gopkg.in/yaml.v3"
+import logs "github.com/zorodc/maobot/loggers"
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "time"
+
+const (
+	DefaultPort   = "64738"
+	DefaultPrefix = "!"
+)
+
+// A time.Duration written as text in configuration files, e.g. "1m30s".
+type Duration time.Duration
+
+func (this *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration, such as \"1m30s\"", text)
+	}
+	*this = Duration(d)
+	return nil
+}
+
+func (this Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(this).String()), nil
+}
+
+// How the bot tries to reconnect once disconnected by an error.
+// The delay doubles after each failed attempt, up to the maximum.
+type Reconnect struct {
+	Tries    uint     `json:"tries"     toml:"tries"     yaml:"tries"` // 0: unlimited
+	Delay    Duration `json:"delay"     toml:"delay"     yaml:"delay"`
+	MaxDelay Duration `json:"max_delay" toml:"max_delay" yaml:"max_delay"`
+}
+
+// How fast the bot sends chat messages: a burst at once, then one each
+// interval. Messages beyond the most queued are dropped.
+type Outbox struct {
+	Burst     uint     `json:"burst"      toml:"burst"      yaml:"burst"`
+	Interval  Duration `json:"interval"   toml:"interval"   yaml:"interval"` // 0: unlimited
+	MaxQueued uint     `json:"max_queued" toml:"max_queued" yaml:"max_queued"`
+}
+
+// How images linked in chat are fetched and posted. Private, loopback and
+// link-local addresses are refused unless allow_private is set.
+type Images struct {
+	MaxDownloadKB uint     `json:"max_download_kb" toml:"max_download_kb" yaml:"max_download_kb"`
+	MaxPerMessage uint     `json:"max_per_message" toml:"max_per_message" yaml:"max_per_message"` // 0 disables image fetching
+	Allow         []string `json:"allow"           toml:"allow"           yaml:"allow"` // Domains; any if empty.
+	Deny          []string `json:"deny"            toml:"deny"            yaml:"deny"`
+	AllowPrivate  bool     `json:"allow_private"   toml:"allow_private"   yaml:"allow_private"`
+	MaxRedirects  uint     `json:"max_redirects"   toml:"max_redirects"   yaml:"max_redirects"`
+	Timeout       Duration `json:"timeout"         toml:"timeout"         yaml:"timeout"` // 0: none
+}
+
+// A file entries of one kind of log are written to, instead of the console.
+// It is rotated once over MaxSizeMB, or daily, and the rotated files gzipped.
+type LogFile struct {
+	Path      string `json:"path"        toml:"path"        yaml:"path"`
+	MaxSizeMB uint   `json:"max_size_mb" toml:"max_size_mb" yaml:"max_size_mb"`
+	Daily     bool   `json:"daily"       toml:"daily"       yaml:"daily"`
+	Keep      uint   `json:"keep"        toml:"keep"        yaml:"keep"` // 0: all
+	Format    string `json:"format"      toml:"format"      yaml:"format"` // text or json
+}
+
+type Config struct {
+	Server   string   `json:"server"    toml:"server"    yaml:"server"`
+	Username string   `json:"username"  toml:"username"  yaml:"username"`
+	Password string   `json:"password"  toml:"password"  yaml:"password"`
+	Cert     string   `json:"cert"      toml:"cert"      yaml:"cert"`
+	Key      string   `json:"key"       toml:"key"       yaml:"key"`
+	CA       string   `json:"ca"        toml:"ca"        yaml:"ca"`
+	Insecure bool     `json:"insecure"  toml:"insecure"  yaml:"insecure"`
+	KnownServers string `json:"known_servers" toml:"known_servers" yaml:"known_servers"`
+	Timeout  Duration `json:"timeout"   toml:"timeout"   yaml:"timeout"`
+	DebugLog string   `json:"debug_log" toml:"debug_log" yaml:"debug_log"`
+	LogLevel string   `json:"log_level" toml:"log_level" yaml:"log_level"`
+	JSONLog  string   `json:"json_log"  toml:"json_log"  yaml:"json_log"`
+	// Log files by the kind of log: error, debug or interaction.
+	// debug_log is short for a debug log file with no rotation.
+	LogFiles map[string]LogFile `json:"log_files" toml:"log_files" yaml:"log_files"`
+	Prefix   string   `json:"prefix"    toml:"prefix"    yaml:"prefix"`
+	Channel  string   `json:"channel"   toml:"channel"   yaml:"channel"`
+	Owners   []string `json:"owners"    toml:"owners"    yaml:"owners"`
+	History  uint     `json:"history"   toml:"history"   yaml:"history"`
+	JobsFile string   `json:"jobs_file" toml:"jobs_file" yaml:"jobs_file"`
+	ScriptsFile string `json:"scripts_file" toml:"scripts_file" yaml:"scripts_file"`
+	// How much to log of each kind of event, by name, e.g.
+	// {"TextMessageEvent": "detailed", "UserChangeEvent.Comment": "brief"}.
+	EventLogs map[string]string `json:"event_logs" toml:"event_logs" yaml:"event_logs"`
+
+	Reconnect Reconnect `json:"reconnect" toml:"reconnect" yaml:"reconnect"`
+	Outbox    Outbox    `json:"outbox"    toml:"outbox"    yaml:"outbox"`
+	Images    Images    `json:"images"    toml:"images"    yaml:"images"`
+}
+
+// The settings used for anything not configured.
+func Default() *Config {
+	return &Config{
+		Timeout:Duration(4 * time.Second),
+		LogLevel:"debug",
+		Prefix:DefaultPrefix,
+		History:20,
+		Reconnect:Reconnect{Tries:8, Delay:Duration(300 * time.Millisecond),
+			MaxDelay:Duration(time.Minute)},
+		// Murmur's default flood limits.
+		Outbox:Outbox{Burst:5, Interval:Duration(time.Second), MaxQueued:256},
+		Images:Images{MaxDownloadKB:8 << 10, MaxPerMessage:3, MaxRedirects:5,
+			Timeout:Duration(10 * time.Second)},
+	}
+}
+
+// An error in the value of a particular field.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (this *FieldError) Error() string {
+	return fmt.Sprintf("config: field `%s`: %s", this.Field, this.Err.Error())
+}
+
+func (this *FieldError) Unwrap() error {
+	return this.Err
+}
+
+// Read the file at `path` over the defaults.
+// The result should be validated once any other overrides are applied.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err.Error())
+	}
+
+	conf := Default()
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = decodeJSON(data, conf)
+	case ".toml":
+		err = decodeTOML(data, conf)
+	case ".yaml", ".yml":
+		err = decodeYAML(data, conf)
+	default:
+		err = fmt.Errorf("config: unknown file type `%s` (use .json, .toml or .yaml)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func decodeJSON(data []byte, conf *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(conf)
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &FieldError{Field:typeErr.Field,
+			Err:fmt.Errorf("expected %s, not %s", typeErr.Type, typeErr.Value)}
+	}
+	if err != nil {
+		if fieldErr := locate(jsonDocument(data), reflect.TypeOf(*conf),
+			"json", ""); fieldErr != nil {
+			return fieldErr
+		}
+		return fmt.Errorf("config: %s", err.Error())
+	}
+	return nil
+}
+
+func decodeTOML(data []byte, conf *Config) error {
+	meta, err := toml.Decode(string(data), conf)
+	if err != nil {
+		// Not every version of the decoder names the setting.
+		var root toml.Primitive
+		if meta, rootErr := toml.Decode(string(data), &root); rootErr == nil {
+			if fieldErr := locate(tomlDocument{meta, root}, reflect.TypeOf(*conf),
+				"toml", ""); fieldErr != nil {
+				return fieldErr
+			}
+		}
+		return fmt.Errorf("config: %s", err.Error())
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return &FieldError{Field:undecoded[0].String(),
+			Err:errors.New("no such setting")}
+	}
+	return nil
+}
+
+func decodeYAML(data []byte, conf *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(conf); err != nil {
+		// The decoder's errors give the line, but not the setting.
+		var node yaml.Node
+		if yaml.Unmarshal(data, &node) == nil && len(node.Content) > 0 {
+			if fieldErr := locate(yamlDocument{node.Content[0]},
+				reflect.TypeOf(*conf), "yaml", ""); fieldErr != nil {
+				return fieldErr
+			}
+		}
+		return fmt.Errorf("config: %s", err.Error())
+	}
+	return nil
+}
+
+// Check that the settings are complete and consistent.
+func (this *Config) Validate() error {
+	switch {
+	case this.Server == "":
+		return &FieldError{Field:"server", Err:errors.New("no server given")}
+	case this.Username == "":
+		return &FieldError{Field:"username", Err:errors.New("no username given")}
+	case this.Prefix == "":
+		return &FieldError{Field:"prefix", Err:errors.New("must not be empty")}
+	case strings.ContainsAny(this.Prefix, " \t\n\""):
+		return &FieldError{Field:"prefix",
+			Err:errors.New("must not contain spaces or quotes")}
+	case (this.Cert == "") != (this.Key == ""):
+		field := "key"
+		if this.Cert == "" { field = "cert"; }
+		return &FieldError{Field:field,
+			Err:errors.New("cert and key must be given together")}
+	case this.Timeout < 0:
+		return &FieldError{Field:"timeout", Err:errors.New("must not be negative")}
+	case this.Reconnect.Delay < 0:
+		return &FieldError{Field:"reconnect.delay",
+			Err:errors.New("must not be negative")}
+	// Else the bot would hammer the server with attempts, without end.
+	case this.Reconnect.Delay == 0 && this.Reconnect.Tries == 0:
+		return &FieldError{Field:"reconnect.delay",
+			Err:errors.New("must be more than 0 while reconnect.tries is unlimited")}
+	case this.Reconnect.MaxDelay < this.Reconnect.Delay:
+		return &FieldError{Field:"reconnect.max_delay",
+			Err:errors.New("must not be less than reconnect.delay")}
+	case this.Outbox.Burst == 0:
+		return &FieldError{Field:"outbox.burst", Err:errors.New("must be at least 1")}
+	case this.Outbox.Interval < 0:
+		return &FieldError{Field:"outbox.interval",
+			Err:errors.New("must not be negative")}
+	case this.Outbox.MaxQueued == 0:
+		return &FieldError{Field:"outbox.max_queued",
+			Err:errors.New("must be at least 1")}
+	case this.Images.MaxDownloadKB == 0:
+		return &FieldError{Field:"images.max_download_kb",
+			Err:errors.New("must be at least 1")}
+	case this.Images.Timeout < 0:
+		return &FieldError{Field:"images.timeout",
+			Err:errors.New("must not be negative")}
+	}
+	if _, err := logs.ParseLevel(this.LogLevel); err != nil {
+		return &FieldError{Field:"log_level", Err:err}
+	}
+	for kind, file := range this.LogFiles {
+		field := "log_files." + kind
+		if _, err := logs.ParseLogKind(kind); err != nil {
+			return &FieldError{Field:field, Err:err}
+		}
+		if file.Path == "" {
+			return &FieldError{Field:field + ".path", Err:errors.New("no path given")}
+		}
+		if file.Format != "" && file.Format != "text" && file.Format != "json" {
+			return &FieldError{Field:field + ".format",
+				Err:errors.New("must be text or json")}
+		}
+	}
+	for name, verbosity := range this.EventLogs {
+		if _, err := logs.ParseVerbosity(verbosity); err != nil {
+			return &FieldError{Field:"event_logs." + name, Err:err}
+		}
+	}
+	return nil
+}
+
+// The log files to write, by kind, including the debug_log shorthand.
+func (this *Config) Logs() map[string]LogFile {
+	files := map[string]LogFile{}
+	if this.DebugLog != "" {
+		files["debug"] = LogFile{Path:this.DebugLog}
+	}
+	for kind, file := range this.LogFiles {
+		files[strings.ToLower(kind)] = file
+	}
+	return files
+}
+
+// The server's address, with the default port if none was given.
+func (this *Config) Address() string {
+	// A colon after any closing bracket marks a port, as in [::1]:64738.
+	host := this.Server[strings.LastIndex(this.Server, "]")+1:]
+	if strings.Contains(host, ":") {
+		return this.Server
+	}
+	return this.Server + ":" + DefaultPort
+}
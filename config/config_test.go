@@ -0,0 +1,161 @@
+package config
+
+import "errors"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func load(t *testing.T, name, contents string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad(t *testing.T) {
+	files := map[string]string{
+		"bot.json":"{\"server\": \"example.com\", \"timeout\": \"9s\", \"history\": 5,\n" +
+			"\"reconnect\": {\"delay\": \"1s\"}}",
+		"bot.toml":"server = \"example.com\"\ntimeout = \"9s\"\nhistory = 5\n" +
+			"[reconnect]\ndelay = \"1s\"\n",
+		"bot.yaml":"server: example.com\ntimeout: 9s\nhistory: 5\n" +
+			"reconnect:\n  delay: 1s\n",
+	}
+	for name, contents := range files {
+		conf, err := load(t, name, contents)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if conf.Server != "example.com" || conf.Timeout != Duration(9*time.Second) ||
+			conf.History != 5 || conf.Reconnect.Delay != Duration(time.Second) {
+			t.Errorf("%s: got %+v", name, conf)
+		}
+		// Unset settings keep their defaults.
+		if conf.Reconnect.Tries != Default().Reconnect.Tries {
+			t.Errorf("%s: reconnect.tries = %d, want the default", name, conf.Reconnect.Tries)
+		}
+	}
+}
+
+// Every setting that fails to decode is named in the error.
+func TestLoadNamesField(t *testing.T) {
+	tests := []struct {
+		name, contents, field string
+	}{
+		{"bot.json", `{"timeout": "abc"}`, "timeout"},
+		{"bot.json", `{"history": "abc"}`, "history"},
+		{"bot.json", `{"reconnect": {"max_delay": "abc"}}`, "reconnect.max_delay"},
+		{"bot.json", `{"images": {"timeout": 10}}`, "images.timeout"},
+		{"bot.json", `{"log_files": {"debug": {"keep": "all"}}}`, "log_files.debug.keep"},
+		{"bot.json", `{"nonsense": 1}`, ""},
+
+		{"bot.yaml", "timeout: abc\n", "timeout"},
+		{"bot.yaml", "history: abc\n", "history"},
+		{"bot.yaml", "server: x\nreconnect:\n  max_delay: abc\n", "reconnect.max_delay"},
+		{"bot.yaml", "owners: 3\n", "owners"},
+		{"bot.yaml", "log_files:\n  debug:\n    keep: all\n", "log_files.debug.keep"},
+		{"bot.yaml", "reconnect: 5\n", "reconnect"},
+
+		{"bot.toml", "nonsense = 1\n", "nonsense"},
+		{"bot.toml", "timeout = \"abc\"\n", "timeout"},
+		{"bot.toml", "history = \"abc\"\n", "history"},
+		{"bot.toml", "[reconnect]\nmax_delay = \"abc\"\n", "reconnect.max_delay"},
+		{"bot.toml", "[log_files.debug]\nkeep = \"all\"\n", "log_files.debug.keep"},
+		{"bot.toml", "owners = 3\n", "owners"},
+	}
+	for _, test := range tests {
+		_, err := load(t, test.name, test.contents)
+		if err == nil {
+			t.Errorf("%s %q: no error", test.name, test.contents)
+			continue
+		}
+		var fieldErr *FieldError
+		isField := errors.As(err, &fieldErr)
+		switch {
+		case test.field == "" && isField:
+			t.Errorf("%s %q: got a field error, %v", test.name, test.contents, err)
+		case test.field != "" && (!isField || fieldErr.Field != test.field):
+			t.Errorf("%s %q: got %v, want an error in `%s`",
+				test.name, test.contents, err, test.field)
+		}
+	}
+}
+
+func TestLoadDurationMessage(t *testing.T) {
+	for name, contents := range map[string]string{
+		"bot.json":`{"timeout": "abc"}`, "bot.yaml":"timeout: abc\n",
+		"bot.toml":"timeout = \"abc\"\n",
+	} {
+		_, err := load(t, name, contents)
+		if err == nil || !strings.Contains(err.Error(), `"abc" is not a duration`) ||
+			!strings.Contains(err.Error(), "field `timeout`") {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestLoadSyntaxError(t *testing.T) {
+	for name, contents := range map[string]string{
+		"bot.json":`{"timeout": `, "bot.yaml":"timeout: [", "bot.toml":"timeout = ",
+	} {
+		_, err := load(t, name, contents)
+		var fieldErr *FieldError
+		if err == nil || errors.As(err, &fieldErr) {
+			t.Errorf("%s: got %v, want a syntax error", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf := Default()
+	conf.Server, conf.Username = "example.com", "bot"
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	tests := []struct {
+		change func(*Config)
+		field  string // In error, or "" if valid.
+	}{
+		{func(c *Config) { c.Reconnect.MaxDelay = c.Reconnect.Delay - 1; }, "reconnect.max_delay"},
+		{func(c *Config) { c.Reconnect.Delay = -1; }, "reconnect.delay"},
+		// No delay between a limited number of tries is allowed, but not
+		// between unlimited tries.
+		{func(c *Config) { c.Reconnect.Delay, c.Reconnect.MaxDelay = 0, 0; }, ""},
+		{func(c *Config) {
+			c.Reconnect.Delay, c.Reconnect.MaxDelay, c.Reconnect.Tries = 0, 0, 0
+		}, "reconnect.delay"},
+		{func(c *Config) { c.Reconnect.Tries = 0; }, ""},
+	}
+	for i, test := range tests {
+		changed := *conf
+		test.change(&changed)
+		err := changed.Validate()
+		var fieldErr *FieldError
+		switch {
+		case test.field == "" && err != nil:
+			t.Errorf("change %d: %v", i+1, err)
+		case test.field != "" && (!errors.As(err, &fieldErr) || fieldErr.Field != test.field):
+			t.Errorf("change %d: got %v, want an error in %s", i+1, err, test.field)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+	for server, want := range map[string]string{
+		"example.com":"example.com:" + DefaultPort,
+		"example.com:1234":"example.com:1234",
+		"[::1]":"[::1]:" + DefaultPort,
+		"[::1]:1234":"[::1]:1234",
+	} {
+		conf := Config{Server:server}
+		if got := conf.Address(); got != want {
+			t.Errorf("Address of %q = %q, want %q", server, got, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/* Finds which setting a decoder failed on, for errors that don't say. */
+package config
+
+import "github.com/BurntSushi/toml"
+import "gopkg.in/yaml.v3"
+
+import "encoding"
+import "encoding/json"
+import "reflect"
+import "sort"
+import "strings"
+
+// A value in a configuration file, as its format sees it.
+type document interface {
+	// The entries of a mapping by key, or false if it isn't a mapping.
+	entries() (map[string]document, bool)
+	decode(into interface{}) error
+}
+
+type jsonDocument json.RawMessage
+
+func (this jsonDocument) entries() (map[string]document, bool) {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(this, &raw) != nil || raw == nil {
+		return nil, false
+	}
+	entries := make(map[string]document, len(raw))
+	for key, value := range raw {
+		entries[key] = jsonDocument(value)
+	}
+	return entries, true
+}
+
+func (this jsonDocument) decode(into interface{}) error {
+	return json.Unmarshal(this, into)
+}
+
+type yamlDocument struct{ node *yaml.Node }
+
+func (this yamlDocument) entries() (map[string]document, bool) {
+	if this.node.Kind != yaml.MappingNode {
+		return nil, false
+	}
+	entries := make(map[string]document, len(this.node.Content)/2)
+	for i := 0; i+1 < len(this.node.Content); i += 2 {
+		entries[this.node.Content[i].Value] = yamlDocument{this.node.Content[i+1]}
+	}
+	return entries, true
+}
+
+func (this yamlDocument) decode(into interface{}) error {
+	err := this.node.Decode(into)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// Drop the "yaml: unmarshal errors:" header; the field is named instead.
+		return &yamlErrors{typeErr.Errors}
+	}
+	return err
+}
+
+type tomlDocument struct {
+	meta  toml.MetaData
+	value toml.Primitive
+}
+
+func (this tomlDocument) entries() (map[string]document, bool) {
+	var raw map[string]toml.Primitive
+	if this.meta.PrimitiveDecode(this.value, &raw) != nil || raw == nil {
+		return nil, false
+	}
+	entries := make(map[string]document, len(raw))
+	for key, value := range raw {
+		entries[key] = tomlDocument{this.meta, value}
+	}
+	return entries, true
+}
+
+func (this tomlDocument) decode(into interface{}) error {
+	return this.meta.PrimitiveDecode(this.value, into)
+}
+
+type yamlErrors struct{ errors []string }
+
+func (this *yamlErrors) Error() string {
+	return strings.Join(this.errors, "; ")
+}
+
+var gTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Find the first setting in `doc` that can't be decoded into its field of
+// `typ`, whose fields are named by the struct tag `tag`, by decoding each on
+// its own. Returns nil if none is found, e.g. for a syntax error.
+func locate(doc document, typ reflect.Type, tag string, path string) *FieldError {
+	entries, isMapping := doc.entries()
+	custom := reflect.PointerTo(typ).Implements(gTextUnmarshaler)
+	switch {
+	case isMapping && !custom && typ.Kind() == reflect.Struct:
+		for _, key := range sortedKeys(entries) {
+			field, ok := fieldByTag(typ, tag, key)
+			// Unknown settings are already reported by the decoder.
+			if !ok { continue; }
+			if err := locate(entries[key], field.Type, tag, join(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case isMapping && !custom && typ.Kind() == reflect.Map:
+		for _, key := range sortedKeys(entries) {
+			if err := locate(entries[key], typ.Elem(), tag, join(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if path == "" { return nil; }
+	if err := doc.decode(reflect.New(typ).Interface()); err != nil {
+		return &FieldError{Field:path, Err:err}
+	}
+	return nil
+}
+
+// The field of a struct named `key` by its `tag` tags.
+func fieldByTag(typ reflect.Type, tag, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func sortedKeys(entries map[string]document) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func join(path, key string) string {
+	if path == "" { return key; }
+	return path + "." + key
+}
@@ -96,3 +96,27 @@ func Call(function RtFunc,
 	return returnLst, nil
 }
 
+
+// Determine whether `function` takes `value` as its first parameter, that is,
+// whether CallWith would pass `value` to it. Only a first parameter of exactly
+// `value`'s type asks for it; one it merely satisfies, such as interface{},
+// is left for an argument. A variadic first parameter never asks for it.
+func TakesFirst(function RtFunc, value interface{}) bool {
+	funcType := reflect.TypeOf(function)
+	if funcType.NumIn() == 0 ||
+		(funcType.IsVariadic() && funcType.NumIn() == 1) {
+		return false
+	}
+	return funcType.In(0) == reflect.TypeOf(value)
+}
+
+// Executes a dynamic function call, as Call does, but injects `value` as the
+// first parameter if the function asks for it. This lets callers supply
+// context that only some functions care about.
+func CallWith(value interface{}, function RtFunc,
+	parameters ...interface{}) ([]interface{}, error) {
+	if TakesFirst(function, value) {
+		parameters = append([]interface{}{value}, parameters...)
+	}
+	return Call(function, parameters...)
+}
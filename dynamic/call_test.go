@@ -0,0 +1,38 @@
+package dynamic
+
+import "testing"
+
+type context struct{ name string }
+
+func TestTakesFirst(t *testing.T) {
+	ctx := &context{"ctx"}
+	tests := []struct {
+		name     string
+		function RtFunc
+		want     bool
+	}{
+		{"exact type", func(*context, string) {}, true},
+		{"exact type only", func(*context) {}, true},
+		{"no parameters", func() {}, false},
+		{"other type", func(string) {}, false},
+		{"empty interface", func(interface{}) {}, false},
+		{"empty interface then more", func(interface{}, string) {}, false},
+		{"variadic", func(...*context) {}, false},
+	}
+	for _, test := range tests {
+		if got := TakesFirst(test.function, ctx); got != test.want {
+			t.Errorf("%s: TakesFirst = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCallWithInterfaceParameter(t *testing.T) {
+	var got interface{}
+	_, err := CallWith(&context{"ctx"}, func(arg interface{}) { got = arg; }, "argument")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "argument" {
+		t.Errorf("interface{} parameter received %v, want the argument", got)
+	}
+}
@@ -1,31 +1,178 @@
+/* Passes events on to whoever subscribes to them.
+   Each subscriber receives the events of the type it asks for, optionally
+   filtered, through a buffered channel drained by a goroutine of its own, so
+   that a slow subscriber doesn't hold up the poster, nor others. A subscriber
+   which panics is logged and carries on with the next event. */
 package eventstream
 
-type EventRecipient func(interface{})bool
+import logs "github.com/zorodc/maobot/loggers"
 
-var recipients []EventRecipient
+import "runtime/debug"
+import "sync"
+import "sync/atomic"
 
-// Signal to all recipients that an event has occurred.
-func PostEvent(event interface{}) {
-	var done []uint
-	for idx, recipient := range recipients {
-		// Create a list of recipients to remove.
-		if recipient(event) {
-			done = append(done, uint(idx))
+// What to do with an event when a subscriber's buffer is full.
+type Policy int
+
+const (
+	Block Policy = iota // Wait for room, holding up the poster.
+	Drop                // Discard the event.
+)
+
+// The buffer subscribers have, unless told otherwise.
+const kDefaultBuffer = 64
+
+type options struct {
+	buffer int
+	policy Policy
+}
+
+type Option func(*options)
+
+// Buffer up to `n` events not yet handled.
+func Buffered(n int) Option {
+	return func(this *options) { this.buffer = n; }
+}
+
+func WithPolicy(policy Policy) Option {
+	return func(this *options) { this.policy = policy; }
+}
+
+// A subscription to events, until Unsubscribe is called.
+type Subscription struct {
+	accept  func(interface{}) bool
+	handle  func(interface{})
+	policy  Policy
+	events  chan interface{}
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+}
+
+var gSubscribers struct {
+	sync.RWMutex
+	list []*Subscription
+}
+
+// Have `handler` called with each event of type T posted from now on.
+func Subscribe[T any](handler func(T), opts ...Option) *Subscription {
+	return SubscribeWhere(nil, handler, opts...)
+}
+
+// Have `handler` called with each event of type T for which `filter` is true.
+// A nil filter accepts every event of the type.
+func SubscribeWhere[T any](filter func(T) bool, handler func(T),
+	opts ...Option) *Subscription {
+	config := options{buffer:kDefaultBuffer, policy:Block}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	this := &Subscription{
+		accept:func(e interface{}) bool {
+			event, ok := e.(T)
+			return ok && (filter == nil || filter(event))
+		},
+		handle:func(e interface{}) { handler(e.(T)); },
+		policy:config.policy,
+		events:make(chan interface{}, config.buffer),
+		done:make(chan struct{}),
+	}
+
+	gSubscribers.Lock()
+	gSubscribers.list = append(gSubscribers.list, this)
+	gSubscribers.Unlock()
+
+	go this.run()
+	return this
+}
+
+// Stop receiving events. Events already buffered are discarded, though one
+// may still be being handled as this returns. Safe to call more than once,
+// and from within the handler.
+func (this *Subscription) Unsubscribe() {
+	this.once.Do(func() {
+		gSubscribers.Lock()
+		for i, sub := range gSubscribers.list {
+			if sub == this {
+				gSubscribers.list = append(gSubscribers.list[:i:i],
+					gSubscribers.list[i+1:]...)
+				break
+			}
+		}
+		gSubscribers.Unlock()
+		close(this.done)
+	})
+}
+
+// The number of events discarded because the buffer was full.
+func (this *Subscription) Dropped() uint64 {
+	return this.dropped.Load()
+}
+
+func (this *Subscription) run() {
+	for {
+		select {
+		case <-this.done:
+			return
+		case event := <-this.events:
+			// Unsubscribing wins over events buffered before it.
+			select {
+			case <-this.done:
+				return
+			default:
+			}
+			this.call(event)
+		}
+	}
+}
+
+// Handle an event, surviving any panic in the handler.
+func (this *Subscription) call(event interface{}) {
+	defer recovered(event)
+	this.handle(event)
+}
+
+// Check an event against the filter, taking a panic in it as a no.
+func (this *Subscription) accepts(event interface{}) (ok bool) {
+	defer recovered(event)
+	return this.accept(event)
+}
+
+func recovered(event interface{}) {
+	if r := recover(); r != nil {
+		// Error logs may be posted to the channel, so the stack goes elsewhere.
+		logs.Logf(logs.ErrorLogs, "Event subscriber panicked on %T: %v.", event, r)
+		logs.Logf(logs.DebugLogs, "Stack of the panic on %T:\n%s", event, debug.Stack())
+	}
+}
+
+func (this *Subscription) deliver(event interface{}) {
+	if !this.accepts(event) { return; }
+
+	if this.policy == Drop {
+		select {
+		case this.events <- event:
+		case <-this.done:
+		default:
+			this.dropped.Add(1)
 		}
+		return
 	}
-	var nremoved uint;
-	for _, idx := range done {
-		// Adjust for the recipients already removed from the slice.
-		// e.g. If we removed one earlier in the list, the next removal needs to
-		// adjust by 1.
-		idx -= nremoved
-		// Remove a single element.
-		recipients = append(recipients[:idx], recipients[idx+1:]...)
-		nremoved++
+	select {
+	case this.events <- event:
+	case <-this.done:
 	}
-	
 }
 
-func PostRecipient(er EventRecipient) {
-	recipients = append(recipients, er)
+// Signal to all subscribers that an event has occurred.
+// Filters are run by the poster, so should be quick.
+func PostEvent(event interface{}) {
+	gSubscribers.RLock()
+	subscribers := append([]*Subscription(nil), gSubscribers.list...)
+	gSubscribers.RUnlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.deliver(event)
+	}
 }
@@ -0,0 +1,271 @@
+package eventstream
+
+import "sync"
+import "testing"
+import "time"
+
+// Event types of the tests' own, so that they don't see each other's events.
+type ping struct{ n int }
+type pong struct{ n int }
+type slow struct{ n int }
+type boom struct{ n int }
+
+// Collect the events a subscriber handles, in order.
+type collector[T any] struct {
+	mu     sync.Mutex
+	events []T
+}
+
+func (this *collector[T]) handle(event T) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.events = append(this.events, event)
+}
+
+func (this *collector[T]) got() []T {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]T(nil), this.events...)
+}
+
+// Wait for the collector to have `n` events.
+func (this *collector[T]) await(t *testing.T, n int) []T {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := this.got()
+		if len(events) >= n { return events; }
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait a moment, and check nothing more has arrived.
+func (this *collector[T]) settled(t *testing.T, n int) {
+	t.Helper()
+	time.Sleep(20 * time.Millisecond)
+	if events := this.got(); len(events) != n {
+		t.Errorf("got %d events, want %d", len(events), n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	var pings collector[ping]
+	var pongs collector[*pong]
+	subPing := Subscribe(pings.handle)
+	subPong := Subscribe(pongs.handle)
+	defer subPing.Unsubscribe()
+	defer subPong.Unsubscribe()
+
+	for i := 0; i < 10; i++ {
+		PostEvent(ping{i})
+		PostEvent(&pong{i})
+		PostEvent(pong{i}) // Not a *pong, so nobody's.
+	}
+	events := pings.await(t, 10)
+	for i, event := range events {
+		if event.n != i {
+			t.Fatalf("event %d is %v; events arrived out of order", i, event)
+		}
+	}
+	pongs.await(t, 10)
+	pings.settled(t, 10)
+	pongs.settled(t, 10)
+}
+
+func TestSubscribeWhere(t *testing.T) {
+	var evens collector[ping]
+	sub := SubscribeWhere(func(e ping) bool { return e.n % 2 == 0; }, evens.handle)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 10; i++ {
+		PostEvent(ping{i})
+	}
+	for _, event := range evens.await(t, 5) {
+		if event.n % 2 != 0 {
+			t.Errorf("the filter let %v through", event)
+		}
+	}
+	evens.settled(t, 5)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	var pings collector[ping]
+	sub := Subscribe(pings.handle)
+	PostEvent(ping{1})
+	pings.await(t, 1)
+
+	sub.Unsubscribe()
+	sub.Unsubscribe() // Harmless.
+	PostEvent(ping{2})
+	pings.settled(t, 1)
+}
+
+func TestUnsubscribeFromHandler(t *testing.T) {
+	var pings collector[ping]
+	var sub *Subscription
+	var ready sync.WaitGroup
+	ready.Add(1)
+	sub = Subscribe(func(e ping) {
+		ready.Wait()
+		pings.handle(e)
+		sub.Unsubscribe()
+	})
+	ready.Done()
+
+	PostEvent(ping{1})
+	pings.await(t, 1)
+	PostEvent(ping{2})
+	pings.settled(t, 1)
+}
+
+func TestDropPolicy(t *testing.T) {
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	var handled collector[slow]
+	sub := Subscribe(func(e slow) {
+		started <- struct{}{}
+		<-release
+		handled.handle(e)
+	}, Buffered(2), WithPolicy(Drop))
+	defer sub.Unsubscribe()
+
+	// One event is taken by the handler, two fill the buffer, and the rest
+	// are dropped without holding up the poster.
+	PostEvent(slow{0})
+	<-started
+	posted := make(chan struct{})
+	go func() {
+		for i := 1; i < 10; i++ {
+			PostEvent(slow{i})
+		}
+		close(posted)
+	}()
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poster was held up by a full subscriber")
+	}
+	if dropped := sub.Dropped(); dropped != 7 {
+		t.Errorf("dropped %d events, want 7", dropped)
+	}
+
+	close(release)
+	events := handled.await(t, 3)
+	for i, want := range []int{0, 1, 2} {
+		if events[i].n != want {
+			t.Errorf("handled %v, want the first three", events)
+			break
+		}
+	}
+	handled.settled(t, 3)
+}
+
+func TestBlockPolicy(t *testing.T) {
+	release := make(chan struct{})
+	var handled collector[pong]
+	sub := Subscribe(func(e pong) {
+		<-release
+		handled.handle(e)
+	}, Buffered(1), WithPolicy(Block))
+	defer sub.Unsubscribe()
+
+	posted := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			PostEvent(pong{i})
+		}
+		close(posted)
+	}()
+	select {
+	case <-posted:
+		t.Fatal("the poster wasn't held up by a full subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poster stayed held up once there was room")
+	}
+	handled.await(t, 5)
+	if sub.Dropped() != 0 {
+		t.Errorf("dropped %d events with the Block policy", sub.Dropped())
+	}
+}
+
+// A blocked poster is let go once the subscriber it waits on unsubscribes.
+func TestBlockedPosterUnsubscribe(t *testing.T) {
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	defer close(release)
+	sub := Subscribe(func(e slow) {
+		started <- struct{}{}
+		<-release
+	}, Buffered(0), WithPolicy(Block))
+
+	PostEvent(slow{0}) // Taken by the handler, which then waits.
+	<-started
+	posted := make(chan struct{})
+	go func() {
+		PostEvent(slow{1})
+		close(posted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sub.Unsubscribe()
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poster stayed blocked after unsubscribing")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var handled collector[boom]
+	sub := Subscribe(func(e boom) {
+		if e.n == 1 { panic("boom"); }
+		handled.handle(e)
+	})
+	defer sub.Unsubscribe()
+	// A panicking filter rejects the event, rather than crashing the poster.
+	var filtered collector[boom]
+	subWhere := SubscribeWhere(func(e boom) bool {
+		if e.n == 2 { panic("boom"); }
+		return true
+	}, filtered.handle)
+	defer subWhere.Unsubscribe()
+
+	for i := 0; i < 4; i++ {
+		PostEvent(boom{i})
+	}
+	events := handled.await(t, 3)
+	if events[0].n != 0 || events[1].n != 2 || events[2].n != 3 {
+		t.Errorf("handled %v after a panic, want 0, 2 and 3", events)
+	}
+	events = filtered.await(t, 3)
+	if events[0].n != 0 || events[1].n != 1 || events[2].n != 3 {
+		t.Errorf("filtered %v, want 0, 1 and 3", events)
+	}
+}
+
+// Subscribe, post and unsubscribe from many goroutines at once, for the race
+// detector to check.
+func TestConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var pings collector[ping]
+			sub := Subscribe(pings.handle, Buffered(4), WithPolicy(Drop))
+			for j := 0; j < 100; j++ {
+				PostEvent(ping{j})
+			}
+			sub.Unsubscribe()
+		}()
+	}
+	wg.Wait()
+}
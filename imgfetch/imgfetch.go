@@ -2,10 +2,46 @@ package imgfetch
 
 import "encoding/base64"
 import "bytes"
-import "strings"
-import "io/ioutil"
+import "fmt"
+import "io"
 import "net/http"
+import neturl "net/url"
 import "errors"
+import "sync"
+
+// The most bytes downloaded of an image, unless told otherwise.
+const kDefaultMaxDownload = 8 << 20
+
+var gLimits struct {
+	sync.Mutex
+	download int64 // The most bytes of an image to download.
+	message  uint  // The longest image message the server accepts; 0 if unknown.
+}
+
+func init() {
+	gLimits.download = kDefaultMaxDownload
+}
+
+// Refuse to download images larger than `bytes`.
+func SetMaxDownload(bytes int64) {
+	gLimits.Lock()
+	defer gLimits.Unlock()
+	gLimits.download = bytes
+}
+
+// Shrink images until their messages are at most `length` bytes long, the
+// server's MaximumImageMessageLength. No limit if 0.
+func SetMaxMessageLen(length uint) {
+	gLimits.Lock()
+	defer gLimits.Unlock()
+	gLimits.message = length
+}
+
+func limits() (download int64, message uint) {
+	gLimits.Lock()
+	defer gLimits.Unlock()
+	return gLimits.download, gLimits.message
+}
 
 func encode(data []byte) (encoded []byte) {
 	buffer  := bytes.NewBuffer(nil)
@@ -15,6 +51,16 @@ func encode(data []byte) (encoded []byte) {
 	return buffer.Bytes()
 }
 
+// The message showing an image, given it encoded in base64.
+func Message(data []byte, mimetype string) string {
+	return `<img src="data:` + mimetype + `;base64,` + string(data) + `"/>`
+}
+
+// The length of the message showing `size` bytes of an image.
+func messageLen(size int, mimetype string) uint {
+	return uint(len(Message(nil, mimetype)) + base64.StdEncoding.EncodedLen(size))
+}
+
 // The set of supported mimetypes.
 var supported = map[string]struct{} {
 	"image/png":struct{}{},
@@ -26,29 +72,58 @@ var supported = map[string]struct{} {
 	//	"image/svg+xml":struct{}{},
 }
 
+// Fetch the image at `url`, encoded in base64, if the policy allows it.
+// URLs starting with www. are fetched over https.
+// Images too large for the server's image messages are shrunk, and
+// re-encoded as JPEG, to fit.
 func FetchImage(url string) (data []byte, mimetype string, ok error) {
-	if !(strings.HasPrefix(url, "http://")  ||
-		  strings.HasPrefix(url, "https://") ||
-		  strings.HasPrefix(url, "www.")) {
+	if url = normalizeURL(url); url == "" {
 		ok = errors.New("Argument not a URL.")
 		return
 	}
+	maxDownload, maxMessage := limits()
+
+	httpClient, policy := client()
+	target, ok := neturl.Parse(url)
+	if ok != nil {
+		return
+	}
+	if ok = policy.checkURL(target); ok != nil {
+		return
+	}
 
-	response, ok := http.Get(url)
+	response, ok := httpClient.Get(url)
 	if ok == nil {
 		defer response.Body.Close()
 	} else { return; }
 
-	bytes, ok := ioutil.ReadAll(response.Body)
+	if response.ContentLength > maxDownload {
+		ok = fmt.Errorf("Image is larger than %d bytes.", maxDownload)
+		return
+	}
+	// Read a byte past the limit, to tell if the image goes over it.
+	bytes, ok := io.ReadAll(io.LimitReader(response.Body, maxDownload+1))
 	if ok != nil {
 		return
 	}
+	if int64(len(bytes)) > maxDownload {
+		ok = fmt.Errorf("Image is larger than %d bytes.", maxDownload)
+		return
+	}
 
-	if _, in := supported[http.DetectContentType(bytes)]; !in {
+	mimetype = http.DetectContentType(bytes)
+	if _, in := supported[mimetype]; !in {
 		ok = errors.New("Url does not point to an acceptible mimetype.")
 		return
 	}
 
+	if maxMessage > 0 && messageLen(len(bytes), mimetype) > maxMessage {
+		if bytes, ok = shrink(bytes, maxMessage); ok != nil {
+			return
+		}
+		mimetype = "image/jpeg"
+	}
+
 	data = encode(bytes)
 	return
 }
@@ -0,0 +1,199 @@
+package imgfetch
+
+import "bytes"
+import "encoding/base64"
+import "encoding/binary"
+import "errors"
+import "hash/crc32"
+import "image"
+import "image/color"
+import "image/png"
+import "math/rand"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "testing"
+
+import _ "image/jpeg"
+
+// A PNG of `width` by `height` pixels of noise, which doesn't compress, so
+// that its size follows from its dimensions.
+func noisyPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(random.Intn(256))
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// The start of a PNG claiming to be `width` by `height` pixels, which is as
+// far as a header is read.
+func pngHeader(width, height uint32) []byte {
+	var chunk bytes.Buffer
+	chunk.WriteString("IHDR")
+	binary.Write(&chunk, binary.BigEndian, width)
+	binary.Write(&chunk, binary.BigEndian, height)
+	chunk.Write([]byte{8, 6, 0, 0, 0}) // 8 bits of RGBA, not interlaced.
+
+	var data bytes.Buffer
+	data.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&data, binary.BigEndian, uint32(chunk.Len()-4))
+	data.Write(chunk.Bytes())
+	binary.Write(&data, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()))
+	return data.Bytes()
+}
+
+// Serve `handler` over HTTP, letting the bot fetch from loopback meanwhile,
+// and restore the defaults after.
+func serve(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	_, old := client()
+	SetPolicy(Policy{AllowPrivate:true, MaxRedirects:5})
+	t.Cleanup(func() {
+		server.Close()
+		SetPolicy(old)
+		SetMaxDownload(kDefaultMaxDownload)
+		SetMaxMessageLen(0)
+	})
+	return server.URL
+}
+
+// Serve `data` with its length given.
+func serveBytes(t *testing.T, data []byte) string {
+	return serve(t, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		writer.Write(data)
+	})
+}
+
+func decodeFetched(t *testing.T, data []byte) ([]byte, image.Image) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("the image fetched doesn't decode: %v", err)
+	}
+	return raw, img
+}
+
+func TestFetchImage(t *testing.T) {
+	original := noisyPNG(t, 20, 10)
+	url := serveBytes(t, original)
+	data, mimetype, err := FetchImage(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimetype != "image/png" {
+		t.Errorf("the mimetype is %s, want image/png", mimetype)
+	}
+	if raw, _ := decodeFetched(t, data); !bytes.Equal(raw, original) {
+		t.Error("the image fetched isn't the one served")
+	}
+}
+
+func TestFetchNotImage(t *testing.T) {
+	url := serveBytes(t, []byte("<html><body>Hello</body></html>"))
+	if _, _, err := FetchImage(url); err == nil {
+		t.Error("no error fetching HTML")
+	}
+}
+
+func TestDownloadCap(t *testing.T) {
+	data := noisyPNG(t, 30, 30)
+	url := serveBytes(t, data)
+
+	SetMaxDownload(int64(len(data)))
+	if _, _, err := FetchImage(url); err != nil {
+		t.Errorf("an image exactly at the cap: %v", err)
+	}
+	// Refused on its Content-Length alone.
+	SetMaxDownload(int64(len(data)) - 1)
+	if _, _, err := FetchImage(url); err == nil {
+		t.Error("no error for an image over the cap")
+	}
+}
+
+// An image streamed without a Content-Length is cut off once past the cap.
+func TestDownloadCapStreamed(t *testing.T) {
+	data := noisyPNG(t, 30, 30)
+	url := serve(t, func(writer http.ResponseWriter, request *http.Request) {
+		for start := 0; start < len(data); start += 256 {
+			if _, err := writer.Write(data[start:min(start+256, len(data))]); err != nil {
+				return
+			}
+			writer.(http.Flusher).Flush()
+		}
+	})
+
+	SetMaxDownload(int64(len(data)))
+	if _, _, err := FetchImage(url); err != nil {
+		t.Errorf("a streamed image exactly at the cap: %v", err)
+	}
+	SetMaxDownload(int64(len(data)) - 1)
+	if _, _, err := FetchImage(url); err == nil {
+		t.Error("no error for a streamed image over the cap")
+	}
+}
+
+func TestShrinkToFit(t *testing.T) {
+	original := noisyPNG(t, 200, 150)
+	url := serveBytes(t, original)
+	const max = 20000
+	if messageLen(len(original), "image/png") <= max {
+		t.Fatal("the image already fits")
+	}
+
+	SetMaxMessageLen(max)
+	data, mimetype, err := FetchImage(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimetype != "image/jpeg" {
+		t.Errorf("the mimetype is %s, want image/jpeg", mimetype)
+	}
+	if length := len(Message(data, mimetype)); length > max {
+		t.Errorf("the message is %d bytes long, over the %d allowed", length, max)
+	}
+	_, img := decodeFetched(t, data)
+	bounds := img.Bounds()
+	if bounds.Dx() > 200 || bounds.Dy() > 150 || bounds.Dx() < kMinSide {
+		t.Errorf("shrunk to %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	// The aspect ratio is kept, give or take rounding.
+	if ratio := float64(bounds.Dx()) / float64(bounds.Dy()); ratio < 1.2 || ratio > 1.45 {
+		t.Errorf("shrunk to %dx%d, out of proportion", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestShrinkTooLarge(t *testing.T) {
+	if _, err := shrink(noisyPNG(t, 100, 100), 200); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+// An image claiming more pixels than allowed is refused before they're
+// decoded, which would otherwise take gigabytes.
+func TestShrinkPixelCap(t *testing.T) {
+	if _, err := shrink(pngHeader(100000, 100000), 1000); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("got %v, want ErrTooManyPixels", err)
+	}
+}
+
+// JPEG has no transparency, so it's drawn over white.
+func TestFlatten(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	img.Set(0, 0, color.NRGBA{})
+	if flat := flatten(img); flat.RGBAAt(0, 0) != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("a transparent pixel flattened to %v", flat.RGBAAt(0, 0))
+	}
+}
@@ -0,0 +1,92 @@
+/* Finds the links in a message, whether sent as HTML anchors by desktop
+   clients or as plain text by mobile ones, and fetches the images among them. */
+package imgfetch
+
+import "html"
+import "regexp"
+import "strings"
+
+// The most links in one message tried, however few of them are images.
+const kMaxLinksTried = 10
+
+var (
+	hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	tagPattern  = regexp.MustCompile(`<[^>]*>`)
+	urlPattern  = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+)
+
+type Image struct {
+	Data     []byte // Encoded in base64.
+	Mimetype string
+}
+
+// Give a URL without a scheme, such as www.example.com, the https scheme.
+// Returns "" for anything else that isn't http or https.
+func normalizeURL(url string) string {
+	lower := strings.ToLower(url)
+	switch {
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return url
+	case strings.HasPrefix(lower, "www."):
+		return "https://" + url
+	}
+	return ""
+}
+
+// The URLs linked in a message of HTML, each once: the targets of its
+// anchors, then any written out in its text.
+func FindURLs(message string) []string {
+	var urls []string
+	seen := map[string]bool{}
+	add := func(url string) {
+		if url = normalizeURL(url); url != "" && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+
+	for _, match := range hrefPattern.FindAllStringSubmatch(message, -1) {
+		add(html.UnescapeString(match[1] + match[2] + match[3]))
+	}
+	text := html.UnescapeString(tagPattern.ReplaceAllString(message, " "))
+	for _, url := range urlPattern.FindAllString(text, -1) {
+		add(trimURL(url))
+	}
+	return urls
+}
+
+// Trim the punctuation a URL written in a sentence is likely followed by,
+// keeping closing brackets that have an opening one in the URL.
+func trimURL(url string) string {
+	for len(url) > 0 {
+		last := url[len(url)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"", last) >= 0:
+		case last == ')' && strings.Count(url, "(") < strings.Count(url, ")"):
+		case last == ']' && strings.Count(url, "[") < strings.Count(url, "]"):
+		default:
+			return url
+		}
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
+// Fetch up to `max` of the images linked in a message of HTML, in the order
+// they're linked. Nothing is fetched for a message already showing an image.
+func FetchImages(message string, max int) []Image {
+	if strings.Contains(strings.ToLower(message), "<img") { return nil; }
+
+	var images []Image
+	urls := FindURLs(message)
+	if len(urls) > kMaxLinksTried {
+		urls = urls[:kMaxLinksTried]
+	}
+	for _, url := range urls {
+		if len(images) >= max { break; }
+		if data, mimetype, err := FetchImage(url); err == nil {
+			images = append(images, Image{Data:data, Mimetype:mimetype})
+		}
+	}
+	return images
+}
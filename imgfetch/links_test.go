@@ -0,0 +1,128 @@
+package imgfetch
+
+import "fmt"
+import "net/http"
+import "strings"
+import "sync/atomic"
+import "testing"
+
+func TestFindURLs(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []string
+	}{
+		{`<a href="http://a.test/x.png">pic</a>`, []string{"http://a.test/x.png"}},
+		{`<a href='https://a.test/y'>y</a>`, []string{"https://a.test/y"}},
+		{`<a href=http://a.test/z>z</a>`, []string{"http://a.test/z"}},
+		{`<A class="c" HREF = "http://a.test/?a=1&amp;b=2">q</A>`,
+			[]string{"http://a.test/?a=1&b=2"}},
+		{`see www.example.com/pic.png.`, []string{"https://www.example.com/pic.png"}},
+		{`<a href="www.example.com">site</a>`, []string{"https://www.example.com"}},
+		// Targets first, then the text, each once.
+		{`http://a.test/2 <a href="http://a.test/1">http://a.test/1</a> http://a.test/2, http://a.test/1`,
+			[]string{"http://a.test/1", "http://a.test/2"}},
+		{`(see http://a.test/wiki/X_(y))`, []string{"http://a.test/wiki/X_(y)"}},
+		{`<b>http://a.test/bold</b>, "http://a.test/q" 'https://b.test/r'`,
+			[]string{"http://a.test/bold", "http://a.test/q", "https://b.test/r"}},
+		{`http://a.test/1&amp;2`, []string{"http://a.test/1&2"}},
+		// Only the web is linked to.
+		{`<a href="javascript:alert(1)">x</a> <a href="ftp://a.test/f">f</a> file:///etc`, nil},
+		{`no links at all`, nil},
+	}
+	for _, test := range tests {
+		got := FindURLs(test.message)
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("FindURLs(%s) = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
+
+func TestTrimURL(t *testing.T) {
+	tests := map[string]string{
+		"http://a.test/x":        "http://a.test/x",
+		"http://a.test/x.":       "http://a.test/x",
+		"http://a.test/x?!":      "http://a.test/x",
+		`http://a.test/x'"`:      "http://a.test/x",
+		"http://a.test/x);":      "http://a.test/x",
+		"http://a.test/x)":       "http://a.test/x",
+		"http://a.test/(x)":      "http://a.test/(x)",
+		"http://a.test/(x)).":    "http://a.test/(x)",
+		"http://a.test/[x]]":     "http://a.test/[x]",
+		"http://a.test/a.b/?q=1": "http://a.test/a.b/?q=1",
+		"...":                    "",
+	}
+	for url, want := range tests {
+		if got := trimURL(url); got != want {
+			t.Errorf("trimURL(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+// Serve an image at /image/..., and text elsewhere, counting the requests.
+func serveLinks(t *testing.T) (string, *atomic.Int32) {
+	image := noisyPNG(t, 4, 4)
+	var requests atomic.Int32
+	url := serve(t, func(writer http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+		if strings.HasPrefix(request.URL.Path, "/image/") {
+			writer.Write(image)
+		} else {
+			writer.Write([]byte("just text"))
+		}
+	})
+	return url, &requests
+}
+
+// A message linking to each of the paths on the server.
+func linking(server string, paths ...string) string {
+	var links []string
+	for _, path := range paths {
+		links = append(links, fmt.Sprintf(`<a href="%s%s">link</a>`, server, path))
+	}
+	return strings.Join(links, " ")
+}
+
+func TestFetchImages(t *testing.T) {
+	server, requests := serveLinks(t)
+	var texts []string
+	for i := 0; i < kMaxLinksTried; i++ {
+		texts = append(texts, fmt.Sprintf("/text/%d", i))
+	}
+
+	tests := []struct {
+		name     string
+		message  string
+		max      int
+		images   int
+		requests int32
+	}{
+		{"images", linking(server, "/image/1", "/text/1", "/image/2"), 5, 2, 3},
+		{"capped", linking(server, "/image/1", "/image/2", "/image/3"), 2, 2, 2},
+		{"none wanted", linking(server, "/image/1"), 0, 0, 0},
+		{"duplicates", linking(server, "/image/1", "/image/1") + " " + server + "/image/1",
+			5, 1, 1},
+		{"already showing one", `<img src="data:image/png;base64,AA=="/>` +
+			linking(server, "/image/1"), 5, 0, 0},
+		{"already showing one, shouting", `<IMG SRC="x"> ` + linking(server, "/image/1"),
+			5, 0, 0},
+		// Links past the limit aren't tried, even when none before were images.
+		{"too many links", linking(server, append(texts, "/image/1")...), 5, 0,
+			kMaxLinksTried},
+		{"within the limit", linking(server, append(texts[1:], "/image/1")...), 5, 1,
+			kMaxLinksTried},
+	}
+	for _, test := range tests {
+		requests.Store(0)
+		images := FetchImages(test.message, test.max)
+		if len(images) != test.images || requests.Load() != test.requests {
+			t.Errorf("%s: fetched %d images in %d requests, want %d in %d", test.name,
+				len(images), requests.Load(), test.images, test.requests)
+		}
+		for _, image := range images {
+			if image.Mimetype != "image/png" || len(image.Data) == 0 {
+				t.Errorf("%s: fetched %s of %d bytes", test.name, image.Mimetype,
+					len(image.Data))
+			}
+		}
+	}
+}
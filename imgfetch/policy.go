@@ -0,0 +1,173 @@
+/* Where images may be fetched from. Hosts are resolved before connecting, and
+   refused if any of their addresses is private, loopback or link-local, so
+   that users can't have the bot fetch from internal services. The check is
+   made on each connection, so is made again after each redirect. Domains may
+   also be allowed or denied by name. */
+package imgfetch
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "net/url"
+import "strings"
+import "sync"
+import "time"
+
+// Looks up the addresses of hosts; net.Resolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type Policy struct {
+	Allow        []string // Domains which may be fetched from, or all if empty.
+	Deny         []string // Domains which may not be fetched from.
+	AllowPrivate bool     // Fetch from private, loopback and link-local addresses.
+	MaxRedirects int
+	Timeout      time.Duration // For the whole request, or none if 0.
+	Resolver     Resolver      // net.DefaultResolver if nil.
+}
+
+// Returned, wrapped, for URLs the policy refuses.
+var ErrForbidden = errors.New("Fetching from there isn't allowed")
+
+// Addresses refused besides those net.IP classifies: "this network" and the
+// shared address space used by carrier-grade NAT.
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil { panic(err); }
+	return network
+}
+
+var gPolicy struct {
+	sync.Mutex
+	policy Policy
+	client *http.Client
+}
+
+func init() {
+	SetPolicy(Policy{MaxRedirects:5, Timeout:10 * time.Second})
+}
+
+func SetPolicy(policy Policy) {
+	if policy.Resolver == nil {
+		policy.Resolver = net.DefaultResolver
+	}
+	dialer := &net.Dialer{Timeout:policy.Timeout}
+	client := &http.Client{
+		Transport:&http.Transport{
+			// A proxy would be what's dialed, and checked, instead.
+			Proxy:nil,
+			DialContext:func(ctx context.Context, network, address string) (net.Conn, error) {
+				return policy.dial(ctx, dialer, network, address)
+			},
+			TLSHandshakeTimeout:policy.Timeout,
+		},
+		CheckRedirect:func(request *http.Request, via []*http.Request) error {
+			if len(via) > policy.MaxRedirects {
+				return fmt.Errorf("Stopped after %d redirects.", policy.MaxRedirects)
+			}
+			return policy.checkURL(request.URL)
+		},
+		Timeout:policy.Timeout,
+	}
+
+	gPolicy.Lock()
+	defer gPolicy.Unlock()
+	gPolicy.policy, gPolicy.client = policy, client
+}
+
+func client() (*http.Client, Policy) {
+	gPolicy.Lock()
+	defer gPolicy.Unlock()
+	return gPolicy.client, gPolicy.policy
+}
+
+// Check the scheme and domain of a URL.
+func (this Policy) checkURL(target *url.URL) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("%w: not http or https.", ErrForbidden)
+	}
+	host := strings.TrimSuffix(strings.ToLower(target.Hostname()), ".")
+	if matchesDomain(host, this.Deny) {
+		return fmt.Errorf("%w: %s is denied.", ErrForbidden, host)
+	}
+	if len(this.Allow) > 0 && !matchesDomain(host, this.Allow) {
+		return fmt.Errorf("%w: %s isn't allowed.", ErrForbidden, host)
+	}
+	return nil
+}
+
+// Whether `host` is one of the domains, or a subdomain of one.
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve the host being dialed and, if none of its addresses is refused,
+// connect to one of them. The addresses checked are the ones dialed, so the
+// host can't resolve differently in between.
+func (this Policy) dial(ctx context.Context, dialer *net.Dialer,
+	network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP:ip}}
+	} else if addrs, err = this.Resolver.LookupIPAddr(ctx, host); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s.", host)
+	}
+	if !this.AllowPrivate {
+		for _, addr := range addrs {
+			if blocked(addr.IP) {
+				return nil, fmt.Errorf("%w: %s resolves to %s.", ErrForbidden, host, addr.IP)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = gConnect(ctx, dialer, network, net.JoinHostPort(addr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Connect to an address that's been checked. The tests, which can only listen
+// on addresses that are refused, connect elsewhere instead.
+var gConnect = func(ctx context.Context, dialer *net.Dialer,
+	network, address string) (net.Conn, error) {
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Whether an address is private, loopback, link-local, or otherwise not
+// somewhere on the internet.
+func blocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNets {
+		if network.Contains(ip) { return true; }
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package imgfetch
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "testing"
+import "time"
+
+// Resolves the hosts it knows, whatever their case, and no others.
+type fakeResolver map[string][]string
+
+func (this fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := this[strings.TrimSuffix(strings.ToLower(host), ".")]
+	if !ok {
+		return nil, &net.DNSError{Err:"no such host", Name:host, IsNotFound:true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP:net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+// The hosts the tests fetch from. The public ones are in TEST-NET-3, which
+// isn't refused, and which the tests connect to the server in place of.
+var gHosts = fakeResolver{
+	"public.test":        {"203.0.113.1"},
+	"images.public.test": {"203.0.113.2"},
+	"other.test":         {"203.0.113.3"},
+	"loopback.test":      {"127.0.0.1"},
+	"loopback6.test":     {"::1"},
+	"private.test":       {"192.168.1.10"},
+	"private6.test":      {"fd00::1"},
+	"metadata.test":      {"169.254.169.254"},
+	"cgnat.test":         {"100.64.0.1"},
+	"zero.test":          {"0.0.0.0"},
+	"mixed.test":         {"203.0.113.4", "10.0.0.1"},
+}
+
+// A server of an image, of redirects and of nothing at all, which the public
+// hosts above connect to.
+type testServer struct {
+	*httptest.Server
+	port string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	image := noisyPNG(t, 10, 10)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/image.png", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write(image)
+	})
+	// Redirect n times over, then to the image.
+	handler.HandleFunc("/hops/", func(writer http.ResponseWriter, request *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/hops/"))
+		target := "/image.png"
+		if n > 1 {
+			target = fmt.Sprintf("/hops/%d", n-1)
+		}
+		http.Redirect(writer, request, target, http.StatusFound)
+	})
+	handler.HandleFunc("/to", func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, request.URL.Query().Get("url"), http.StatusFound)
+	})
+	handler.HandleFunc("/slow", func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	server := &testServer{Server:httptest.NewServer(handler)}
+	_, server.port, _ = net.SplitHostPort(server.Listener.Addr().String())
+	original := gConnect
+	gConnect = func(ctx context.Context, dialer *net.Dialer,
+		network, address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "203.0.113.") {
+			address = server.Listener.Addr().String()
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	_, old := client()
+	t.Cleanup(func() {
+		server.Close()
+		gConnect = original
+		SetPolicy(old)
+	})
+	return server
+}
+
+// The URL of `path` on the server, by way of `host`.
+func (this *testServer) at(host, path string) string {
+	return "http://" + net.JoinHostPort(host, this.port) + path
+}
+
+func withPolicy(policy Policy) {
+	policy.Resolver = gHosts
+	if policy.MaxRedirects == 0 {
+		policy.MaxRedirects = 5
+	}
+	SetPolicy(policy)
+}
+
+func expectForbidden(t *testing.T, url string) {
+	t.Helper()
+	if _, _, err := FetchImage(url); !errors.Is(err, ErrForbidden) {
+		t.Errorf("fetching %s: got %v, want ErrForbidden", url, err)
+	}
+}
+
+func expectFetched(t *testing.T, url string) {
+	t.Helper()
+	if _, _, err := FetchImage(url); err != nil {
+		t.Errorf("fetching %s: %v", url, err)
+	}
+}
+
+func TestRefusesInternalAddresses(t *testing.T) {
+	server := newTestServer(t)
+	withPolicy(Policy{})
+	expectFetched(t, server.at("public.test", "/image.png"))
+
+	for _, host := range []string{"loopback.test", "loopback6.test", "private.test",
+		"private6.test", "metadata.test", "cgnat.test", "zero.test",
+		"127.0.0.1", "::1", "10.1.2.3"} {
+		expectForbidden(t, server.at(host, "/image.png"))
+	}
+	// Every address of a host is checked, not just the first.
+	expectForbidden(t, server.at("mixed.test", "/image.png"))
+
+	withPolicy(Policy{AllowPrivate:true})
+	expectFetched(t, server.at("loopback.test", "/image.png"))
+}
+
+func TestRefusesRedirectInside(t *testing.T) {
+	server := newTestServer(t)
+	withPolicy(Policy{})
+	for _, target := range []string{
+		server.at("private.test", "/image.png"),
+		server.at("127.0.0.1", "/image.png"),
+		server.at("mixed.test", "/image.png"),
+		"file:///etc/passwd",
+	} {
+		expectForbidden(t, server.at("public.test", "/to?url="+target))
+	}
+	expectFetched(t, server.at("public.test", "/to?url="+server.at("other.test", "/image.png")))
+}
+
+func TestDomainLists(t *testing.T) {
+	server := newTestServer(t)
+	withPolicy(Policy{Allow:[]string{"public.test"}, Deny:[]string{"images.public.test"}})
+	expectFetched(t, server.at("public.test", "/image.png"))
+	expectFetched(t, server.at("PUBLIC.test.", "/image.png"))
+	// Denial wins over the allowance of the domain it's within.
+	expectForbidden(t, server.at("images.public.test", "/image.png"))
+	expectForbidden(t, server.at("other.test", "/image.png"))
+	// Redirects are checked against the lists too.
+	expectForbidden(t, server.at("public.test", "/to?url="+server.at("other.test", "/image.png")))
+
+	withPolicy(Policy{Deny:[]string{".public.test"}})
+	expectForbidden(t, server.at("public.test", "/image.png"))
+	expectForbidden(t, server.at("images.public.test", "/image.png"))
+	expectFetched(t, server.at("other.test", "/image.png"))
+}
+
+func TestMatchesDomain(t *testing.T) {
+	domains := []string{"example.com", "Images.Example.org."}
+	tests := map[string]bool{
+		"example.com":           true,
+		"cdn.example.com":       true,
+		"a.b.example.com":       true,
+		"notexample.com":        false,
+		"example.com.evil.test": false,
+		"images.example.org":    true,
+		"example.org":           false,
+	}
+	for host, want := range tests {
+		if got := matchesDomain(host, domains); got != want {
+			t.Errorf("matchesDomain(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	server := newTestServer(t)
+	withPolicy(Policy{MaxRedirects:3})
+	expectFetched(t, server.at("public.test", "/hops/3"))
+	if _, _, err := FetchImage(server.at("public.test", "/hops/4")); err == nil {
+		t.Error("followed 4 redirects, with 3 allowed")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := newTestServer(t)
+	withPolicy(Policy{Timeout:100 * time.Millisecond})
+	start := time.Now()
+	if _, _, err := FetchImage(server.at("public.test", "/slow")); err == nil {
+		t.Error("no error from a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, with a timeout of 100ms", elapsed)
+	}
+}
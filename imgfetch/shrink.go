@@ -0,0 +1,111 @@
+/* Shrinks images to fit in the server's image messages, by re-encoding them
+   as JPEG at decreasing quality, then at decreasing sizes. */
+package imgfetch
+
+import "bytes"
+import "errors"
+import "image"
+import "image/color"
+import "image/draw"
+import "image/jpeg"
+
+import _ "image/gif"
+import _ "image/png"
+
+// The JPEG qualities tried at each size, best first.
+var kQualities = []int{85, 70, 55, 40}
+
+// How much smaller each size tried is than the last.
+const kScaleStep = 0.75
+
+// The smallest width or height an image is shrunk to.
+const kMinSide = 16
+
+// The most pixels an image may have to be shrunk. Decoded, each takes four
+// bytes, and a small file may claim to be enormous.
+const kMaxPixels = 25 * 1000 * 1000
+
+var (
+	ErrTooLarge      = errors.New("Image can't be shrunk to fit in a message.")
+	ErrTooManyPixels = errors.New("Image has too many pixels to shrink.")
+)
+
+// Re-encode an image as JPEG, as large and good as fits in a message of
+// `max` bytes. Animated GIFs keep only their first frame.
+func shrink(data []byte, max uint) ([]byte, error) {
+	// Only the header is read, so nothing is allocated for the pixels yet.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width) * int64(config.Height) > kMaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := flatten(decoded)
+
+	var buffer bytes.Buffer
+	for scale := 1.0; ; scale *= kScaleStep {
+		scaled := img
+		if scale < 1 {
+			bounds := img.Bounds()
+			width  := int(float64(bounds.Dx()) * scale)
+			height := int(float64(bounds.Dy()) * scale)
+			if width < kMinSide || height < kMinSide {
+				return nil, ErrTooLarge
+			}
+			scaled = resize(img, width, height)
+		}
+
+		for _, quality := range kQualities {
+			buffer.Reset()
+			if err := jpeg.Encode(&buffer, scaled, &jpeg.Options{Quality:quality}); err != nil {
+				return nil, err
+			}
+			if messageLen(buffer.Len(), "image/jpeg") <= max {
+				return buffer.Bytes(), nil
+			}
+		}
+	}
+}
+
+// Draw an image over white, since JPEG has no transparency.
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat
+}
+
+// Scale an image down to `width` by `height`, each pixel the average of those
+// of the original it covers.
+func resize(img *image.RGBA, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * bounds.Dy() / height
+		y1 := (y + 1) * bounds.Dy() / height
+		for x := 0; x < width; x++ {
+			x0 := x * bounds.Dx() / width
+			x1 := (x + 1) * bounds.Dx() / width
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[sy*img.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(pixel[0]), g+int(pixel[1]), b+int(pixel[2]), a+int(pixel[3])
+					n++
+				}
+			}
+			i := y*scaled.Stride + x*4
+			scaled.Pix[i], scaled.Pix[i+1] = uint8(r/n), uint8(g/n)
+			scaled.Pix[i+2], scaled.Pix[i+3] = uint8(b/n), uint8(a/n)
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,345 @@
+/* Logs gumble events. Each event type registers a formatter; events of types
+   without one are summarized by reflection, so that event types added by
+   gumble are logged rather than fatal. How much is logged of each event type
+   can be set, by the type's name, e.g. "TextMessageEvent". */
+package loggers
+
+import "layeh.com/gumble/gumble"
+
+import "fmt"
+import "reflect"
+import "strconv"
+import "strings"
+import "sync"
+
+// How much of an event to log.
+type Verbosity int
+
+const (
+	Silent   Verbosity = iota // Nothing.
+	Brief                     // A line from the event's formatter.
+	Detailed                  // That, and a summary of all of its fields.
+)
+
+var verbosityNames = []string{"silent", "brief", "detailed"}
+
+func (this Verbosity) String() string {
+	if int(this) < len(verbosityNames) { return verbosityNames[this]; }
+	return "Verbosity(" + strconv.Itoa(int(this)) + ")"
+}
+
+func ParseVerbosity(name string) (Verbosity, error) {
+	for i, known := range verbosityNames {
+		if strings.EqualFold(name, known) { return Verbosity(i), nil; }
+	}
+	return Silent, fmt.Errorf("unknown verbosity `%s` (use %s)", name,
+		strings.Join(verbosityNames, ", "))
+}
+
+// Produces the log entry for an event, or "" to log nothing.
+type EventFormatter func(event interface{}) (kind LogKind, entry string)
+
+var gEvents = struct {
+	sync.RWMutex
+	formatters map[reflect.Type]EventFormatter
+	verbosity  map[string]Verbosity // By EventName; Brief if absent.
+}{
+	formatters:map[reflect.Type]EventFormatter{},
+	verbosity:map[string]Verbosity{
+		// Lists all the registered users, once a new user is registered.
+		"UserListEvent":Silent,
+		// User changes too frequent or dull to log by default.
+		"UserChangeEvent.Comment":Silent,
+		"UserChangeEvent.Audio":Silent,
+		"UserChangeEvent.Texture":Silent,
+		"UserChangeEvent.PrioritySpeaker":Silent,
+		"UserChangeEvent.Recording":Silent,
+		"UserChangeEvent.Stats":Silent,
+	},
+}
+
+// Format events of type T, e.g. *gumble.ACLEvent, with `format`, replacing
+// any formatter for T already registered.
+func RegisterEventFormatter[T any](format func(event T) (LogKind, string)) {
+	gEvents.Lock()
+	defer gEvents.Unlock()
+	gEvents.formatters[reflect.TypeOf((*T)(nil)).Elem()] =
+		func(event interface{}) (LogKind, string) { return format(event.(T)); }
+}
+
+// The name by which an event's verbosity is set: its type's, sans pointer.
+func EventName(event interface{}) string {
+	t := reflect.TypeOf(event)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil { return "nil"; }
+	return t.Name()
+}
+
+// Set how much is logged of events with the given name. Kinds of user change
+// are named after the event, e.g. "UserChangeEvent.Comment".
+func SetEventVerbosity(name string, verbosity Verbosity) {
+	gEvents.Lock()
+	defer gEvents.Unlock()
+	gEvents.verbosity[name] = verbosity
+}
+
+func EventVerbosity(name string) Verbosity {
+	gEvents.RLock()
+	defer gEvents.RUnlock()
+	if verbosity, ok := gEvents.verbosity[name]; ok { return verbosity; }
+	return Brief
+}
+
+// Called to log a gumble event in an interesting way.
+func LogGumbleEvent(e interface{}) {
+	verbosity := EventVerbosity(EventName(e))
+	if verbosity == Silent { return; }
+
+	gEvents.RLock()
+	format, ok := gEvents.formatters[reflect.TypeOf(e)]
+	gEvents.RUnlock()
+
+	kind, entry := DebugLogs, ""
+	if ok {
+		kind, entry = format(e)
+		if entry == "" { return; }
+	}
+	if !ok || verbosity >= Detailed {
+		if entry != "" { entry += " "; }
+		entry += SummarizeEvent(e)
+	}
+	LogFields(kind, entry, eventFields(e))
+}
+
+var (
+	kUserType    = reflect.TypeOf((*gumble.User)(nil))
+	kChannelType = reflect.TypeOf((*gumble.Channel)(nil))
+)
+
+// The structured fields of an event: its name, and the user and channel it
+// concerns, if any.
+func eventFields(e interface{}) Fields {
+	fields := Fields{FieldEvent:EventName(e)}
+	v := reflect.Indirect(reflect.ValueOf(e))
+	if v.Kind() != reflect.Struct { return fields; }
+
+	var user *gumble.User
+	for _, name := range []string{"User", "Sender"} {
+		if field := v.FieldByName(name); field.IsValid() && field.Type() == kUserType {
+			user, _ = field.Interface().(*gumble.User)
+			if user != nil { break; }
+		}
+	}
+	var channel *gumble.Channel
+	if field := v.FieldByName("Channel"); field.IsValid() && field.Type() == kChannelType {
+		channel, _ = field.Interface().(*gumble.Channel)
+	}
+	if channel == nil && user != nil {
+		channel = user.Channel
+	}
+
+	if user != nil {
+		fields[FieldUser] = user.Name
+	}
+	if channel != nil {
+		fields[FieldChannel] = channel.Name
+	}
+	return fields
+}
+
+// Summarize an event generically, by the names and values of its fields.
+func SummarizeEvent(e interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(e))
+	if v.Kind() != reflect.Struct {
+		return fmt.Sprintf("%T: %v", e, e)
+	}
+	return v.Type().Name() + "{" + strings.Join(summarizeFields(v), " ") + "}"
+}
+
+var kClientType = reflect.TypeOf((*gumble.Client)(nil))
+
+func summarizeFields(v reflect.Value) (fields []string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		switch {
+		case !field.IsExported(), field.Type == kClientType:
+			continue
+		case field.Anonymous && field.Type.Kind() == reflect.Struct:
+			fields = append(fields, summarizeFields(v.Field(i))...)
+		default:
+			if value, ok := summarizeValue(v.Field(i)); ok {
+				fields = append(fields, field.Name+":"+value)
+			}
+		}
+	}
+	return
+}
+
+// Summarize a field's value, or return false if it's empty.
+// Anything with a name, like users and channels, is shown by name.
+func summarizeValue(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() { return "", false; }
+		elem := v.Elem()
+		if elem.Kind() == reflect.Struct {
+			if name := elem.FieldByName("Name"); name.IsValid() &&
+				name.Kind() == reflect.String {
+				return strconv.Quote(name.String()), true
+			}
+			return elem.Type().Name(), true
+		}
+		return summarizeValue(elem)
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 { return "", false; }
+		return "[" + strconv.Itoa(v.Len()) + "]", true
+	case reflect.Struct:
+		return v.Type().Name(), true
+	case reflect.String:
+		return strconv.Quote(v.String()), true
+	case reflect.Func, reflect.Chan:
+		return "", false
+	}
+	return fmt.Sprint(v.Interface()), true
+}
+
+// The kinds of user change, in the order they're described.
+var kUserChanges = []struct {
+	kind gumble.UserChangeType
+	name string
+	describe func(*gumble.UserChangeEvent) string
+}{
+	{gumble.UserChangeConnected, "Connected",
+		func(*gumble.UserChangeEvent) string { return "connected to the server"; }},
+	{gumble.UserChangeDisconnected, "Disconnected",
+		func(*gumble.UserChangeEvent) string { return "disconnected"; }},
+	{gumble.UserChangeKicked, "Kicked",
+		func(*gumble.UserChangeEvent) string { return "was kicked"; }},
+	{gumble.UserChangeBanned, "Banned",
+		func(*gumble.UserChangeEvent) string { return "was banned"; }},
+	{gumble.UserChangeRegistered, "Registered",
+		func(*gumble.UserChangeEvent) string { return "was registered"; }},
+	{gumble.UserChangeUnregistered, "Unregistered",
+		func(*gumble.UserChangeEvent) string { return "was unregistered"; }},
+	{gumble.UserChangeName, "Name",
+		func(*gumble.UserChangeEvent) string { return "changed their name"; }},
+	{gumble.UserChangeChannel, "Channel",
+		func(ev *gumble.UserChangeEvent) string {
+			if ev.User == nil || ev.User.Channel == nil { return "changed channel"; }
+			return "moved to " + ev.User.Channel.Name
+		}},
+	{gumble.UserChangeComment, "Comment",
+		func(*gumble.UserChangeEvent) string { return "changed their comment"; }},
+	{gumble.UserChangeAudio, "Audio",
+		func(ev *gumble.UserChangeEvent) string {
+			if ev.User == nil { return "changed their audio state"; }
+			return fmt.Sprintf("changed their audio state (muted:%t deafened:%t)",
+				ev.User.SelfMuted, ev.User.SelfDeafened)
+		}},
+	{gumble.UserChangeTexture, "Texture",
+		func(*gumble.UserChangeEvent) string { return "changed their avatar"; }},
+	{gumble.UserChangePrioritySpeaker, "PrioritySpeaker",
+		func(*gumble.UserChangeEvent) string { return "changed priority speaker"; }},
+	{gumble.UserChangeRecording, "Recording",
+		func(ev *gumble.UserChangeEvent) string {
+			if ev.User != nil && ev.User.Recording { return "started recording"; }
+			return "stopped recording"
+		}},
+	{gumble.UserChangeStats, "Stats",
+		func(*gumble.UserChangeEvent) string { return "had their stats updated"; }},
+}
+
+func init() {
+	RegisterEventFormatter(func(ev *gumble.ACLEvent) (LogKind, string) {
+		return DebugLogs, fmt.Sprintf("Got an ACL: %v.", ev)
+	})
+	RegisterEventFormatter(func(ev *gumble.BanListEvent) (LogKind, string) {
+		return DebugLogs, fmt.Sprintf("Got a BanList: %v.", ev)
+	})
+	RegisterEventFormatter(func(ev *gumble.ContextActionChangeEvent) (LogKind, string) {
+		return DebugLogs, fmt.Sprintf("Got a ContextActionChange: %v.", ev)
+	})
+	RegisterEventFormatter(func(ev *gumble.PermissionDeniedEvent) (LogKind, string) {
+		return DebugLogs, fmt.Sprintf("Got a PermissionDeniedEvent: %v.", ev)
+	})
+	RegisterEventFormatter(func(ev *gumble.ChannelChangeEvent) (LogKind, string) {
+		return DebugLogs, fmt.Sprintf("Got a ChannelChange: %v.", ev)
+	})
+
+	RegisterEventFormatter(func(ev *gumble.ConnectEvent) (LogKind, string) {
+		self := ev.Client.Self
+		return DebugLogs, "Connected to channel: {" + self.Channel.Name +
+			"} as {" + self.Name + "}."
+	})
+	RegisterEventFormatter(func(ev *gumble.DisconnectEvent) (LogKind, string) {
+		var reason string
+		switch {
+		case len(ev.String) > 0:
+			reason = ev.String
+		case ev.Type == gumble.DisconnectError:
+			reason = "unknown error"
+		case ev.Type == gumble.DisconnectBanned:
+			reason = "banned"
+		case ev.Type == gumble.DisconnectKicked:
+			reason = "kicked"
+		case ev.Type == gumble.DisconnectUser:
+			return ErrorLogs, "" // ignore
+		}
+		return ErrorLogs, "Disconnected from server: " + reason
+	})
+	RegisterEventFormatter(func(ev *gumble.ServerConfigEvent) (LogKind, string) {
+		var lines []string
+		if (ev.MaximumMessageLength != nil) {
+			lines = append(lines, fmt.Sprintf("Maximum message length is %d.",
+				*ev.MaximumMessageLength))
+		}
+		if (ev.WelcomeMessage != nil) {
+			lines = append(lines, "Welcome message: " + *ev.WelcomeMessage + ".")
+		}
+		return DebugLogs, strings.Join(lines, " ")
+	})
+
+	RegisterEventFormatter(func(ev *gumble.TextMessageEvent) (LogKind, string) {
+		var recip string
+		var acc []string
+		for _, userptr := range ev.Users {
+			acc = append(acc, userptr.Name)
+		}
+		for _, channelptr := range ev.Channels {
+			acc = append(acc, channelptr.Name)
+		}
+		if (len(ev.Users) > 0) {
+			recip += fmt.Sprintf("users:%v",acc)
+		}
+		if (len(ev.Channels) > 0) {
+			recip += fmt.Sprintf("channels:%v",acc)
+		}
+
+		sender := "<no sender>"
+		if (ev.Sender != nil) {
+			sender = ev.Sender.Name
+		}
+		return DebugLogs, fmt.Sprintf("{%s} => %s: {`%s`}", sender, recip, ev.Message)
+	})
+
+	RegisterEventFormatter(func(ev *gumble.UserChangeEvent) (LogKind, string) {
+		var actions []string
+		for _, change := range kUserChanges {
+			if !ev.Type.Has(change.kind) ||
+				EventVerbosity("UserChangeEvent." + change.name) == Silent {
+				continue
+			}
+			actions = append(actions, change.describe(ev))
+		}
+		if len(actions) == 0 { return DebugLogs, ""; }
+
+		user := "<no user>"
+		if (ev.User != nil) {
+			user = ev.User.Name
+		}
+		return DebugLogs, fmt.Sprintf("UserEvent: {%s} %s.", user,
+			strings.Join(actions, ", "))
+	})
+}
@@ -0,0 +1,264 @@
+package loggers
+
+import "layeh.com/gumble/gumble"
+
+import "strings"
+import "sync"
+import "testing"
+
+// Keeps the entries it's given.
+type recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (this *recorder) Print(s string) {
+	this.PrintEntry(Entry{Message:strings.TrimSuffix(s, "\n")})
+}
+
+func (this *recorder) PrintEntry(entry Entry) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.entries = append(this.entries, entry)
+}
+
+func (this *recorder) take() []Entry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	entries := this.entries
+	this.entries = nil
+	return entries
+}
+
+// Send entries of every kind to a recorder alone, for the rest of the test.
+func recordLogs(t *testing.T) *recorder {
+	sinkMu.Lock()
+	old := sinkList
+	sinkList = nil
+	sinkMu.Unlock()
+	t.Cleanup(func() {
+		sinkMu.Lock()
+		sinkList = old
+		sinkMu.Unlock()
+	})
+
+	rec := &recorder{}
+	AddLogger(rec, ErrorLogs, DebugLogs, InterractionLogs)
+	return rec
+}
+
+// Set events' verbosities for the rest of the test.
+func withVerbosities(t *testing.T, verbosities map[string]Verbosity) {
+	gEvents.Lock()
+	old := gEvents.verbosity
+	gEvents.verbosity = map[string]Verbosity{}
+	for name, verbosity := range old {
+		gEvents.verbosity[name] = verbosity
+	}
+	gEvents.Unlock()
+	t.Cleanup(func() {
+		gEvents.Lock()
+		gEvents.verbosity = old
+		gEvents.Unlock()
+	})
+
+	for name, verbosity := range verbosities {
+		SetEventVerbosity(name, verbosity)
+	}
+}
+
+var (
+	gLobby = &gumble.Channel{ID:1, Name:"Lobby"}
+	gAlice = &gumble.User{Name:"alice", Channel:gLobby}
+	gBot   = &gumble.User{Name:"bot", Channel:gLobby}
+)
+
+func intPtr(n int) *int { return &n; }
+
+// The one entry logged, or false if nothing was.
+func logged(t *testing.T, rec *recorder) (Entry, bool) {
+	t.Helper()
+	entries := rec.take()
+	if len(entries) > 1 {
+		t.Errorf("logged %d entries, want at most 1: %v", len(entries), entries)
+	}
+	if len(entries) == 0 { return Entry{}, false; }
+	return entries[0], true
+}
+
+func TestEventFormatters(t *testing.T) {
+	rec := recordLogs(t)
+	withVerbosities(t, nil)
+
+	tests := []struct {
+		name  string
+		event interface{}
+		kind  LogKind
+		want  string // The entry's message, or "" if nothing should be logged.
+	}{
+		{"private message", &gumble.TextMessageEvent{TextMessage:gumble.TextMessage{
+			Sender:gAlice, Users:[]*gumble.User{gBot}, Message:"hi"}},
+			DebugLogs, "{alice} => users:[bot]: {`hi`}"},
+		{"channel message", &gumble.TextMessageEvent{TextMessage:gumble.TextMessage{
+			Channels:[]*gumble.Channel{gLobby}, Message:"hello"}},
+			DebugLogs, "{<no sender>} => channels:[Lobby]: {`hello`}"},
+		{"connected", &gumble.ConnectEvent{Client:&gumble.Client{Self:gBot}},
+			DebugLogs, "Connected to channel: {Lobby} as {bot}."},
+		{"kicked", &gumble.DisconnectEvent{Type:gumble.DisconnectKicked},
+			ErrorLogs, "Disconnected from server: kicked"},
+		{"disconnected with a reason", &gumble.DisconnectEvent{
+			Type:gumble.DisconnectError, String:"server shutting down"},
+			ErrorLogs, "Disconnected from server: server shutting down"},
+		{"disconnected by the bot", &gumble.DisconnectEvent{Type:gumble.DisconnectUser},
+			ErrorLogs, ""},
+		{"server config", &gumble.ServerConfigEvent{MaximumMessageLength:intPtr(5000)},
+			DebugLogs, "Maximum message length is 5000."},
+		{"empty server config", &gumble.ServerConfigEvent{}, DebugLogs, ""},
+		{"user changes", &gumble.UserChangeEvent{User:gAlice,
+			Type:gumble.UserChangeConnected | gumble.UserChangeChannel},
+			DebugLogs, "UserEvent: {alice} connected to the server, moved to Lobby."},
+		{"silent user change", &gumble.UserChangeEvent{User:gAlice,
+			Type:gumble.UserChangeComment}, DebugLogs, ""},
+		{"silent event", &gumble.UserListEvent{}, DebugLogs, ""},
+	}
+	for _, test := range tests {
+		LogGumbleEvent(test.event)
+		entry, ok := logged(t, rec)
+		switch {
+		case test.want == "" && ok:
+			t.Errorf("%s: logged %q, want nothing", test.name, entry.Message)
+		case test.want == "":
+		case !ok:
+			t.Errorf("%s: logged nothing, want %q", test.name, test.want)
+		case entry.Message != test.want || entry.Kind != test.kind:
+			t.Errorf("%s: logged %q as %s, want %q as %s", test.name,
+				entry.Message, entry.Kind, test.want, test.kind)
+		}
+	}
+}
+
+func TestEventFields(t *testing.T) {
+	rec := recordLogs(t)
+	withVerbosities(t, nil)
+
+	LogGumbleEvent(&gumble.TextMessageEvent{TextMessage:gumble.TextMessage{
+		Sender:gAlice, Message:"hi"}})
+	entry, _ := logged(t, rec)
+	want := Fields{FieldEvent:"TextMessageEvent", FieldUser:"alice", FieldChannel:"Lobby"}
+	if len(entry.Fields) != len(want) {
+		t.Errorf("got fields %v, want %v", entry.Fields, want)
+	}
+	for key, value := range want {
+		if entry.Fields[key] != value {
+			t.Errorf("got fields %v, want %v", entry.Fields, want)
+			break
+		}
+	}
+}
+
+// An event gumble might add, without a formatter of its own.
+type testEvent struct {
+	Client  *gumble.Client
+	User    *gumble.User
+	Channel *gumble.Channel
+	Count   int
+	Note    string
+	Tags    []string
+	Empty   []string
+	Handler func()
+	hidden  int
+}
+
+func TestSummarizeEvent(t *testing.T) {
+	tests := []struct {
+		event interface{}
+		want  string
+	}{
+		{&testEvent{Client:&gumble.Client{}, User:gAlice, Count:3, Note:"x y",
+			Tags:[]string{"a", "b"}, Handler:func() {}, hidden:1},
+			`testEvent{User:"alice" Count:3 Note:"x y" Tags:[2]}`},
+		{testEvent{Channel:gLobby}, `testEvent{Channel:"Lobby" Count:0 Note:""}`},
+		// Embedded structs' fields are summarized as the event's own.
+		{&gumble.TextMessageEvent{TextMessage:gumble.TextMessage{Sender:gAlice,
+			Channels:[]*gumble.Channel{gLobby}, Message:"hi"}},
+			`TextMessageEvent{Sender:"alice" Channels:[1] Message:"hi"}`},
+		{&gumble.ContextActionChangeEvent{ContextAction:&gumble.ContextAction{Name:"go"}},
+			`ContextActionChangeEvent{Type:0 ContextAction:"go"}`},
+		{42, "int: 42"},
+	}
+	for _, test := range tests {
+		if got := SummarizeEvent(test.event); got != test.want {
+			t.Errorf("SummarizeEvent(%T) = %s, want %s", test.event, got, test.want)
+		}
+	}
+}
+
+func TestUnformattedEvent(t *testing.T) {
+	rec := recordLogs(t)
+	withVerbosities(t, nil)
+
+	LogGumbleEvent(&testEvent{User:gAlice, Count:2})
+	entry, ok := logged(t, rec)
+	want := `testEvent{User:"alice" Count:2 Note:""}`
+	if !ok || entry.Message != want || entry.Kind != DebugLogs {
+		t.Errorf("logged %q as %s, want %q as debug", entry.Message, entry.Kind, want)
+	}
+	if entry.Fields[FieldEvent] != "testEvent" || entry.Fields[FieldUser] != "alice" {
+		t.Errorf("got fields %v", entry.Fields)
+	}
+
+	SetEventVerbosity("testEvent", Silent)
+	LogGumbleEvent(&testEvent{})
+	if entry, ok := logged(t, rec); ok {
+		t.Errorf("logged %q for a silenced event", entry.Message)
+	}
+}
+
+func TestDetailedEvent(t *testing.T) {
+	rec := recordLogs(t)
+	withVerbosities(t, map[string]Verbosity{"TextMessageEvent":Detailed})
+
+	LogGumbleEvent(&gumble.TextMessageEvent{TextMessage:gumble.TextMessage{
+		Sender:gAlice, Message:"hi"}})
+	entry, _ := logged(t, rec)
+	want := "{alice} => : {`hi`}" + ` TextMessageEvent{Sender:"alice" Message:"hi"}`
+	if entry.Message != want {
+		t.Errorf("logged %q, want %q", entry.Message, want)
+	}
+}
+
+func TestUserChangeVerbosity(t *testing.T) {
+	both := gumble.UserChangeConnected | gumble.UserChangeChannel
+	tests := []struct {
+		name        string
+		verbosities map[string]Verbosity
+		change      gumble.UserChangeType
+		want        string // What alice is said to have done, or "" for nothing.
+	}{
+		{"defaults", nil, both, "connected to the server, moved to Lobby"},
+		{"one kind silenced", map[string]Verbosity{"UserChangeEvent.Channel":Silent},
+			both, "connected to the server"},
+		{"all kinds silenced", map[string]Verbosity{"UserChangeEvent.Channel":Silent,
+			"UserChangeEvent.Connected":Silent}, both, ""},
+		{"silent by default", nil, gumble.UserChangeComment, ""},
+		{"made audible", map[string]Verbosity{"UserChangeEvent.Comment":Brief},
+			gumble.UserChangeComment, "changed their comment"},
+		{"event silenced", map[string]Verbosity{"UserChangeEvent":Silent}, both, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := recordLogs(t)
+			withVerbosities(t, test.verbosities)
+
+			LogGumbleEvent(&gumble.UserChangeEvent{User:gAlice, Type:test.change})
+			entry, ok := logged(t, rec)
+			want := ""
+			if test.want != "" {
+				want = "UserEvent: {alice} " + test.want + "."
+			}
+			if entry.Message != want || ok != (want != "") {
+				t.Errorf("logged %q, want %q", entry.Message, want)
+			}
+		})
+	}
+}
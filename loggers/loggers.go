@@ -5,9 +5,11 @@ package loggers
 
 import "io"
 import "log" // Use standard library loggers to implement WriterLogger
-import "os"
 import "fmt"
+import "sync"
+import "time"
 import "layeh.com/gumble/gumble"
+import "github.com/zorodc/maobot/outbox"
 
 type LogKind int;
 
@@ -18,138 +20,69 @@ const (
 	// StatusLogs?
 )
 
-// Global list of loggers used when logging.
-var loggerList = map[LogKind]([]Logger){}
+// A logger, with the entries it receives.
+type Sink struct {
+	logger Logger
+	kinds  map[LogKind]bool
+	min    Level
+}
+
+// Global list of sinks used when logging.
+var sinkList []*Sink
+var sinkMu sync.RWMutex
 
 // Called to log an entry to all receptive loggers.
 func Log(kind LogKind, entry string) {
-	for _, logger := range loggerList[kind] {
-		logger.Print(entry + "\n")
-	}
+	LogEntry(Entry{Kind:kind, Level:kind.Level(), Message:entry})
 }
 func Logf(kind LogKind, format string, args ...interface{}) {
 	Log(kind, fmt.Sprintf(format, args...))
 }
 
-// Called to log a gumble event in an interesting way.
-func LogGumbleEvent(e interface{}) {
-//	Log(fmt.Sprintf("Got event: %v", reflect.TypeOf(e)), DebugLogs)
-	switch ev := e.(type) {
-	case *gumble.ACLEvent:
-		Logf(DebugLogs, "Got an ACL: %v.", ev)
-
-	case *gumble.BanListEvent:
-		Logf(DebugLogs, "Got a BanList: %v.", ev)
-
-	case *gumble.ContextActionChangeEvent:
-		Logf(DebugLogs, "Got a ContextActionChange: %v.", ev);
-
-	case *gumble.PermissionDeniedEvent:
-		Logf(DebugLogs, "Got a PermissionDeniedEvent: %v.", ev)
-
-	case *gumble.ConnectEvent:
-		Log(DebugLogs, "Connected to channel: {" + ev.Client.Self.Channel.Name +
-    	     "} as {" + ev.Client.Self.Name + "}.")
-
-	case *gumble.DisconnectEvent:
-		var reason string
-			switch {
-			case len(ev.String) > 0:
-				reason = ev.String
-			case ev.Type == gumble.DisconnectError:
-				reason = "unknown error"
-			case ev.Type == gumble.DisconnectBanned:
-				reason = "banned"
-			case ev.Type == gumble.DisconnectKicked:
-				reason = "kicked"
-			case ev.Type == gumble.DisconnectUser:
-				return // ignore
-			}
-			Log(ErrorLogs, "Disconnected from server: " + reason)
-
-	case *gumble.ServerConfigEvent:
-		if (ev.MaximumMessageLength != nil) {
-			Logf(DebugLogs, "Maximum message length is %d.",
-				*ev.MaximumMessageLength)
-		}
-		if (ev.WelcomeMessage != nil) {
-			Log(DebugLogs, "Welcome message: " + *ev.WelcomeMessage + ".")
-		}
-
-	case *gumble.ChannelChangeEvent:
-		Logf(DebugLogs, "Got a ChannelChange: %v.", ev);
-
-	case *gumble.TextMessageEvent:
-		var recip string
-		var acc []string
-		for _, userptr := range ev.Users {
-			acc = append(acc, userptr.Name)
-		}
-		for _, channelptr := range ev.Channels {
-			acc = append(acc, channelptr.Name)
-		}
-		if (len(ev.Users) > 0) {
-			recip += fmt.Sprintf("users:%v",acc)
-		}
-		if (len(ev.Channels) > 0) {
-			recip += fmt.Sprintf("channels:%v",acc)
-		}
+// Log a message with structured fields, at the kind's usual level.
+func LogFields(kind LogKind, entry string, fields Fields) {
+	LogEntry(Entry{Kind:kind, Level:kind.Level(), Message:entry, Fields:fields})
+}
 
-		sender := "<no sender>"
-		if (ev.Sender != nil) {
-			sender = ev.Sender.Name
-		}
+// Log an entry to each sink taking its kind, at or above the sink's level.
+// Loggers which understand entries get them whole; others get the text.
+func LogEntry(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
 
-		Logf(DebugLogs, "{%s} => %s: {`%s`}", sender, recip, ev.Message)
-			
-
-	case *gumble.UserChangeEvent:
-		var action string
-		switch {
-		case (ev.Type & gumble.UserChangeConnected) != 0:
-			action = "connected to the server"
-		case (ev.Type & gumble.UserChangeDisconnected) != 0:
-			action = "disconnected"
-		case (ev.Type & gumble.UserChangeKicked) != 0:
-			action = "was kicked"
-		case (ev.Type & gumble.UserChangeBanned) != 0:
-			action = "was banned"
-		case (ev.Type & gumble.UserChangeRegistered) != 0:
-			action = "was registered"
-		case (ev.Type & gumble.UserChangeUnregistered) != 0:
-			action = "was unregistered"
-		case (ev.Type & gumble.UserChangeName) != 0:
-			action = "changed their name"
-		case (ev.Type & gumble.UserChangeChannel) != 0:
-			action = "moved to " + ev.User.Channel.Name
-//    These are currently ignored.
-//		case gumble.UserChangeComment, gumble.UserChangeAudio,
-//			gumble.UserChangeTexture, gumble.UserChangePrioritySpeaker,
-//			gumble.UserChangeRecording, gumble.UserChangeStats
-		default:
-			return
-		}
-	
-		user := "<no user>"
-		if (ev.User != nil) {
-			user = ev.User.Name
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	for _, sink := range sinkList {
+		if !sink.kinds[entry.Kind] || entry.Level < sink.min { continue; }
+		if logger, ok := sink.logger.(EntryLogger); ok {
+			logger.PrintEntry(entry)
+		} else {
+			sink.logger.Print(entry.Message + "\n")
 		}
-		
-		Logf(DebugLogs, "UserEvent: {%s} %s.", user, action)
-
-	case *gumble.UserListEvent:
-// Lists all the registered users, once a new user is registered.
-// Currently ignored.
-
-	default:
-		panic("Event handling incomplete!")
-	}	
+	}
 }
 
-func AddLogger(l Logger, kinds ...LogKind) {
+// Send entries of the given kinds to `l`, from the lowest level up unless
+// told otherwise with MinLevel.
+func AddLogger(l Logger, kinds ...LogKind) *Sink {
+	sink := &Sink{logger:l, kinds:map[LogKind]bool{}}
 	for _, kind := range kinds {
-		loggerList[kind] = append(loggerList[kind], l)
+		sink.kinds[kind] = true
 	}
+
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	sinkList = append(sinkList, sink)
+	return sink
+}
+
+// Only send the sink entries at `level` or above.
+func (this *Sink) MinLevel(level Level) *Sink {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	this.min = level
+	return this
 }
 
 type Logger interface {
@@ -172,7 +105,18 @@ func (this WriterLogger) Print(s string) {
 	this.logger.Print(s)
 }
 
+// Print the entry as text, with its fields after the message.
+func (this WriterLogger) PrintEntry(entry Entry) {
+	this.logger.Print(entry.Text() + "\n")
+}
+
+func init() {
+	// The outbox echoes the error logs, so it can't log to them itself.
+	outbox.LogError = func(message string) { Log(ErrorLogs, message); }
+}
+
 type MessageLogger struct {
+	mu     sync.Mutex // Set from the event goroutine, read by whoever logs.
 	client *gumble.Client // can be nil
 	maxLen uint // maximum message size the server can recieve
 }
@@ -183,21 +127,33 @@ func NewMessageLogger(c *gumble.Client) MessageLogger {
 
 func (this *MessageLogger) SetClient(c *gumble.Client) {
 	if c == nil { panic("Client should not be set to nil."); }
-	(*this).client = c
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.client = c
 }
 
 func (this *MessageLogger) SetMaxMsgLen(len uint) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
 	this.maxLen = len
 }
 
-func (this MessageLogger) Print(message string) {
+// The maximum message length the server accepts, or 0 if it sent none.
+func (this *MessageLogger) MaxMsgLen() uint {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.maxLen
+}
+
+// Send the message to the bot's channel, split into pages if it's too long.
+// Replies to commands are sent ahead of it.
+func (this *MessageLogger) Print(message string) {
+	this.mu.Lock()
+	client, maxLen := this.client, this.maxLen
+	this.mu.Unlock()
+
 	// Silently avoid printing a message to a null reciever.
-	if this.client == nil { return; }
+	if client == nil { return; }
 	// If maxLen is 0, the server sent no maximum length.
-	if this.maxLen > 0 && uint(len(message)) > this.maxLen {
-		fmt.Fprintf(os.Stderr,
-			"ERROR: Message {`" + message + "`} exceeds maximum length " +
-				string(this.maxLen) + ", trying to send anyways...")
-	}
-	this.client.Self.Channel.Send(message, false)
+	outbox.Send(outbox.ToChannel(client.Self.Channel), message, maxLen, outbox.Low)
 }
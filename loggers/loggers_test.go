@@ -0,0 +1,35 @@
+package loggers
+
+import "layeh.com/gumble/gumble"
+
+import "sync"
+import "testing"
+
+// The client and maximum length are set by the event goroutine while others
+// log; run with -race.
+func TestMessageLoggerConcurrent(t *testing.T) {
+	logger := NewMessageLogger(nil)
+	client := &gumble.Client{Self:&gumble.User{Name:"bot", Channel:&gumble.Channel{}}}
+	// Without a client, messages are dropped.
+	logger.Print("nowhere to go")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := uint(1); i <= 100; i++ {
+			logger.SetMaxMsgLen(i)
+			logger.SetClient(client)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			logger.MaxMsgLen()
+		}
+	}()
+	wg.Wait()
+	if got := logger.MaxMsgLen(); got != 100 {
+		t.Errorf("MaxMsgLen() = %d, want 100", got)
+	}
+}
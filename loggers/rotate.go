@@ -0,0 +1,238 @@
+/* A sink writing to a file, which is rotated once it grows too large or a day
+   passes. Rotated files are renamed with the time of rotation, gzipped, and
+   pruned to a number kept. The file can be reopened, e.g. on SIGHUP, so that
+   it may also be rotated externally, by logrotate. */
+package loggers
+
+import "compress/gzip"
+import "fmt"
+import "io"
+import "os"
+import "os/signal"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+// The layout of the time appended to the names of rotated files.
+const kRotatedLayout = "20060102-150405.000"
+
+type RotateOptions struct {
+	MaxSize int64 // Rotate before the file grows past this many bytes, if > 0.
+	Daily   bool  // Rotate on the first entry of each day.
+	Keep    int   // The number of rotated files to keep; all of them if 0.
+	JSON    bool  // Write entries as JSON, rather than text.
+}
+
+type FileLogger struct {
+	mu      sync.Mutex
+	path    string
+	options RotateOptions
+	file    *os.File
+	size    int64
+	opened  time.Time
+	format  func(Entry) []byte
+	pending sync.WaitGroup // Compressions under way.
+}
+
+// Open a file to log to, appending to it if it already exists.
+func NewFileLogger(path string, options RotateOptions) (*FileLogger, error) {
+	this := &FileLogger{path:path, options:options, format:formatText}
+	if options.JSON {
+		this.format = formatJSON
+	}
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func formatText(entry Entry) []byte {
+	return []byte(entry.Time.Format("2006/01/02 15:04:05 ") + entry.Text() + "\n")
+}
+
+func formatJSON(entry Entry) []byte {
+	return append(entryJSON(entry), '\n')
+}
+
+// Open the file at the path. The lock must be held, or the logger unshared.
+func (this *FileLogger) open() error {
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file, this.size = file, info.Size()
+	this.opened = info.ModTime()
+	if this.size == 0 {
+		this.opened = time.Now()
+	}
+	return nil
+}
+
+func (this *FileLogger) Print(s string) {
+	this.PrintEntry(Entry{Time:time.Now(), Level:LevelInfo,
+		Message:strings.TrimSuffix(s, "\n")})
+}
+
+func (this *FileLogger) PrintEntry(entry Entry) {
+	line := this.format(entry)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.file == nil { return; }
+
+	if this.due(entry.Time, int64(len(line))) {
+		if err := this.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Can't rotate %s: %s\n", this.path, err)
+		}
+	}
+	n, _ := this.file.Write(line)
+	this.size += int64(n)
+}
+
+// Whether the file should be rotated before writing `n` bytes at `now`.
+func (this *FileLogger) due(now time.Time, n int64) bool {
+	if this.size == 0 { return false; }
+	if this.options.MaxSize > 0 && this.size+n > this.options.MaxSize {
+		return true
+	}
+	if this.options.Daily {
+		y1, m1, d1 := this.opened.Date()
+		y2, m2, d2 := now.Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+	return false
+}
+
+// Rotate the file now, regardless of its size or age.
+func (this *FileLogger) Rotate() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.rotate()
+}
+
+func (this *FileLogger) rotate() error {
+	// The file is closed even if Close fails, so carry on with a new one.
+	var closeErr error
+	if this.file != nil {
+		closeErr = this.file.Close()
+		this.file = nil
+	}
+	rotated := this.path + "." + time.Now().Format(kRotatedLayout)
+	// Rotating twice in a millisecond mustn't overwrite the first, nor
+	// break the order the names sort in.
+	for exists(rotated) || exists(rotated+".gz") {
+		time.Sleep(time.Millisecond)
+		rotated = this.path + "." + time.Now().Format(kRotatedLayout)
+	}
+	renameErr := os.Rename(this.path, rotated)
+	if err := this.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	this.pending.Add(1)
+	go func() {
+		defer this.pending.Done()
+		if err := compress(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Can't compress %s: %s\n", rotated, err)
+		}
+		this.prune()
+	}()
+	return closeErr
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Replace a file with a gzipped copy, named with .gz appended.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if closeErr := writer.Close(); err == nil { err = closeErr; }
+	if closeErr := out.Close(); err == nil { err = closeErr; }
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Remove the oldest rotated files beyond the number kept.
+func (this *FileLogger) prune() {
+	if this.options.Keep <= 0 { return; }
+
+	rotated, err := filepath.Glob(this.path + ".*.gz")
+	if err != nil { return; }
+	// Their names sort by the time they were rotated.
+	sort.Strings(rotated)
+	for len(rotated) > this.options.Keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// Close and reopen the file at the path, which may since have been moved.
+func (this *FileLogger) Reopen() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.file != nil {
+		this.file.Close()
+	}
+	if err := this.open(); err != nil {
+		this.file = nil
+		return err
+	}
+	return nil
+}
+
+// Close the file, once any rotated files are compressed.
+func (this *FileLogger) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.pending.Wait()
+	if this.file == nil { return nil; }
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+// Reopen the loggers' files whenever the process receives SIGHUP.
+// Without any loggers, SIGHUP is left to end the process as usual.
+func ReopenOnSIGHUP(loggers ...*FileLogger) {
+	if len(loggers) == 0 { return; }
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			for _, logger := range loggers {
+				if err := logger.Reopen(); err != nil {
+					Logf(ErrorLogs, "Can't reopen %s: %s.", logger.path, err.Error())
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package loggers
+
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+// The rotated files beside the log, once they're compressed.
+func rotatedFiles(t *testing.T, logger *FileLogger) []string {
+	t.Helper()
+	logger.pending.Wait()
+	files, err := filepath.Glob(logger.path + ".*.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRotateOnSize(t *testing.T) {
+	line := strings.Repeat("x", 40)
+	// Room for two lines, but not three.
+	size := int64(len(formatText(Entry{Time:time.Now(), Level:LevelInfo, Message:line})))
+	path := filepath.Join(t.TempDir(), "bot.log")
+	logger, err := NewFileLogger(path, RotateOptions{MaxSize:size*5/2, Keep:2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	for i := 0; i < 12; i++ {
+		logger.Print(line)
+	}
+	// Each file holds two lines, so there were five rotations, of which two
+	// files are kept.
+	if files := rotatedFiles(t, logger); len(files) != 2 {
+		t.Errorf("kept %d rotated files, want 2: %v", len(files), files)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("the current file holds %d lines, want 2", n)
+	}
+}
+
+func TestRotateDaily(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	logger, err := NewFileLogger(path, RotateOptions{Daily:true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	now := time.Now()
+	logger.PrintEntry(Entry{Time:now, Message:"today"})
+	logger.PrintEntry(Entry{Time:now, Message:"still today"})
+	if files := rotatedFiles(t, logger); len(files) != 0 {
+		t.Fatalf("rotated within a day: %v", files)
+	}
+	logger.PrintEntry(Entry{Time:now.AddDate(0, 0, 1), Message:"tomorrow"})
+	if files := rotatedFiles(t, logger); len(files) != 1 {
+		t.Errorf("%d rotated files after a day, want 1", len(files))
+	}
+}
+
+// Rotating a logger whose file failed to close, or was never reopened, still
+// leaves it with a file to write to.
+func TestRotateWithoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	logger, err := NewFileLogger(path, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Print("before")
+
+	// Closing it behind the logger's back makes its own Close fail.
+	logger.file.Close()
+	if err := logger.Rotate(); err == nil {
+		t.Error("no error from closing the file twice")
+	}
+	logger.Print("after")
+	if logger.file == nil {
+		t.Fatal("no file after rotating")
+	}
+
+	logger.mu.Lock()
+	logger.file.Close()
+	logger.file = nil
+	logger.mu.Unlock()
+	if err := logger.Rotate(); err != nil {
+		t.Errorf("rotating without a file: %v", err)
+	}
+	logger.Print("again")
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "again") {
+		t.Errorf("nothing written after rotating; the file holds %q", data)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bot.log")
+	logger, err := NewFileLogger(path, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Print("first")
+
+	// As logrotate would: move the file away, then have it reopened.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Print("second")
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "first") || !strings.Contains(string(data), "second") {
+		t.Errorf("the reopened file holds %q", data)
+	}
+}
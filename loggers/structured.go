@@ -0,0 +1,159 @@
+/* Structured log entries: a message at a level, with named fields, which text
+   sinks print after the message and the JSON sink writes as an object. */
+package loggers
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (this Level) String() string {
+	if this >= 0 && int(this) < len(levelNames) { return levelNames[this]; }
+	return "Level(" + strconv.Itoa(int(this)) + ")"
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, known := range levelNames {
+		if strings.EqualFold(name, known) { return Level(i), nil; }
+	}
+	return LevelDebug, fmt.Errorf("unknown log level `%s` (use %s)", name,
+		strings.Join(levelNames, ", "))
+}
+
+// The level entries of each kind are logged at by Log and Logf.
+func (this LogKind) Level() Level {
+	switch this {
+	case ErrorLogs:        return LevelError
+	case InterractionLogs: return LevelInfo
+	}
+	return LevelDebug
+}
+
+func ParseLogKind(name string) (LogKind, error) {
+	for _, kind := range []LogKind{ErrorLogs, DebugLogs, InterractionLogs} {
+		if strings.EqualFold(name, kind.String()) { return kind, nil; }
+	}
+	return DebugLogs, fmt.Errorf("unknown kind of log `%s` (use error, debug or interaction)", name)
+}
+
+func (this LogKind) String() string {
+	switch this {
+	case ErrorLogs:        return "error"
+	case DebugLogs:        return "debug"
+	case InterractionLogs: return "interaction"
+	}
+	return "LogKind(" + strconv.Itoa(int(this)) + ")"
+}
+
+// The names of commonly logged fields.
+const (
+	FieldEvent   = "event"   // The name of a gumble event's type.
+	FieldUser    = "user"    // The name of the user concerned.
+	FieldChannel = "channel" // The name of the channel concerned.
+	FieldCommand = "command"
+	FieldLatency = "latency" // A time.Duration.
+	FieldError   = "error"
+)
+
+type Fields map[string]interface{}
+
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Kind    LogKind
+	Message string
+	Fields  Fields
+}
+
+// A logger which makes use of the entry, rather than just its message.
+type EntryLogger interface {
+	Logger
+	PrintEntry(Entry)
+}
+
+// The entry's message, followed by its fields as key=value, sorted by key.
+func (this Entry) Text() string {
+	if len(this.Fields) == 0 { return this.Message; }
+
+	keys := make([]string, 0, len(this.Fields))
+	for key := range this.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString(this.Message)
+	for _, key := range keys {
+		value := fmt.Sprint(this.Fields[key])
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&builder, " %s=%s", key, value)
+	}
+	return builder.String()
+}
+
+// Writes each entry as a JSON object on a line of its own.
+type JSONLogger struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{writer:w}
+}
+
+func (this *JSONLogger) Print(s string) {
+	this.PrintEntry(Entry{Time:time.Now(), Level:LevelInfo,
+		Message:strings.TrimSuffix(s, "\n")})
+}
+
+func (this *JSONLogger) PrintEntry(entry Entry) {
+	line := entryJSON(entry)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.writer.Write(append(line, '\n'))
+}
+
+// An entry as a JSON object. Fields are written alongside time, level, kind
+// and msg, which they can't replace. Durations are written in seconds.
+func entryJSON(entry Entry) []byte {
+	object := make(map[string]interface{}, len(entry.Fields)+4)
+	for key, value := range entry.Fields {
+		switch value := value.(type) {
+		case time.Duration:
+			object[key] = value.Seconds()
+		case error:
+			object[key] = value.Error()
+		default:
+			object[key] = value
+		}
+	}
+	object["time"]  = entry.Time.Format(time.RFC3339Nano)
+	object["level"] = entry.Level.String()
+	object["kind"]  = entry.Kind.String()
+	object["msg"]   = entry.Message
+
+	line, err := json.Marshal(object)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"time":object["time"].(string),
+			"level":"error", "msg":"unloggable entry: " + err.Error()})
+	}
+	return line
+}
@@ -0,0 +1,115 @@
+package loggers
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "strings"
+import "testing"
+import "time"
+
+func TestEntryText(t *testing.T) {
+	tests := []struct {
+		fields Fields
+		want   string
+	}{
+		{nil, "ran"},
+		{Fields{}, "ran"},
+		// Sorted by key, whatever order they're given in.
+		{Fields{FieldUser:"alice", FieldCommand:"!skip"}, "ran command=!skip user=alice"},
+		{Fields{FieldLatency:1500 * time.Millisecond, "n":3}, "ran latency=1.5s n=3"},
+		// Values that would be ambiguous unquoted are quoted.
+		{Fields{FieldChannel:"Game Room"}, `ran channel="Game Room"`},
+		{Fields{"a":`say "hi"`, "b":"x=y", "c":"1\n2", "d":""}, `ran a="say \"hi\"" b="x=y" c="1\n2" d=`},
+		{Fields{FieldError:errors.New("no such file")}, `ran error="no such file"`},
+	}
+	for _, test := range tests {
+		entry := Entry{Message:"ran", Fields:test.fields}
+		if got := entry.Text(); got != test.want {
+			t.Errorf("Text() = %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewJSONLogger(&buffer)
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	logger.PrintEntry(Entry{Time:at, Level:LevelWarn, Kind:ErrorLogs, Message:"slow",
+		Fields:Fields{FieldLatency:250 * time.Millisecond, FieldError:errors.New("timed out"),
+			FieldUser:"alice", "msg":"not the message", "level":"not the level"}})
+	logger.Print("plain\n")
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2: %q", len(lines), buffer.String())
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &object); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"time":"2024-05-06T07:08:09Z", "level":"warn",
+		"kind":"error", "msg":"slow", FieldLatency:0.25, FieldError:"timed out",
+		FieldUser:"alice"}
+	if len(object) != len(want) {
+		t.Errorf("got %v, want %v", object, want)
+	}
+	for key, value := range want {
+		if object[key] != value {
+			t.Errorf("%s: got %v, want %v", key, object[key], value)
+		}
+	}
+
+	// Plain messages are entries at the info level, without their newline.
+	object = nil
+	if err := json.Unmarshal([]byte(lines[1]), &object); err != nil {
+		t.Fatal(err)
+	}
+	if object["msg"] != "plain" || object["level"] != "info" {
+		t.Errorf("got %v for a plain message", object)
+	}
+
+	// Entries that can't be written as JSON are reported as such.
+	buffer.Reset()
+	logger.PrintEntry(Entry{Time:at, Message:"odd", Fields:Fields{"f":func() {}}})
+	object = nil
+	if err := json.Unmarshal(buffer.Bytes(), &object); err != nil {
+		t.Fatal(err)
+	}
+	if object["level"] != "error" || !strings.HasPrefix(object["msg"].(string), "unloggable entry") {
+		t.Errorf("got %v for an unloggable entry", object)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	recordLogs(t)
+	everything := &recorder{}
+	AddLogger(everything, ErrorLogs, DebugLogs)
+	warnings := &recorder{}
+	AddLogger(warnings, ErrorLogs, DebugLogs).MinLevel(LevelWarn)
+	errorsOnly := &recorder{}
+	AddLogger(errorsOnly, ErrorLogs).MinLevel(LevelDebug)
+
+	Log(DebugLogs, "debug")
+	Log(ErrorLogs, "error")
+	LogEntry(Entry{Kind:DebugLogs, Level:LevelWarn, Message:"warning"})
+	Log(InterractionLogs, "interaction")
+
+	tests := []struct {
+		name string
+		rec  *recorder
+		want []string
+	}{
+		{"everything", everything, []string{"debug", "error", "warning"}},
+		{"warnings", warnings, []string{"error", "warning"}},
+		{"errors only", errorsOnly, []string{"error"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, entry := range test.rec.take() {
+			got = append(got, entry.Message)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
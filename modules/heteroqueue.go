@@ -5,44 +5,17 @@
 
 package modules
 
-import "layeh.com/gumble/gumble"
 import "layeh.com/gumble/gumbleffmpeg"
 import "github.com/zorodc/maobot/commands"
 import "github.com/zorodc/maobot/collections/syncqueue"
+import logs "github.com/zorodc/maobot/loggers"
+import "layeh.com/gumble/gumble"
+import "html"
 import "time"
 //import "github.com/zorodc/maobot/eventstream"
 
-const kLoopInterval = 200 * time.Millisecond
-
-// TODO: On rollback, grab source of stopped song and restart w/ it.
-// Otherwise unpause.
-
-// Spinlock. Once the current song is done, go to the next one.
-// TODO: Add synchronization to StreamQueue functions.
-// This will ensure exclusivity of queue manipulation.
-func thread() { 
-	for {
-		time.Sleep(kLoopInterval)
-
-		s := gStreamQueue.Front()
-		if s != nil &&
-			s.(*gumbleffmpeg.Stream).State() == gumbleffmpeg.StateStopped {
-			gStreamQueue.PopFront()
-			if s := gStreamQueue.Front(); s != nil {
-				s := s.(*gumbleffmpeg.Stream)
-				err := s.Play()
-				println("Skipping!")
-				if err != nil {
-					println(err.Error())
-				}
-			}
-// TODO: FIX THIS FOR OTHERS
-//			if s := gStreamQueue.Front().(*gumbleffmpeg.Stream); s != nil {
-//				s.Play()
-//			}
-		}
-	}
-}
+// The number of finished tracks remembered for !prev, unless configured.
+const kDefaultHistoryLen = 20
 
 func init() {
 //	eventstream.PostRecipient(func(e interface{}) bool {
@@ -60,33 +33,49 @@ func init() {
 //		return false
 //	})
 
-	SetPlayer(&gStreamQueue)
-	go thread()
+	SetPlayer(gStreamQueue)
 	commands.Table["queue"] = commands.Command{
-		Function:func(_ interface{}) { SetPlayer(&gStreamQueue); },
+		Function:func() { SetPlayer(gStreamQueue); },
 		Arity:0,
 		OptionalArgs:nil,
 		Description:"Set the queue as the current player.",
-		Usage:"",}
+		Usage:"",
+		Permission:commands.RegisteredUser,}
 	commands.Table["add"] = commands.Command{
-		Function:func(c *gumble.Client, link string) {
-			source := gumbleffmpeg.SourceExec(
-				"youtube-dl", "-f", "opus/bestaudio", "-o", "-", link)
-			println("Source object made.")
-			stream := gumbleffmpeg.New(c, source)
-			println("Stream object made.")
-			gStreamQueue.Append(stream)
-			println("Stream object appended.")
-			err := gStreamQueue.Front().(*gumbleffmpeg.Stream).Play()
-			println("Playing...")
-			if err != nil {
-				println(err.Error())
+		Function:func(ctx *commands.Context, link string) {
+			position := gStreamQueue.enqueue(gStreamQueue.newLinkTrack(ctx, link))
+			logs.Logf(logs.DebugLogs, "Queued `%s` at position %d.", link, position)
+			ctx.Replyf("Queued at position %d.", position)
+		},
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Add a link to the end of the queue.",
+		Usage:"link",}
+	commands.Table["prev"] = commands.Command{
+		Function:func(ctx *commands.Context) {
+			if title, ok := gStreamQueue.Prev(); ok {
+				ctx.Replyf("Replaying %s.", html.EscapeString(title))
+			} else {
+				ctx.Reply("There is no previous track.")
 			}
 		},
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Replay the previous track, then resume the current one.",
+		Usage:"",
+		Permission:commands.RegisteredUser,}
+	commands.Table["previous"] = commands.Table["prev"]
+	commands.Table["prior"]    = commands.Table["prev"]
+	commands.Table["myvolume"] = commands.Command{
+		Function:func(ctx *commands.Context, vol float32) {
+			vol = gStreamQueue.SetUserVolume(ctx.Sender.Name, vol)
+			ctx.Replyf("Tracks you queue will play at volume %.2f.", vol)
+		},
 		Arity:1,
 		OptionalArgs:nil,
-		Description:"Set the queue as the current player.",
-		Usage:"",}
+		Description:"Set the volume at which the tracks you queue are played.",
+		Usage:"level",
+		Permission:commands.RegisteredUser,}
 /*	commands.Table["fromfile"] = commands.Command{
 		Function:fromFile,
 		Arity: 1,
@@ -113,52 +102,412 @@ func init() {
 		Usage:"",}*/
 }
 
-/* Implementation of the player interface for ffmpeg streams. */
+// The parts of a gumbleffmpeg.Stream used by the player.
+// Anything playable in the same manner may be queued, e.g. a fake for testing.
+type Stream interface {
+	Play() error
+	Pause() error
+	Stop() error
+	Wait() // Returns once the stream has finished or been stopped.
+	State() gumbleffmpeg.State
+	Elapsed() time.Duration
+	SetVolume(float32)
+}
+
+// Adapts a gumbleffmpeg.Stream, whose volume is a field, to Stream.
+type ffmpegStream struct {
+	*gumbleffmpeg.Stream
+}
+
+func (this ffmpegStream) SetVolume(vol float32) {
+	this.Stream.Volume = vol
+}
+
+// The range of volumes, where 1 plays a stream as is.
+const (
+	kMinVolume     = float32(0.0)
+	kMaxVolume     = float32(2.0)
+	kDefaultVolume = float32(1.0)
+)
+
+func clampVolume(vol float32) float32 {
+	switch {
+	case vol < kMinVolume: return kMinVolume
+	case vol > kMaxVolume: return kMaxVolume
+	}; return vol
+}
+
+// The name to record as having queued a track.
+func submitter(ctx *commands.Context) string {
+	if ctx.Sender == nil { return ""; }
+	return ctx.Sender.Name
+}
+
+// Describes where a track came from, so that its stream may be recreated;
+// a stream can't be replayed once it has stopped.
+type source struct {
+	link string // A link played through youtube-dl, if set,
+	file string // otherwise, a path to a file ffmpeg can read.
+}
+
+func (this source) String() string {
+	if this.link != "" { return this.link; }
+	return this.file
+}
+
+// Create a new, unstarted stream of the source, beginning `offset` into it.
+func (this source) open(client *gumble.Client, offset time.Duration) Stream {
+	var src gumbleffmpeg.Source
+	if this.link != "" {
+		src = gumbleffmpeg.SourceExec(
+			gYoutubeDL, "-f", "opus/bestaudio", "-o", "-", "--", this.link)
+	} else {
+		src = gumbleffmpeg.SourceFile(this.file)
+	}
+	stream := gumbleffmpeg.New(client, src)
+	stream.Offset = offset
+	return ffmpegStream{stream}
+}
+
+// An entry in the queue.
+type track struct {
+	stream      Stream
+	source      source
+	client      *gumble.Client // The client the stream plays through.
+	submitter   string    // The name of whoever queued the track.
+	meta        *Metadata // nil until known, if ever.
+	awaited     bool      // Whether something is waiting for the stream to finish.
+	interrupted bool      // Paused to play another; resumes when it's next.
+	held        bool      // Not to start until told to play, e.g. once resumed.
+	offset      time.Duration // Where in the source the stream begins.
+	volume      float32   // What it plays at, once started.
+}
+
+// Create a track for the player streaming a link through youtube-dl, on
+// behalf of the sender. Its metadata is fetched in the background, and filled
+// in by the player's owner goroutine once known.
+func (this *StreamPlayer) newLinkTrack(ctx *commands.Context, link string) *track {
+	src := source{link:link}
+	t := &track{stream:src.open(ctx.Client, 0), source:src, client:ctx.Client,
+		submitter:submitter(ctx)}
+
+	go func() {
+		meta, err := FetchMetadata(link)
+		if err != nil {
+			logs.Logf(logs.ErrorLogs, "No metadata for `%s`: %s.", link, err.Error())
+			return
+		}
+		this.do(func() { t.meta = meta; })
+	}()
+	return t
+}
+
+// A short name for the track.
+func (this *track) title() string {
+	if this.meta != nil && this.meta.Title != "" {
+		return this.meta.Title
+	}
+	return this.source.String()
+}
+
+// Create a fresh, unstarted copy of the track.
+func (this *track) replay() *track {
+	return this.reopen(this.client, 0)
+}
+
+// Create an unstarted copy of the track, playing through `client` from
+// `offset` into its source.
+func (this *track) reopen(client *gumble.Client, offset time.Duration) *track {
+	return &track{stream:this.source.open(client, offset), source:this.source,
+		client:client, submitter:this.submitter, meta:this.meta, offset:offset,
+		volume:this.volume}
+}
+
+// How far into its source the track has played.
+func (this *track) elapsed() time.Duration {
+	return this.offset + this.stream.Elapsed()
+}
+
+// Stop the track's stream, if it has been started.
+func (this *track) stop() {
+	if this.stream.State() != gumbleffmpeg.StateInitial {
+		this.stream.Stop()
+	}
+}
+
+/* Implementation of the player interface for ffmpeg streams.
+   The queue is owned by a single goroutine, which runs every request made of
+   the player in turn, so that skipping, pausing and a track ending by itself
+   can never interleave. */
 type StreamPlayer struct {
-	syncqueue.Queue
+	queue    syncqueue.Queue[*track]
+	requests chan func()
+	volume   float32            // Carried over from track to track.
+	userVols map[string]float32 // Volumes for the tracks a user queues, instead.
+	history    []*track // Tracks that have left the front, oldest first.
+	historyLen uint     // The most tracks kept in the history.
 }
 
-var gStreamQueue StreamPlayer
+var gStreamQueue = NewStreamPlayer()
 
-func (this *StreamPlayer) Next() {
-	front := this.PopFront()
-	if front != nil {
-		front.(*gumbleffmpeg.Stream).Pause()
+func NewStreamPlayer() *StreamPlayer {
+	this := &StreamPlayer{requests:make(chan func()), volume:kDefaultVolume,
+		userVols:map[string]float32{}, historyLen:kDefaultHistoryLen}
+	go this.run()
+	return this
+}
+
+// Set how many finished tracks the queue remembers for !prev.
+func SetHistoryLen(n uint) {
+	gStreamQueue.SetHistoryLen(n)
+}
+
+// The owner goroutine.
+func (this *StreamPlayer) run() {
+	for request := range this.requests {
+		request()
 	}
-	this.Play()
 }
 
-func (this *StreamPlayer) Paused() bool {
-	front := this.Front()
-	if front != nil {
-		return front.(*gumbleffmpeg.Stream).State() == gumbleffmpeg.StatePaused
+// Have the owner goroutine run `request`, and wait until it has.
+// Must not be called by the owner goroutine itself.
+func (this *StreamPlayer) do(request func()) {
+	done := make(chan struct{})
+	this.requests <- func() {
+		defer close(done)
+		request()
 	}
+	<-done
+}
 
-	return false
+// Wait for the track to finish, then inform the owner goroutine.
+func (this *StreamPlayer) await(t *track) {
+	t.stream.Wait()
+	this.requests <- func() { this.finished(t); }
 }
 
-func (this *StreamPlayer) Pause() {
-	front := this.Front()
-	if front != nil {
-		front.(*gumbleffmpeg.Stream).Pause()
+// Called by the owner goroutine once a track's stream has finished.
+func (this *StreamPlayer) finished(t *track) {
+	// If it isn't at the front, it was skipped, and the queue has moved on.
+	if front, ok := this.queue.Front(); !ok || front != t {
+		return
 	}
+	logs.Log(logs.DebugLogs, "Track finished.")
+	this.queue.PopFront()
+	this.retire(t)
+	this.start()
 }
 
-func (this *StreamPlayer) Play() {
-	front := this.Front()
-	if front != nil {
-		front.(*gumbleffmpeg.Stream).Play()
+// Stop a track that has left the front of the queue, and remember it.
+func (this *StreamPlayer) retire(t *track) {
+	t.stop()
+	this.history = append(this.history, t)
+	if over := len(this.history) - int(this.historyLen); over > 0 {
+		this.history = append([]*track(nil), this.history[over:]...)
+	}
+}
+
+// Set how many finished tracks are remembered, forgetting any excess.
+func (this *StreamPlayer) SetHistoryLen(n uint) {
+	this.do(func() {
+		this.historyLen = n
+		if over := len(this.history) - int(n); over > 0 {
+			this.history = append([]*track(nil), this.history[over:]...)
+		}
+	})
+}
+
+// Replay the most recent track in the history, pausing the current track
+// until it's done. Returns the title of the track, and false if there's none.
+func (this *StreamPlayer) Prev() (title string, ok bool) {
+	this.do(func() {
+		if len(this.history) == 0 { return; }
+		last := this.history[len(this.history)-1]
+		this.history = this.history[:len(this.history)-1]
+
+		this.interruptWith(last.replay())
+		title, ok = last.title(), true
+	}); return
+}
+
+// Start the front track, if it hasn't been started yet.
+// Tracks which fail to start, or were stopped already, are dropped in favour
+// of the next.
+func (this *StreamPlayer) start() {
+	for t, ok := this.queue.Front(); ok; t, ok = this.queue.Front() {
+		switch t.stream.State() {
+		case gumbleffmpeg.StateStopped:
+			this.queue.PopFront()
+			continue
+		case gumbleffmpeg.StatePaused:
+			if t.interrupted && !t.held {
+				t.interrupted = false
+				t.volume = this.volumeFor(t)
+				t.stream.SetVolume(t.volume)
+				t.stream.Play()
+			}
+			return
+		case gumbleffmpeg.StatePlaying:
+			return
+		}
+		if t.held { return; }
+
+		t.volume = this.volumeFor(t)
+		t.stream.SetVolume(t.volume)
+
+		err := t.stream.Play()
+		if err == nil {
+			if !t.awaited {
+				t.awaited = true
+				go this.await(t)
+			}
+			return
+		}
+		logs.Logf(logs.ErrorLogs, "Couldn't play track: %s.", err.Error())
+		this.queue.PopFront()
 	}
 }
 
-func (this *StreamPlayer) Info() string {
-	return "" // TODO
+// Have the player resume through a new client, after reconnecting.
+// Any move asked for through the old one is forgotten.
+func Rebind(client *gumble.Client) {
+	forgetMove()
+	gStreamQueue.Rebind(client)
+}
+
+// Replace the queued tracks' streams, which died with the old connection, with
+// streams through `client`. The current track resumes where it left off, or
+// stays paused if it was paused. Tracks in the history are replayed through
+// `client` from now on.
+func (this *StreamPlayer) Rebind(client *gumble.Client) {
+	this.do(func() {
+		for _, t := range this.history {
+			t.client = client
+		}
+		tracks := this.queue.Snapshot()
+		if len(tracks) == 0 { return; }
+		this.queue.Clear()
+		for i, t := range tracks {
+			var fresh *track
+			if i == 0 || t.interrupted {
+				fresh = t.reopen(client, t.elapsed())
+				fresh.interrupted = t.interrupted
+				fresh.held = i == 0 &&
+					(t.held || t.stream.State() == gumbleffmpeg.StatePaused)
+			} else {
+				fresh = t.reopen(client, 0)
+			}
+			// The old track's await sees it has left the front, and does nothing.
+			t.stop()
+			this.queue.Append(fresh)
+		}
+		this.start()
+	})
+}
+
+// Add a track to the back of the queue, and return its 1-based position.
+// If nothing was queued, it begins playing immediately.
+func (this *StreamPlayer) enqueue(t *track) (position uint) {
+	this.do(func() {
+		this.queue.Append(t)
+		position = this.queue.Count()
+		this.start()
+	}); return
 }
 
-func (this *StreamPlayer) Volume() float32 {
-	return 0.0 // TODO
+func (this *StreamPlayer) Next() {
+	this.do(func() {
+		if front, ok := this.queue.PopFront(); ok {
+			this.retire(front)
+		}
+		this.start()
+	})
+}
+
+func (this *StreamPlayer) Paused() (paused bool) {
+	this.do(func() {
+		if front, ok := this.queue.Front(); ok {
+			paused = front.held ||
+				front.stream.State() == gumbleffmpeg.StatePaused
+		}
+	}); return
+}
+
+func (this *StreamPlayer) Pause() {
+	this.do(func() {
+		front, ok := this.queue.Front()
+		if ok && front.stream.State() == gumbleffmpeg.StatePlaying {
+			front.stream.Pause()
+		}
+	})
+}
+
+func (this *StreamPlayer) Play() {
+	this.do(func() {
+		front, ok := this.queue.Front()
+		if ok && front.stream.State() == gumbleffmpeg.StatePaused {
+			front.stream.Play()
+		}
+		if ok { front.held = false; }
+		this.start()
+	})
+}
+
+// Describe the current track, or return "" if there is none.
+func (this *StreamPlayer) Info() (info string) {
+	this.do(func() {
+		if t, ok := this.queue.Front(); ok {
+			info = describe(t.meta, t.elapsed(), t.submitter)
+		}
+	}); return
+}
+
+// The volume of the current track, or of those to come if there's none.
+func (this *StreamPlayer) Volume() (vol float32) {
+	this.do(func() { vol = this.volumeNow(); }); return
+}
+
+// Set the volume of the current track and those after it.
+func (this *StreamPlayer) SetVolume(vol float32) float32 {
+	this.do(func() { vol = this.setVolume(vol); }); return vol
+}
+
+// Raise or lower the volume by `delta`, as SetVolume would, returning the
+// volume set. The volume is read and set at once, so that changes made at
+// the same time all count.
+func (this *StreamPlayer) AdjustVolume(delta float32) (vol float32) {
+	this.do(func() { vol = this.setVolume(this.volumeNow() + delta); }); return
+}
+
+// The volume a track starts at: its submitter's, if they've chosen one, else
+// the player's. Called by the owner goroutine.
+func (this *StreamPlayer) volumeFor(t *track) float32 {
+	if vol, ok := this.userVols[t.submitter]; ok { return vol; }
+	return this.volume
+}
+
+// Called by the owner goroutine.
+func (this *StreamPlayer) volumeNow() float32 {
+	if front, ok := this.queue.Front(); ok {
+		return front.volume
+	}
+	return this.volume
+}
+
+// Called by the owner goroutine.
+func (this *StreamPlayer) setVolume(vol float32) float32 {
+	vol = clampVolume(vol)
+	this.volume = vol
+	if front, ok := this.queue.Front(); ok {
+		front.volume = vol
+		front.stream.SetVolume(vol)
+	}
+	return vol
 }
 
-func (this *StreamPlayer) SetVolume(vol float32) {
-	println(vol) // TODO
+// Set the volume at which the tracks queued by `user` will start.
+func (this *StreamPlayer) SetUserVolume(user string, vol float32) float32 {
+	vol = clampVolume(vol)
+	this.do(func() { this.userVols[user] = vol; })
+	return vol
 }
@@ -0,0 +1,325 @@
+package modules
+
+import "layeh.com/gumble/gumble"
+import "layeh.com/gumble/gumbleffmpeg"
+
+import "math/rand"
+import "sync"
+import "testing"
+import "time"
+
+// A stream which plays until stopped, or told to finish.
+type fakeStream struct {
+	mu     sync.Mutex
+	state  gumbleffmpeg.State
+	volume float32
+	starts int // How many times it was played from the start.
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{done:make(chan struct{})}
+}
+
+func (this *fakeStream) Play() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	switch this.state {
+	case gumbleffmpeg.StateInitial:
+		this.starts++
+		fallthrough
+	case gumbleffmpeg.StatePaused:
+		this.state = gumbleffmpeg.StatePlaying
+	}
+	return nil
+}
+
+func (this *fakeStream) Pause() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.state == gumbleffmpeg.StatePlaying {
+		this.state = gumbleffmpeg.StatePaused
+	}
+	return nil
+}
+
+func (this *fakeStream) Stop() error {
+	this.finish()
+	return nil
+}
+
+// End the stream, as if it had played to the end.
+func (this *fakeStream) finish() {
+	this.mu.Lock()
+	this.state = gumbleffmpeg.StateStopped
+	this.mu.Unlock()
+	this.once.Do(func() { close(this.done); })
+}
+
+func (this *fakeStream) Wait() { <-this.done; }
+
+func (this *fakeStream) State() gumbleffmpeg.State {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state
+}
+
+func (this *fakeStream) Elapsed() time.Duration { return 0; }
+
+func (this *fakeStream) SetVolume(vol float32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.volume = vol
+}
+
+func enqueueFake(player *StreamPlayer, submitter string) *fakeStream {
+	stream := newFakeStream()
+	player.enqueue(&track{stream:stream, source:source{file:"fake"},
+		submitter:submitter})
+	return stream
+}
+
+// Wait for `cond` to hold, as checked by the player's owner goroutine.
+func eventually(t *testing.T, player *StreamPlayer, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var ok bool
+		player.do(func() { ok = cond(); })
+		if ok { return; }
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (this *StreamPlayer) front() (stream Stream) {
+	if t, ok := this.queue.Front(); ok {
+		stream = t.stream
+	}; return
+}
+
+func TestStreamPlayerPlaysInTurn(t *testing.T) {
+	player := NewStreamPlayer()
+	first  := enqueueFake(player, "a")
+	second := enqueueFake(player, "b")
+
+	if first.State() != gumbleffmpeg.StatePlaying {
+		t.Fatalf("first track is %v, want playing", first.State())
+	}
+	if second.State() != gumbleffmpeg.StateInitial {
+		t.Fatalf("second track is %v before the first finished", second.State())
+	}
+
+	first.finish()
+	eventually(t, player, "the second track to start", func() bool {
+		return player.front() == Stream(second) &&
+			second.State() == gumbleffmpeg.StatePlaying
+	})
+
+	second.finish()
+	eventually(t, player, "the queue to empty", func() bool {
+		return player.queue.Count() == 0
+	})
+	if len(player.history) != 2 {
+		t.Errorf("history holds %d tracks, want 2", len(player.history))
+	}
+}
+
+func TestStreamPlayerSkip(t *testing.T) {
+	player := NewStreamPlayer()
+	first  := enqueueFake(player, "a")
+	second := enqueueFake(player, "b")
+
+	player.Next()
+	if first.State() != gumbleffmpeg.StateStopped {
+		t.Errorf("skipped track is %v, want stopped", first.State())
+	}
+	if second.State() != gumbleffmpeg.StatePlaying {
+		t.Errorf("next track is %v, want playing", second.State())
+	}
+
+	// The skipped track's end mustn't also advance the queue.
+	third := enqueueFake(player, "c")
+	time.Sleep(10 * time.Millisecond)
+	player.do(func() {})
+	if third.State() != gumbleffmpeg.StateInitial {
+		t.Errorf("the queue advanced twice for one skip")
+	}
+}
+
+func TestStreamPlayerStopped(t *testing.T) {
+	player := NewStreamPlayer()
+	first  := enqueueFake(player, "a")
+	second := enqueueFake(player, "b")
+
+	// A track stopped from outside the player is dropped like a finished one.
+	first.Stop()
+	eventually(t, player, "the stopped track to be dropped", func() bool {
+		return player.front() == Stream(second)
+	})
+	if player.clear() != 0 {
+		t.Errorf("clear removed the current track")
+	}
+}
+
+// Append, skip, stop, pause and finish tracks from many goroutines at once,
+// for the race detector to check, then check that the queue is consistent.
+func TestStreamPlayerConcurrent(t *testing.T) {
+	player := NewStreamPlayer()
+
+	var mu      sync.Mutex
+	var streams []*fakeStream
+	var wg      sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				switch random.Intn(6) {
+				case 0, 1:
+					stream := enqueueFake(player, "user")
+					mu.Lock()
+					streams = append(streams, stream)
+					mu.Unlock()
+				case 2:
+					player.Next()
+				case 3:
+					player.Pause()
+					player.Play()
+				case 4:
+					mu.Lock()
+					if len(streams) > 0 {
+						stream := streams[random.Intn(len(streams))]
+						mu.Unlock()
+						stream.finish()
+					} else {
+						mu.Unlock()
+					}
+				case 5:
+					player.clear()
+				}
+			}
+		}(int64(worker))
+	}
+	wg.Wait()
+
+	// Once the front track's end has been handled, if it ended, it must be
+	// playing, and those behind it must not have started. Tracks finished
+	// before they started stay queued until they reach the front.
+	eventually(t, player, "the queue to settle", func() bool {
+		front, ok := player.queue.Front()
+		return !ok || front.stream.State() != gumbleffmpeg.StateStopped
+	})
+	player.do(func() {
+		for i, queued := range player.queue.Snapshot() {
+			state := queued.stream.State()
+			if i == 0 && state != gumbleffmpeg.StatePlaying {
+				t.Errorf("the front track is %v, want playing", state)
+			}
+			if i > 0 && state != gumbleffmpeg.StateInitial &&
+				state != gumbleffmpeg.StateStopped {
+				t.Errorf("track %d is %v, want unstarted", i+1, state)
+			}
+		}
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for _, stream := range streams {
+		stream.mu.Lock()
+		if stream.starts > 1 {
+			t.Errorf("a track was started %d times", stream.starts)
+		}
+		stream.mu.Unlock()
+	}
+}
+
+func (this *fakeStream) getVolume() float32 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.volume
+}
+
+// A user's volume applies to their tracks alone, not to those after them.
+func TestUserVolume(t *testing.T) {
+	player := NewStreamPlayer()
+	player.SetVolume(0.5)
+	player.SetUserVolume("loud", 1.5)
+	first  := enqueueFake(player, "loud")
+	second := enqueueFake(player, "quiet")
+
+	if vol := first.getVolume(); vol != 1.5 {
+		t.Errorf("the user's track plays at %.2f, want 1.5", vol)
+	}
+	if vol := player.Volume(); vol != 1.5 {
+		t.Errorf("Volume() = %.2f during the user's track, want 1.5", vol)
+	}
+	first.finish()
+	eventually(t, player, "the second track to start", func() bool {
+		return player.front() == Stream(second)
+	})
+	if vol := second.getVolume(); vol != 0.5 {
+		t.Errorf("the next track plays at %.2f, want the player's 0.5", vol)
+	}
+}
+
+// Adjustments made at the same time are each applied, and clamped.
+func TestAdjustVolume(t *testing.T) {
+	player := NewStreamPlayer()
+	stream := enqueueFake(player, "a")
+	player.SetVolume(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			player.AdjustVolume(0.125)
+		}()
+	}
+	wg.Wait()
+	if vol := player.Volume(); vol != 2 {
+		t.Errorf("after 16 rises of 0.125, the volume is %.3f, want 2", vol)
+	}
+	if vol := stream.getVolume(); vol != 2 {
+		t.Errorf("the track plays at %.3f, want 2", vol)
+	}
+	if vol := player.AdjustVolume(1); vol != kMaxVolume {
+		t.Errorf("raising past the maximum gave %.2f", vol)
+	}
+	if vol := player.AdjustVolume(-5); vol != kMinVolume {
+		t.Errorf("lowering past the minimum gave %.2f", vol)
+	}
+}
+
+// Tracks played before reconnecting are replayed through the new client.
+func TestRebindHistory(t *testing.T) {
+	player := NewStreamPlayer()
+	old, fresh := &gumble.Client{}, &gumble.Client{}
+	for i := 0; i < 2; i++ {
+		stream := newFakeStream()
+		player.enqueue(&track{stream:stream, source:source{file:"fake"}, client:old})
+		stream.finish()
+		eventually(t, player, "the track to finish", func() bool {
+			return player.queue.Count() == 0
+		})
+	}
+
+	player.Rebind(fresh)
+	player.do(func() {
+		if len(player.history) != 2 {
+			t.Fatalf("the history holds %d tracks, want 2", len(player.history))
+		}
+		for i, past := range player.history {
+			if past.client != fresh {
+				t.Errorf("track %d of the history is bound to the old client", i+1)
+			}
+		}
+		if replayed := player.history[1].replay(); replayed.client != fresh {
+			t.Error("a replayed track plays through the old client")
+		}
+	})
+}
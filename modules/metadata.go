@@ -0,0 +1,91 @@
+/* Describes the tracks queued from links, as reported by youtube-dl. */
+package modules
+
+import "context"
+import "encoding/json"
+import "fmt"
+import "html"
+import "os/exec"
+import "time"
+
+// The youtube-dl executable used to fetch and describe links.
+// A variable, so that it may be swapped for a stub when testing.
+var gYoutubeDL = "youtube-dl"
+
+// How long youtube-dl may take to describe a link before it's given up on.
+var gMetadataTimeout = 30 * time.Second
+
+// The fields of youtube-dl's --dump-json output the player cares about.
+type Metadata struct {
+	Title      string  `json:"title"`
+	Uploader   string  `json:"uploader"`
+	Duration   float64 `json:"duration"` // In seconds; 0 if unknown.
+	Thumbnail  string  `json:"thumbnail"`
+	WebpageURL string  `json:"webpage_url"`
+}
+
+// Ask youtube-dl to describe the media at `link`, without downloading it.
+func FetchMetadata(link string) (*Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gMetadataTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, gYoutubeDL,
+		"--dump-json", "--no-playlist", "--", link)
+	// Don't wait on any children left holding its output once it's killed.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s: timed out after %s", gYoutubeDL, gMetadataTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", gYoutubeDL, err.Error())
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(out, &meta); err != nil {
+		return nil, fmt.Errorf("%s: bad output: %s", gYoutubeDL, err.Error())
+	}
+	return &meta, nil
+}
+
+func (this *Metadata) Length() time.Duration {
+	return time.Duration(this.Duration * float64(time.Second))
+}
+
+// Format a duration as h:mm:ss, or m:ss if under an hour.
+func clock(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes()) % 60, int(d.Seconds()) % 60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// Describe a track in HTML, e.g. for !info.
+// Any of `meta` or `submitter` may be missing.
+func describe(meta *Metadata, elapsed time.Duration, submitter string) string {
+	text := "<i>Unknown track</i>"
+	total := "?"
+	if meta != nil {
+		title := meta.Title
+		if title == "" { title = "Untitled"; }
+		text = "<b>" + html.EscapeString(title) + "</b>"
+		if meta.WebpageURL != "" {
+			text = `<a href="` + html.EscapeString(meta.WebpageURL) + `">` +
+				text + "</a>"
+		}
+		if meta.Uploader != "" {
+			text += " by " + html.EscapeString(meta.Uploader)
+		}
+		if meta.Duration > 0 {
+			total = clock(meta.Length())
+		}
+	}
+
+	text += " [" + clock(elapsed) + "/" + total + "]"
+	if submitter != "" {
+		text += ", queued by " + html.EscapeString(submitter)
+	}
+	return text
+}
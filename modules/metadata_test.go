@@ -0,0 +1,97 @@
+package modules
+
+import "github.com/zorodc/maobot/commands"
+
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+// Swap youtube-dl for a shell script with the given body, for one test.
+func stubYoutubeDL(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "youtube-dl")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := gYoutubeDL
+	gYoutubeDL = path
+	t.Cleanup(func() { gYoutubeDL = old; })
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// The stub checks it was asked for JSON about the link, after a "--".
+	stubYoutubeDL(t, `[ "$1" = --dump-json ] && [ "$3" = -- ] && [ "$4" = "-x" ] || exit 2
+echo '{"title":"Song","uploader":"Band","duration":95.4,"webpage_url":"https://example.com/v"}'`)
+
+	meta, err := FetchMetadata("-x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{Title:"Song", Uploader:"Band", Duration:95.4,
+		WebpageURL:"https://example.com/v"}
+	if *meta != want {
+		t.Errorf("got %+v, want %+v", *meta, want)
+	}
+	if got := clock(meta.Length()); got != "1:35" {
+		t.Errorf("length %s, want 1:35", got)
+	}
+}
+
+func TestFetchMetadataFailure(t *testing.T) {
+	stubYoutubeDL(t, `echo "ERROR: Unsupported URL" >&2; exit 1`)
+	if _, err := FetchMetadata("https://example.com"); err == nil {
+		t.Error("no error from a failing youtube-dl")
+	}
+
+	stubYoutubeDL(t, `echo "not json"`)
+	if _, err := FetchMetadata("https://example.com"); err == nil ||
+		!strings.Contains(err.Error(), "bad output") {
+		t.Errorf("got %v for bad output", err)
+	}
+}
+
+func TestFetchMetadataTimeout(t *testing.T) {
+	stubYoutubeDL(t, `sleep 30`)
+	old := gMetadataTimeout
+	gMetadataTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { gMetadataTimeout = old; })
+
+	start := time.Now()
+	_, err := FetchMetadata("https://example.com")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	meta := &Metadata{Title:"A <b>", Uploader:"Band", Duration:3700,
+		WebpageURL:"https://example.com/v"}
+	got := describe(meta, 65*time.Second, "sam")
+	want := `<a href="https://example.com/v"><b>A &lt;b&gt;</b></a> by Band` +
+		` [1:05/1:01:40], queued by sam`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := describe(nil, 0, ""); got != "<i>Unknown track</i> [0:00/?]" {
+		t.Errorf("without metadata: got %q", got)
+	}
+}
+
+// A track's metadata is filled in by the owner goroutine of the player it's
+// for, which the race detector checks.
+func TestLinkTrackMetadata(t *testing.T) {
+	stubYoutubeDL(t, `echo '{"title":"Song"}'`)
+	player := NewStreamPlayer()
+	track := player.newLinkTrack(&commands.Context{}, "https://example.com/v")
+	eventually(t, player, "the metadata", func() bool { return track.meta != nil; })
+	player.do(func() {
+		if title := track.title(); title != "Song" {
+			t.Errorf("the track is titled %q, want Song", title)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+/* This source file describes commands moving the bot between channels. */
+package modules
+
+import "github.com/zorodc/maobot/commands"
+import "github.com/zorodc/maobot/eventstream"
+import "layeh.com/gumble/gumble"
+
+import "html"
+import "strings"
+import "sync"
+
+var gMovement struct {
+	sync.Mutex
+	// The last move asked for, so that a refusal can be reported to whoever
+	// asked. Cleared once the bot arrives.
+	pending   *gumble.Channel
+	requester replyTarget
+	// The name of the user being followed, if any, and who asked.
+	following string
+	follower  replyTarget
+}
+
+// Who to tell about a move, kept by name and ID rather than as the Context of
+// their command, as that holds a client and users which die on reconnection.
+type replyTarget struct {
+	sender  string
+	channel uint32
+	private bool
+}
+
+func targetOf(ctx *commands.Context) (target replyTarget) {
+	target.private = ctx.Private
+	if ctx.Sender != nil { target.sender = ctx.Sender.Name; }
+	if ctx.Channel != nil { target.channel = ctx.Channel.ID; }
+	return
+}
+
+// A context replying to the target through `client`.
+func (this replyTarget) context(client *gumble.Client) *commands.Context {
+	ctx := &commands.Context{Client:client, Private:this.private,
+		Channel:client.Channels[this.channel]}
+	if this.sender != "" {
+		ctx.Sender = client.Users.Find(this.sender)
+	}
+	return ctx
+}
+
+func init() {
+	commands.Table["moveto"] = commands.Command{
+		Function:func(ctx *commands.Context, path string) {
+			channel := findChannel(ctx.Client, path)
+			if channel == nil {
+				ctx.Replyf("No such channel `%s`.", html.EscapeString(path))
+				return
+			}
+			stopFollowing(ctx)
+			moveTo(ctx, channel)
+		},
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Move to a channel, given its path from the root, e.g. Music/Lounge.",
+		Usage:"channel",
+		Permission:commands.RegisteredUser,}
+	commands.Table["summon"] = commands.Command{
+		Function:func(ctx *commands.Context) {
+			if ctx.Sender == nil || ctx.Sender.Channel == nil {
+				ctx.Reply("I can't tell which channel you're in.")
+				return
+			}
+			stopFollowing(ctx)
+			moveTo(ctx, ctx.Sender.Channel)
+		},
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Move to your channel.",
+		Usage:"",
+		Permission:commands.RegisteredUser,}
+	commands.Table["follow"] = commands.Command{
+		Function:follow,
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Stay in the same channel as a user, or stop following if none is given.",
+		Usage:"[user]",
+		Permission:commands.ChannelAdmin,}
+	commands.Table["harass"] = commands.Table["follow"]
+
+	eventstream.Subscribe(userChanged)
+	eventstream.Subscribe(moveDenied)
+}
+
+// Find a channel by its path from the root, with names separated by slashes.
+// An empty path, or "/", is the root itself.
+func findChannel(client *gumble.Client, path string) *gumble.Channel {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return client.Channels[0]
+	}
+	return client.Channels.Find(strings.Split(path, "/")...)
+}
+
+// The path of a channel, as findChannel takes it.
+func channelPath(channel *gumble.Channel) string {
+	var names []string
+	for ; channel != nil && channel.Parent != nil; channel = channel.Parent {
+		names = append([]string{channel.Name}, names...)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// Move the bot to `channel` on behalf of `ctx`, who is told if it's refused.
+func moveTo(ctx *commands.Context, channel *gumble.Channel) {
+	self := ctx.Client.Self
+	if self.Channel == channel {
+		ctx.Replyf("I'm already in %s.", html.EscapeString(channelPath(channel)))
+		return
+	}
+
+	gMovement.Lock()
+	gMovement.pending, gMovement.requester = channel, targetOf(ctx)
+	gMovement.Unlock()
+	self.Move(channel)
+}
+
+// Forget the move last asked for, whose channel belongs to a dead client.
+func forgetMove() {
+	gMovement.Lock()
+	gMovement.pending, gMovement.requester = nil, replyTarget{}
+	gMovement.Unlock()
+}
+
+func follow(ctx *commands.Context, name ...string) {
+	if len(name) == 0 {
+		if !stopFollowing(ctx) {
+			ctx.Reply("I'm not following anyone.")
+		}
+		return
+	}
+
+	user := ctx.Client.Users.Find(name[0])
+	if user == nil {
+		ctx.Replyf("No such user `%s`.", html.EscapeString(name[0]))
+		return
+	}
+	if user == ctx.Client.Self {
+		ctx.Reply("I can't follow myself.")
+		return
+	}
+
+	gMovement.Lock()
+	gMovement.following, gMovement.follower = user.Name, targetOf(ctx)
+	gMovement.Unlock()
+	ctx.Replyf("Following %s.", html.EscapeString(user.Name))
+	if user.Channel != nil && user.Channel != ctx.Client.Self.Channel {
+		moveTo(ctx, user.Channel)
+	}
+}
+
+// Stop following whoever is being followed, saying so.
+// Returns false if nobody was being followed.
+func stopFollowing(ctx *commands.Context) bool {
+	gMovement.Lock()
+	name := gMovement.following
+	gMovement.following, gMovement.follower = "", replyTarget{}
+	gMovement.Unlock()
+
+	if name == "" { return false; }
+	ctx.Replyf("No longer following %s.", html.EscapeString(name))
+	return true
+}
+
+// Subscribers run on goroutines of their own, so hold the client throughout.
+func userChanged(e *gumble.UserChangeEvent) {
+	e.Client.Do(func() {
+		if e.User == nil { return; }
+
+		gMovement.Lock()
+		if e.User == e.Client.Self && e.Type.Has(gumble.UserChangeChannel) &&
+			e.User.Channel == gMovement.pending {
+			gMovement.pending, gMovement.requester = nil, replyTarget{}
+		}
+		followed := gMovement.following != "" && e.User.Name == gMovement.following
+		follower := gMovement.follower
+		gMovement.Unlock()
+
+		// Follow the user into any channel they move to, or reappear in, through
+		// the client they were seen by, which may be newer than the !follow.
+		moved := e.Type.Has(gumble.UserChangeChannel) ||
+			e.Type.Has(gumble.UserChangeConnected)
+		if followed && moved && e.User.Channel != nil &&
+			e.User.Channel != e.Client.Self.Channel {
+			moveTo(follower.context(e.Client), e.User.Channel)
+		}
+	})
+}
+
+// Report the server refusing to let the bot into the channel last asked for.
+func moveDenied(e *gumble.PermissionDeniedEvent) {
+	e.Client.Do(func() {
+		gMovement.Lock()
+		channel, requester := gMovement.pending, gMovement.requester
+		if e.Channel == nil || e.Channel != channel {
+			gMovement.Unlock()
+			return
+		}
+		gMovement.pending, gMovement.requester = nil, replyTarget{}
+		gMovement.Unlock()
+
+		ctx := requester.context(e.Client)
+		path := html.EscapeString(channelPath(channel))
+		switch e.Type {
+		case gumble.PermissionDeniedPermission:
+			ctx.Replyf("I'm not permitted to enter %s.", path)
+		case gumble.PermissionDeniedChannelFull:
+			ctx.Replyf("%s is full.", path)
+		default:
+			ctx.Replyf("I couldn't move to %s: %s", path, html.EscapeString(e.String))
+		}
+	})
+}
@@ -8,9 +8,10 @@ type Player interface {
 	Paused() bool
 	Pause()
 	Play()
-	Info() string
+	Info() string // Describes the current track in HTML, or is "" if none.
 	Volume() float32
-	SetVolume(float32)
+	SetVolume(float32) float32    // Returns the volume actually set.
+	AdjustVolume(float32) float32 // Changes it by as much, returning the result.
 }
 
 var gCurrentPlayer Player
@@ -18,31 +19,68 @@ var gCurrentPlayer Player
 func init() {
 	// pop|skip|next
 	commands.Table["next"]    =
-		commands.Command{Function:func(_ interface{}) { gCurrentPlayer.Next(); }}
+		commands.Command{Function:func() { gCurrentPlayer.Next(); },
+			Description:"Skip to the next track.",
+			Permission:commands.RegisteredUser}
 	commands.Table["skip"]    = commands.Table["next"]
 	commands.Table["pop"]     = commands.Table["next"]
 
 	commands.Table["pause"]   =
-		commands.Command{Function:func(_ interface{}) { gCurrentPlayer.Pause(); }}
+		commands.Command{Function:func() { gCurrentPlayer.Pause(); },
+			Description:"Pause the current track."}
 	commands.Table["unpause"] =
-		commands.Command{Function:func(_ interface{}) { gCurrentPlayer.Play(); }}
+		commands.Command{Function:func() { gCurrentPlayer.Play(); },
+			Description:"Resume the current track."}
 	commands.Table["play"]    = commands.Table["unpause"]
 	
 	commands.Table["info"]    =
-		commands.Command{Function:func(_ interface{}) { gCurrentPlayer.Info(); }}
+		commands.Command{Function:func(ctx *commands.Context) {
+			if info := gCurrentPlayer.Info(); info != "" {
+				ctx.Reply(info)
+			} else {
+				ctx.Reply("Nothing is playing.")
+			}},
+			Description:"Describe the current track."}
 
 	commands.Table["volume"]  = commands.Command{Function:
-		func(_ interface{}, vol float32) {gCurrentPlayer.SetVolume(vol); }}
+		func(ctx *commands.Context, vol ...float32) {
+			if len(vol) > 0 {
+				gCurrentPlayer.SetVolume(vol[0])
+			}
+			reportVolume(ctx)
+		},
+		Arity:0,
+		OptionalArgs:nil,
+		Permission:commands.RegisteredUser,
+		Description:"Show or set the volume of the current player.",
+		Usage:"[level]",}
 	commands.Table["volup"]   = commands.Command{Function:
-		func(_ interface{}, vol float32) {
-			gCurrentPlayer.SetVolume(gCurrentPlayer.Volume() + vol); }}
+		func(ctx *commands.Context, vol float32) {
+			gCurrentPlayer.AdjustVolume(vol)
+			reportVolume(ctx)
+		},
+		Arity:1,
+		Permission:commands.RegisteredUser,
+		Description:"Raise the volume of the current player.",
+		Usage:"amount",}
 	commands.Table["voldown"] = commands.Command{Function:
-		func(_ interface{}, vol float32) {
-			gCurrentPlayer.SetVolume(gCurrentPlayer.Volume() - vol); }}
+		func(ctx *commands.Context, vol float32) {
+			gCurrentPlayer.AdjustVolume(-vol)
+			reportVolume(ctx)
+		},
+		Arity:1,
+		Permission:commands.RegisteredUser,
+		Description:"Lower the volume of the current player.",
+		Usage:"amount",}
+	commands.Table["vol"]        = commands.Table["volume"]
 	commands.Table["volumeup"]   = commands.Table["volup"]
 	commands.Table["volumedown"] = commands.Table["voldown"]
 }
 
+func reportVolume(ctx *commands.Context) {
+	ctx.Replyf("Volume is %.2f.", gCurrentPlayer.Volume())
+}
+
 func SetPlayer(player Player) {
 	if gCurrentPlayer != nil {
 		gCurrentPlayer.Pause()
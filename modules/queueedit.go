@@ -0,0 +1,184 @@
+/* Commands for editing the queue: adding ahead of others, interrupting,
+   removing, reordering, clearing and listing.
+   Positions given to and shown to users count from 1, the current track. */
+package modules
+
+import "github.com/zorodc/maobot/commands"
+
+import "fmt"
+import "html"
+
+// The number of tracks shown on each page of !list.
+const kListPageLen = 10
+
+func init() {
+	commands.Table["playnext"] = commands.Command{
+		Function:func(ctx *commands.Context, link string) {
+			gStreamQueue.insertNext(gStreamQueue.newLinkTrack(ctx, link))
+			ctx.Reply("Queued to play next.")
+		},
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Add a link to play after the current track.",
+		Usage:"link",}
+	commands.Table["prepend"] = commands.Table["playnext"]
+
+	commands.Table["playnow"] = commands.Command{
+		Function:func(ctx *commands.Context, link string) {
+			gStreamQueue.interrupt(gStreamQueue.newLinkTrack(ctx, link))
+			ctx.Reply("Playing now; the current track will resume afterwards.")
+		},
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Interrupt the current track to play a link.",
+		Usage:"link",
+		Permission:commands.RegisteredUser,}
+	commands.Table["push"]      = commands.Table["playnow"]
+	commands.Table["interrupt"] = commands.Table["playnow"]
+
+	commands.Table["clear"] = commands.Command{
+		Function:func(ctx *commands.Context) {
+			ctx.Replyf("Removed %d upcoming tracks.", gStreamQueue.clear())
+		},
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"Remove every track after the current one, but for any " +
+			"it interrupted, which resume after it.",
+		Usage:"",
+		Permission:commands.ChannelAdmin,}
+
+	commands.Table["remove"] = commands.Command{
+		Function:func(ctx *commands.Context, position uint) {
+			if title, ok := gStreamQueue.remove(position); ok {
+				ctx.Replyf("Removed %s.", html.EscapeString(title))
+			} else {
+				ctx.Replyf("There is no track at position %d.", position)
+			}
+		},
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Remove the track at a position in the queue.",
+		Usage:"position",
+		Permission:commands.RegisteredUser,}
+
+	commands.Table["move"] = commands.Command{
+		Function:func(ctx *commands.Context, from, to uint) {
+			if gStreamQueue.move(from, to) {
+				ctx.Replyf("Moved the track at position %d to %d.", from, to)
+			} else {
+				ctx.Reply("Only tracks after the current one may be moved, " +
+					"and only to positions within the queue.")
+			}
+		},
+		Arity:2,
+		OptionalArgs:nil,
+		Description:"Move a track to another position in the queue.",
+		Usage:"from to",
+		Permission:commands.RegisteredUser,}
+
+	commands.Table["list"] = commands.Command{
+		Function:func(ctx *commands.Context, page ...uint) {
+			n := uint(1)
+			if len(page) > 0 { n = page[0]; }
+			ctx.Reply(gStreamQueue.list(n))
+		},
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"List the tracks in the queue.",
+		Usage:"[page]",}
+}
+
+// Insert a track just after the current one.
+func (this *StreamPlayer) insertNext(t *track) {
+	this.do(func() {
+		this.queue.InsertAt(1, t)
+		this.start()
+	})
+}
+
+// Play a track at once, resuming the current track after it.
+func (this *StreamPlayer) interrupt(t *track) {
+	this.do(func() { this.interruptWith(t); })
+}
+
+// Called by the owner goroutine to play a track before the current one.
+func (this *StreamPlayer) interruptWith(t *track) {
+	if current, ok := this.queue.Front(); ok {
+		if current.stream.Pause() == nil {
+			current.interrupted = true
+		}
+	}
+	this.queue.Prepend(t)
+	this.start()
+}
+
+// Remove every track but the current one and those it interrupted, returning
+// how many were removed.
+func (this *StreamPlayer) clear() (removed uint) {
+	this.do(func() {
+		tracks := this.queue.Snapshot()
+		this.queue.Clear()
+		for i, t := range tracks {
+			if i == 0 || t.interrupted {
+				this.queue.Append(t)
+			} else {
+				t.stop()
+				removed++
+			}
+		}
+	}); return
+}
+
+// Remove the track at a 1-based position, skipping it if it's the current one.
+func (this *StreamPlayer) remove(position uint) (title string, ok bool) {
+	this.do(func() {
+		if position < 1 { return; }
+		t, found := this.queue.RemoveAt(position - 1)
+		if !found { return; }
+
+		title, ok = t.title(), true
+		if position == 1 {
+			this.retire(t)
+			this.start()
+		} else {
+			t.stop()
+		}
+	}); return
+}
+
+// Move the track at one 1-based position to another.
+// The current track may neither be moved, nor displaced.
+func (this *StreamPlayer) move(from, to uint) (ok bool) {
+	this.do(func() {
+		if from < 2 || to < 2 { return; }
+		ok = this.queue.Move(from - 1, to - 1)
+	}); return
+}
+
+// Produce a page of the queue's listing in HTML.
+func (this *StreamPlayer) list(page uint) (listing string) {
+	this.do(func() {
+		items := this.queue.Snapshot()
+		if len(items) == 0 {
+			listing = "The queue is empty."
+			return
+		}
+
+		pages := (uint(len(items)) + kListPageLen - 1) / kListPageLen
+		if page < 1 { page = 1; }
+		if page > pages { page = pages; }
+
+		listing = fmt.Sprintf("<b>Queue</b> (page %d of %d):", page, pages)
+		for i := (page - 1) * kListPageLen;
+			i < page * kListPageLen && i < uint(len(items)); i++ {
+			t := items[i]
+			listing += fmt.Sprintf("<br/>%d. %s", i+1, html.EscapeString(t.title()))
+			if t.submitter != "" {
+				listing += " &mdash; " + html.EscapeString(t.submitter)
+			}
+			if i == 0 {
+				listing += " <i>(playing)</i>"
+			}
+		}
+	}); return
+}
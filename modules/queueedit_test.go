@@ -0,0 +1,175 @@
+package modules
+
+import "layeh.com/gumble/gumbleffmpeg"
+
+import "slices"
+import "strings"
+import "testing"
+
+// A track of a fake stream, titled `name`.
+func fakeTrack(name string) (*track, *fakeStream) {
+	stream := newFakeStream()
+	return &track{stream:stream, source:source{file:name}, submitter:"a"}, stream
+}
+
+// The titles of the queued tracks, in order.
+func titles(player *StreamPlayer) (names []string) {
+	player.do(func() {
+		for _, t := range player.queue.Snapshot() {
+			names = append(names, t.title())
+		}
+	}); return
+}
+
+func expectQueue(t *testing.T, player *StreamPlayer, want ...string) {
+	t.Helper()
+	if got := titles(player); !slices.Equal(got, want) {
+		t.Errorf("the queue holds %q, want %q", got, want)
+	}
+}
+
+// A player queueing the tracks named, the first of them playing.
+func queueOf(names ...string) (*StreamPlayer, map[string]*fakeStream) {
+	player := NewStreamPlayer()
+	streams := map[string]*fakeStream{}
+	for _, name := range names {
+		t, stream := fakeTrack(name)
+		player.enqueue(t)
+		streams[name] = stream
+	}
+	return player, streams
+}
+
+func TestInsertNext(t *testing.T) {
+	player, streams := queueOf("a", "b")
+	next, stream := fakeTrack("c")
+	player.insertNext(next)
+	expectQueue(t, player, "a", "c", "b")
+	if stream.State() != gumbleffmpeg.StateInitial {
+		t.Error("the track inserted started before the current one finished")
+	}
+	streams["a"].finish()
+	eventually(t, player, "the inserted track to start", func() bool {
+		return stream.State() == gumbleffmpeg.StatePlaying
+	})
+}
+
+func TestInterrupt(t *testing.T) {
+	player, streams := queueOf("a", "b")
+	now, stream := fakeTrack("c")
+	player.interrupt(now)
+	expectQueue(t, player, "c", "a", "b")
+	if stream.State() != gumbleffmpeg.StatePlaying ||
+		streams["a"].State() != gumbleffmpeg.StatePaused {
+		t.Fatalf("the interrupting track is %v and the interrupted %v",
+			stream.State(), streams["a"].State())
+	}
+
+	stream.finish()
+	eventually(t, player, "the interrupted track to resume", func() bool {
+		return streams["a"].State() == gumbleffmpeg.StatePlaying
+	})
+	expectQueue(t, player, "a", "b")
+}
+
+// Clearing keeps the track interrupted, which resumes once the current one ends.
+func TestClearKeepsInterrupted(t *testing.T) {
+	player, streams := queueOf("a", "b", "c")
+	now, stream := fakeTrack("d")
+	player.interrupt(now)
+
+	if removed := player.clear(); removed != 2 {
+		t.Errorf("cleared %d tracks, want 2", removed)
+	}
+	expectQueue(t, player, "d", "a")
+	for _, name := range []string{"b", "c"} {
+		if streams[name].State() == gumbleffmpeg.StatePlaying {
+			t.Errorf("%s plays after being cleared", name)
+		}
+	}
+
+	stream.finish()
+	eventually(t, player, "the interrupted track to resume", func() bool {
+		return streams["a"].State() == gumbleffmpeg.StatePlaying
+	})
+	if player.clear() != 0 {
+		t.Error("clearing a queue of one removed something")
+	}
+	expectQueue(t, player, "a")
+}
+
+func TestRemove(t *testing.T) {
+	player, streams := queueOf("a", "b", "c", "d")
+
+	if title, ok := player.remove(3); !ok || title != "c" {
+		t.Errorf("remove(3) = %q, %t, want c", title, ok)
+	}
+	expectQueue(t, player, "a", "b", "d")
+	// Removing the current track skips to the next.
+	if title, ok := player.remove(1); !ok || title != "a" {
+		t.Errorf("remove(1) = %q, %t, want a", title, ok)
+	}
+	if streams["a"].State() != gumbleffmpeg.StateStopped ||
+		streams["b"].State() != gumbleffmpeg.StatePlaying {
+		t.Errorf("after removing the current track, a is %v and b %v",
+			streams["a"].State(), streams["b"].State())
+	}
+	expectQueue(t, player, "b", "d")
+
+	for _, position := range []uint{0, 3, 100} {
+		if _, ok := player.remove(position); ok {
+			t.Errorf("removed a track at position %d", position)
+		}
+	}
+	expectQueue(t, player, "b", "d")
+}
+
+func TestMove(t *testing.T) {
+	player, _ := queueOf("a", "b", "c", "d")
+	if !player.move(4, 2) {
+		t.Error("couldn't move 4 to 2")
+	}
+	expectQueue(t, player, "a", "d", "b", "c")
+	if !player.move(2, 4) {
+		t.Error("couldn't move 2 to 4")
+	}
+	expectQueue(t, player, "a", "b", "c", "d")
+
+	// The current track stays put, and positions must be in the queue.
+	for _, bad := range [][2]uint{{1, 3}, {3, 1}, {0, 2}, {2, 5}, {5, 2}} {
+		if player.move(bad[0], bad[1]) {
+			t.Errorf("moved %d to %d", bad[0], bad[1])
+		}
+	}
+	expectQueue(t, player, "a", "b", "c", "d")
+}
+
+func TestList(t *testing.T) {
+	player := NewStreamPlayer()
+	if got := player.list(1); got != "The queue is empty." {
+		t.Errorf("an empty queue is listed as %q", got)
+	}
+
+	var names []string
+	for i := 0; i < kListPageLen + 3; i++ {
+		names = append(names, string(rune('a' + i)))
+	}
+	player, _ = queueOf(names...)
+	first := player.list(1)
+	if !strings.HasPrefix(first, "<b>Queue</b> (page 1 of 2):<br/>1. a &mdash; a <i>(playing)</i>") {
+		t.Errorf("the first page begins %q", first)
+	}
+	if n := strings.Count(first, "<br/>"); n != kListPageLen {
+		t.Errorf("the first page lists %d tracks, want %d", n, kListPageLen)
+	}
+	// Pages past the last show the last.
+	for _, page := range []uint{2, 9} {
+		if last := player.list(page); strings.Count(last, "<br/>") != 3 ||
+			!strings.Contains(last, "page 2 of 2") || !strings.Contains(last, "13. m") {
+			t.Errorf("page %d is %q", page, last)
+		}
+	}
+	if player.list(0) != first {
+		t.Error("page 0 isn't the first")
+	}
+}
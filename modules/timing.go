@@ -0,0 +1,294 @@
+/* Commands for doing things later: reminders, and commands run at a given time
+   or on an interval. Jobs are kept by a scheduler.Scheduler, saved to the file
+   given to SetJobsFile. */
+package modules
+
+import "github.com/zorodc/maobot/commands"
+import "github.com/zorodc/maobot/eventstream"
+import "github.com/zorodc/maobot/scheduler"
+import logs "github.com/zorodc/maobot/loggers"
+import "github.com/zorodc/maobot/outbox"
+import "layeh.com/gumble/gumble"
+
+import "bytes"
+import "fmt"
+import "html"
+import "strings"
+import "sync"
+import "time"
+
+// The shortest interval !every accepts, so that the bot can't be made to spam.
+const kMinInterval = time.Minute
+
+// The most reminders and commands any one user may have scheduled at once.
+const kMaxJobsPerUser = 10
+
+// The layouts !at accepts, besides RFC 3339; all in local time.
+var gTimeLayouts = []string{"15:04", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+var gScheduler = scheduler.New(scheduler.RealClock, runJob)
+
+// The client jobs act through, and the jobs due while there was none.
+var gTiming struct {
+	sync.Mutex
+	client *gumble.Client
+	late   []scheduler.Job
+}
+
+func init() {
+	gScheduler.SetOwnerLimit(kMaxJobsPerUser)
+
+	commands.Table["remindme"] = commands.Command{
+		Function:func(ctx *commands.Context, after time.Duration, message ...string) {
+			schedule(ctx, time.Now().Add(after), 0, commands.JoinArguments(message))
+		},
+		Arity:2,
+		OptionalArgs:nil,
+		Description:"Send you a reminder after some time, e.g. 10m or 1h30m.",
+		Usage:"duration message",}
+	commands.Table["at"] = commands.Command{
+		Function:func(ctx *commands.Context, at string, what ...string) {
+			when, err := parseTime(at, time.Now())
+			if err != nil {
+				ctx.Replyf("Can't tell when `%s` is: use HH:MM, YYYY-MM-DDTHH:MM or RFC 3339.",
+					html.EscapeString(at))
+				return
+			}
+			schedule(ctx, when, 0, commands.JoinArguments(what))
+		},
+		Arity:2,
+		OptionalArgs:nil,
+		Description:"Run a command, or send you a reminder, at a time.",
+		Usage:"time (command|message)",}
+	commands.Table["every"] = commands.Command{
+		Function:func(ctx *commands.Context, every time.Duration, what ...string) {
+			if every < kMinInterval {
+				ctx.Replyf("The interval must be at least %s.", kMinInterval)
+				return
+			}
+			schedule(ctx, time.Now().Add(every), every, commands.JoinArguments(what))
+		},
+		Arity:2,
+		OptionalArgs:nil,
+		Description:"Run a command, or send you a reminder, on an interval.",
+		Usage:"interval (command|message)",
+		Permission:commands.RegisteredUser,}
+	commands.Table["jobs"] = commands.Command{
+		Function:listJobs,
+		Arity:0,
+		OptionalArgs:nil,
+		Description:"List your scheduled reminders and commands, or everyone's for admins.",
+		Usage:"",}
+	commands.Table["cancel"] = commands.Command{
+		Function:cancelJob,
+		Arity:1,
+		OptionalArgs:nil,
+		Description:"Cancel a scheduled reminder or command by its ID.",
+		Usage:"id",}
+
+	eventstream.Subscribe(func(e *gumble.ConnectEvent) {
+		gTiming.Lock()
+		gTiming.client = e.Client
+		late := gTiming.late
+		gTiming.late = nil
+		gTiming.Unlock()
+
+		for _, job := range late {
+			go runJob(job)
+		}
+	})
+}
+
+// Keep scheduled jobs in the file at `path`, and schedule those already there.
+func SetJobsFile(path string) error {
+	return gScheduler.Load(path)
+}
+
+// Parse a time given to !at. A time of day alone means its next occurrence.
+func parseTime(text string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+	for i, layout := range gTimeLayouts {
+		t, err := time.ParseInLocation(layout, text, now.Location())
+		if err != nil { continue; }
+		if i == 0 {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(),
+				0, 0, now.Location())
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time `%s`", text)
+}
+
+// Schedule `what`, a command if it starts with the prefix, else a reminder.
+func schedule(ctx *commands.Context, when time.Time, every time.Duration,
+	what string) {
+	if ctx.Sender == nil {
+		ctx.Reply("Only users may schedule things.")
+		return
+	}
+	if what == "" {
+		ctx.Reply("Nothing to schedule.")
+		return
+	}
+	if !when.After(time.Now()) {
+		ctx.Reply("That time has already passed.")
+		return
+	}
+
+	job := scheduler.Job{Owner:ctx.Sender.Name, Private:ctx.Private,
+		When:when, Every:every}
+	if ctx.Channel != nil {
+		job.Channel = channelPath(ctx.Channel)
+	}
+	if strings.HasPrefix(what, commands.Prefix()) {
+		name := strings.Fields(what)[0][len(commands.Prefix()):]
+		if _, ok := commands.Table[name]; !ok {
+			ctx.Replyf("No such command `%s`.", html.EscapeString(name))
+			return
+		}
+		// It's authorized again when it runs, but may as well be refused now.
+		if commands.Authorize(name, ctx) != nil { return; }
+		job.Command = what
+	} else {
+		job.Message = what
+	}
+
+	job, err := gScheduler.Add(job)
+	if err == scheduler.ErrTooManyJobs {
+		ctx.Replyf("You already have %d things scheduled; cancel one first.",
+			kMaxJobsPerUser)
+		return
+	} else if err != nil {
+		logs.Logf(logs.ErrorLogs, "Couldn't save jobs: %s.", err.Error())
+	}
+	ctx.Replyf("Scheduled #%d %s.", job.ID, describeJob(job))
+}
+
+// When and how often a job runs, and what it does, in HTML.
+func describeJob(job scheduler.Job) string {
+	what := "reminder: " + html.EscapeString(job.Message)
+	if job.Command != "" {
+		what = "<code>" + html.EscapeString(job.Command) + "</code>"
+	}
+	when := "at " + job.When.Format("2006-01-02 15:04")
+	if job.Repeats() {
+		when += ", then every " + job.Every.String()
+	}
+	return when + ", " + what
+}
+
+// Whether the sender of `ctx` is a channel admin.
+func isAdmin(ctx *commands.Context) bool {
+	if ctx.Sender == nil { return false; }
+	ok, _ := commands.Permitted(commands.CallerOf(ctx.Sender), commands.ChannelAdmin)
+	return ok
+}
+
+// List the caller's jobs, or every job for admins. Private jobs are listed
+// without saying what they do, unless their owner asks privately.
+func listJobs(ctx *commands.Context) {
+	admin := isAdmin(ctx)
+	owns := func(job scheduler.Job) bool {
+		return ctx.Sender != nil && job.Owner == ctx.Sender.Name
+	}
+	var jobs []scheduler.Job
+	for _, job := range gScheduler.Jobs() {
+		if admin || owns(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == 0 {
+		if admin {
+			ctx.Reply("Nothing is scheduled.")
+		} else {
+			ctx.Reply("You have nothing scheduled.")
+		}
+		return
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("<b>Scheduled:</b>")
+	for _, job := range jobs {
+		description := describeJob(job)
+		if job.Private && !(ctx.Private && owns(job)) {
+			description = "<i>(private)</i>"
+		}
+		fmt.Fprintf(&buffer, "<br/>#%d, for %s: %s", job.ID,
+			html.EscapeString(job.Owner), description)
+	}
+	ctx.Reply(buffer.String())
+}
+
+// Cancel a job. Only its owner, or a channel admin, may.
+func cancelJob(ctx *commands.Context, id uint64) {
+	job, ok := gScheduler.Get(id)
+	if !ok {
+		ctx.Replyf("There is no job #%d.", id)
+		return
+	}
+	if ctx.Sender == nil || ctx.Sender.Name != job.Owner {
+		if !isAdmin(ctx) {
+			ctx.Replyf("Only %s or a channel admin may cancel #%d.",
+				html.EscapeString(job.Owner), id)
+			return
+		}
+	}
+
+	if _, err := gScheduler.Cancel(id); err == scheduler.ErrNoSuchJob {
+		ctx.Replyf("There is no job #%d.", id)
+		return
+	} else if err != nil {
+		logs.Logf(logs.ErrorLogs, "Couldn't save jobs: %s.", err.Error())
+	}
+	ctx.Replyf("Cancelled #%d.", id)
+}
+
+// Run a job that has come due, holding it until connected if need be.
+func runJob(job scheduler.Job) {
+	gTiming.Lock()
+	client := gTiming.client
+	if client == nil {
+		gTiming.late = append(gTiming.late, job)
+	}
+	gTiming.Unlock()
+	if client == nil { return; }
+
+	// Act as though the owner sent the command from where they scheduled it.
+	client.Do(func() {
+		ctx := &commands.Context{Client:client, Sender:client.Users.Find(job.Owner),
+			Private:job.Private, Message:job.Command}
+		// With nobody to reply to privately, replies would go to the channel.
+		if job.Private && ctx.Sender == nil {
+			logs.Logf(logs.DebugLogs, "Skipping job #%d, as %s isn't connected.",
+				job.ID, job.Owner)
+			return
+		}
+		if job.Channel != "" {
+			ctx.Channel = findChannel(client, job.Channel)
+		}
+		if ctx.Channel == nil && client.Self != nil {
+			ctx.Channel = client.Self.Channel
+		}
+
+		if job.Command != "" {
+			logs.Logf(logs.DebugLogs, "Running job #%d: `%s`.", job.ID, job.Command)
+			commands.Dispatch(job.Command, ctx)
+			return
+		}
+
+		// Reminders go privately to their owner, if they're around.
+		reminder := "Reminder: " + html.EscapeString(job.Message)
+		if ctx.Sender != nil {
+			outbox.Send(outbox.ToUser(ctx.Sender), reminder, commands.MaxMsgLen(),
+				outbox.High)
+		} else {
+			ctx.Reply(fmt.Sprintf("Reminder for %s: %s",
+				html.EscapeString(job.Owner), html.EscapeString(job.Message)))
+		}
+	})
+}
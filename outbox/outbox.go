@@ -0,0 +1,118 @@
+/* Sends the bot's chat messages. A message too long for the server is split
+   into pages: the first is sent, and the rest kept for its recipient to ask
+   for with More. Everything sent goes through one queue, see queue.go. */
+package outbox
+
+import "layeh.com/gumble/gumble"
+
+import "fmt"
+import "sync"
+
+// Where messages go: a channel, or a user privately.
+type Recipient struct {
+	channel *gumble.Channel
+	user    *gumble.User
+}
+
+func ToChannel(channel *gumble.Channel) Recipient {
+	return Recipient{channel:channel}
+}
+
+func ToUser(user *gumble.User) Recipient {
+	return Recipient{user:user}
+}
+
+// Identifies the recipient across reconnections, which replace the
+// channel and user objects.
+type recipientKey struct {
+	channel uint32
+	user    string
+	private bool
+}
+
+func (this Recipient) key() recipientKey {
+	if this.user != nil {
+		return recipientKey{user:this.user.Name, private:true}
+	}
+	return recipientKey{channel:this.channel.ID}
+}
+
+func (this Recipient) send(message string) {
+	if this.user != nil {
+		this.user.Send(message)
+	} else {
+		this.channel.Send(message, false)
+	}
+}
+
+// Appended to the first page of a split message, given how many remain.
+// The commands package has it name the command fetching the rest.
+var MoreHint = func(left int) string {
+	return fmt.Sprintf("<br/><i>(%d more)</i>", left)
+}
+
+// The pages of split messages not yet asked for, by recipient.
+var gPending struct {
+	sync.Mutex
+	pages map[recipientKey][]string
+}
+
+func init() {
+	gPending.pages = map[recipientKey][]string{}
+}
+
+// Send a message, split into pages of at most `max` bytes if it's longer.
+// Only the first page of a reply is sent; the rest replace any kept for the
+// recipient before. A log echo is sent whole, page after page, so that echoes
+// never take the place of a reply's pages. A max of 0 means no limit.
+func Send(to Recipient, message string, max uint, priority Priority) {
+	pages := Split(message, int(max))
+	if len(pages) > 1 && priority == High {
+		// Split again, leaving room for the hint. Its count is overestimated,
+		// since the smaller pages may be more.
+		room := int(max) - len(MoreHint(len(pages)*10))
+		if room > 0 {
+			pages = Split(message, room)
+		}
+	}
+	if len(pages) == 0 { return; }
+	if priority != High {
+		for _, page := range pages {
+			enqueue(to, page, max, priority)
+		}
+		return
+	}
+
+	if len(pages) > 1 {
+		gPending.Lock()
+		gPending.pages[to.key()] = pages[1:]
+		gPending.Unlock()
+	}
+	enqueue(to, withHint(pages[0], len(pages)-1), max, priority)
+}
+
+// Send the recipient the next page kept for them, as a reply.
+// Returns false if there are none.
+func More(to Recipient, max uint) bool {
+	gPending.Lock()
+	pages := gPending.pages[to.key()]
+	if len(pages) == 0 {
+		gPending.Unlock()
+		return false
+	}
+	page, rest := pages[0], pages[1:]
+	if len(rest) > 0 {
+		gPending.pages[to.key()] = rest
+	} else {
+		delete(gPending.pages, to.key())
+	}
+	gPending.Unlock()
+
+	enqueue(to, withHint(page, len(rest)), max, High)
+	return true
+}
+
+func withHint(page string, left int) string {
+	if left == 0 { return page; }
+	return page + MoreHint(left)
+}
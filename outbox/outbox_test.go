@@ -0,0 +1,157 @@
+package outbox
+
+import "layeh.com/gumble/gumble"
+
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+// Hold every message in the queue, where the tests can see it, rather than
+// sending it: the bucket starts empty, and refills once an hour.
+func TestMain(m *testing.M) {
+	SetLimits(0, time.Hour, kDefaultMaxQueued)
+	os.Exit(m.Run())
+}
+
+func reset(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		gPending.Lock()
+		gPending.pages = map[recipientKey][]string{}
+		gPending.Unlock()
+		gQueue.Lock()
+		gQueue.queued = [High + 1][]*outgoing{}
+		gQueue.dropping = false
+		gQueue.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// The messages queued for `to`, oldest first, whatever their priority.
+func queuedFor(to Recipient) (messages []string) {
+	gQueue.Lock()
+	defer gQueue.Unlock()
+	for priority := Low; priority <= High; priority++ {
+		for _, out := range gQueue.queued[priority] {
+			if out.to.key() == to.key() {
+				messages = append(messages, out.text())
+			}
+		}
+	}
+	return
+}
+
+// A message of `n` numbered words, long enough to need several pages.
+func words(prefix string, n int) string {
+	var list []string
+	for i := 0; i < n; i++ {
+		list = append(list, prefix + strings.Repeat("x", 5) + string(rune('a' + i%26)))
+	}
+	return strings.Join(list, " ")
+}
+
+func TestSendAndMore(t *testing.T) {
+	reset(t)
+	to := ToChannel(&gumble.Channel{ID:1})
+	message := words("r", 60)
+	Send(to, message, 100, High)
+
+	for More(to, 100) {}
+	sent := queuedFor(to)
+	if len(sent) < 3 {
+		t.Fatalf("sent %d pages, want several", len(sent))
+	}
+	var got []string
+	for i, page := range sent {
+		if len(page) > 100 {
+			t.Errorf("page %d is %d bytes long", i+1, len(page))
+		}
+		hint := MoreHint(len(sent) - i - 1)
+		if i == len(sent) - 1 {
+			hint = ""
+		} else if !strings.HasSuffix(page, hint) {
+			t.Errorf("page %d lacks the hint %q: %q", i+1, hint, page)
+		}
+		got = append(got, strings.TrimSuffix(page, hint))
+	}
+	if strings.Join(got, " ") != message {
+		t.Errorf("the pages don't make up the message: %q", got)
+	}
+	if More(to, 100) {
+		t.Error("More sent something after the last page")
+	}
+}
+
+// Neither a short reply nor a log echo, however long, takes the place of the
+// pages kept for a long reply.
+func TestKeptPages(t *testing.T) {
+	reset(t)
+	to := ToChannel(&gumble.Channel{ID:1})
+	Send(to, words("reply", 40), 100, High)
+	Send(to, "ok", 100, High)
+	Send(to, words("echo", 40), 100, Low)
+
+	sent := queuedFor(to)
+	// Low priority is queued apart from the rest, and ahead of it here.
+	var echo []string
+	for len(sent) > 0 && strings.HasPrefix(sent[0], "echo") {
+		echo, sent = append(echo, sent[0]), sent[1:]
+	}
+	if len(echo) < 2 || len(sent) != 2 {
+		t.Fatalf("sent %q and %q, want an echo of several pages and two replies",
+			echo, sent)
+	}
+	for _, page := range echo {
+		if len(page) > 100 || strings.Contains(page, "more)") {
+			t.Errorf("the echo was sent with a page %q, want pages without hints", page)
+		}
+	}
+	if got := strings.Join(echo, " "); got != words("echo", 40) {
+		t.Errorf("the echo was sent as %q, want all of it", got)
+	}
+
+	if !More(to, 100) {
+		t.Fatal("no pages kept after a short reply and an echo")
+	}
+	sent = queuedFor(to)
+	if next := sent[len(sent)-1]; !strings.HasPrefix(next, "reply") {
+		t.Errorf("More sent %q, want the next page of the reply", next)
+	}
+
+	// A long reply replaces them.
+	Send(to, words("second", 40), 100, High)
+	More(to, 100)
+	sent = queuedFor(to)
+	if next := sent[len(sent)-1]; !strings.HasPrefix(next, "second") {
+		t.Errorf("More sent %q, want the next page of the newer reply", next)
+	}
+}
+
+// Pages are kept apart for each channel, and each user privately.
+func TestPagesByRecipient(t *testing.T) {
+	reset(t)
+	channel := ToChannel(&gumble.Channel{ID:1})
+	other := ToChannel(&gumble.Channel{ID:2})
+	user := ToUser(&gumble.User{Name:"a"})
+	Send(channel, words("channel", 40), 100, High)
+	Send(user, words("user", 40), 100, High)
+
+	if More(other, 100) {
+		t.Error("another channel got pages")
+	}
+	for _, to := range []Recipient{channel, user} {
+		Send(to, "short", 100, High)
+	}
+	if !More(user, 100) || !More(channel, 100) {
+		t.Fatal("pages went missing")
+	}
+	if sent := queuedFor(user); !strings.HasPrefix(sent[len(sent)-1], "user") {
+		t.Errorf("the user was sent %q", sent[len(sent)-1])
+	}
+	// A user reconnecting is the same recipient.
+	if !More(ToUser(&gumble.User{Name:"a", Session:9}), 100) {
+		t.Error("the user's pages were lost on reconnecting")
+	}
+}
@@ -0,0 +1,237 @@
+/* The queue every outgoing message waits in, sent from by a single goroutine
+   at a rate limited by a token bucket, so that bursts don't set off the
+   server's flood protection. Replies go ahead of log echoes, and a message
+   identical to the one queued before it is merged into that one. */
+package outbox
+
+import "fmt"
+import "html"
+import "os"
+import "sync"
+import "time"
+import "unicode/utf8"
+
+type Priority int
+
+const (
+	Low  Priority = iota // Echoes of the logs.
+	High                 // Replies, and whatever else is sent for a user.
+)
+
+// Murmur's default flood limits: bursts of 5 messages, then 1 a second.
+const (
+	kDefaultBurst    = 5
+	kDefaultInterval = time.Second
+)
+
+// The most messages waiting to be sent, unless told otherwise.
+const kDefaultMaxQueued = 256
+
+type outgoing struct {
+	to      Recipient
+	message string
+	max     uint // The longest the message may grow when merged.
+	repeats uint // How many identical messages were merged into it.
+}
+
+// The message as sent, noting how many times it was repeated.
+func (this *outgoing) text() string {
+	if this.repeats <= 1 { return this.message; }
+	return this.message + mergedSuffix(this.repeats)
+}
+
+func mergedSuffix(repeats uint) string {
+	return fmt.Sprintf(" <i>(×%d)</i>", repeats)
+}
+
+// Counts of what has happened to messages since the program started.
+type Metrics struct {
+	Pending uint   // Waiting to be sent, now.
+	Sent    uint64
+	Merged  uint64 // Merged into an identical message before them.
+	Dropped uint64 // Discarded for want of room in the queue.
+}
+
+var gQueue struct {
+	sync.Mutex
+	ready     *sync.Cond // Signalled whenever a message is queued.
+	queued    [High + 1][]*outgoing // By priority, oldest first.
+	burst     uint
+	interval  time.Duration
+	maxQueued uint
+	metrics   Metrics
+	dropping  bool // Whether messages have been dropped since one was sent.
+}
+
+// Reports problems sending messages. The loggers package has them logged as
+// errors; they can't be from here, as the error logs are echoed through here.
+var LogError = func(message string) {
+	fmt.Fprintln(os.Stderr, "ERROR: " + message)
+}
+
+// How much of a message to show when reporting it.
+const kReportedLength = 40
+
+// A message's length and its start, escaped, to report it by.
+func describe(message string) string {
+	start := message
+	if len(start) > kReportedLength {
+		cut := kReportedLength
+		for cut > 0 && !utf8.RuneStart(start[cut]) {
+			cut--
+		}
+		start = start[:cut] + "…"
+	}
+	return fmt.Sprintf("{`%s`} (%d bytes)", html.EscapeString(start), len(message))
+}
+
+// Tells the time, and waits. Replaced by the tests.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time         { return time.Now(); }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d); }
+
+func init() {
+	gQueue.ready = sync.NewCond(&gQueue.Mutex)
+	gQueue.burst, gQueue.interval = kDefaultBurst, kDefaultInterval
+	gQueue.maxQueued = kDefaultMaxQueued
+	go sendQueued()
+}
+
+// Send at most `burst` messages at once, then one each `interval`, keeping at
+// most `maxQueued` waiting. An interval of 0 doesn't limit the rate.
+func SetLimits(burst uint, interval time.Duration, maxQueued uint) {
+	gQueue.Lock()
+	defer gQueue.Unlock()
+	gQueue.burst, gQueue.interval, gQueue.maxQueued = burst, interval, maxQueued
+}
+
+func Stats() Metrics {
+	gQueue.Lock()
+	defer gQueue.Unlock()
+	metrics := gQueue.metrics
+	metrics.Pending = pending()
+	return metrics
+}
+
+func pending() uint {
+	return uint(len(gQueue.queued[Low]) + len(gQueue.queued[High]))
+}
+
+// Queue a message. Once the queue is full, the oldest log echo makes way for
+// a message of higher priority; otherwise, the new message is dropped.
+// Errors are reported once the queue is unlocked, as reporting them queues
+// more messages.
+func enqueue(to Recipient, message string, max uint, priority Priority) {
+	if max > 0 && uint(len(message)) > max {
+		LogError(fmt.Sprintf("Message %s exceeds the maximum length %d; sending it anyway.",
+			describe(message), max))
+	}
+	if push(to, message, max, priority) {
+		LogError(fmt.Sprintf("Too many messages queued; dropping %s, and any more until there's room.",
+			describe(message)))
+	}
+}
+
+// Queue a message, returning whether it's the first dropped since a message
+// was last sent. Those dropped after it aren't reported, so that the report
+// of a drop, itself dropped, isn't reported in turn.
+func push(to Recipient, message string, max uint, priority Priority) (report bool) {
+	gQueue.Lock()
+	defer gQueue.Unlock()
+
+	queue := gQueue.queued[priority]
+	if n := len(queue); n > 0 && queue[n-1].merges(to, message) {
+		queue[n-1].repeats++
+		gQueue.metrics.Merged++
+		return false
+	}
+
+	if pending() >= gQueue.maxQueued {
+		if priority == Low || len(gQueue.queued[Low]) == 0 {
+			gQueue.metrics.Dropped++
+			report = !gQueue.dropping
+			gQueue.dropping = true
+			return
+		}
+		gQueue.queued[Low] = gQueue.queued[Low][1:]
+		gQueue.metrics.Dropped++
+	}
+	gQueue.queued[priority] = append(queue,
+		&outgoing{to:to, message:message, max:max, repeats:1})
+	gQueue.ready.Signal()
+	return false
+}
+
+// Whether `message` to `to` may be merged into this one, without growing
+// past the length allowed.
+func (this *outgoing) merges(to Recipient, message string) bool {
+	if this.to.key() != to.key() || this.message != message { return false; }
+	grown := len(this.message) + len(mergedSuffix(this.repeats+1))
+	return this.max == 0 || uint(grown) <= this.max
+}
+
+// Wait for a message to be queued, then take the first of the highest
+// priority. Messages stay queued while waiting on the bucket, so that any
+// of a higher priority queued meanwhile go first, and repeats still merge.
+func nextQueued(bucket *bucket, clock clock) *outgoing {
+	gQueue.Lock()
+	for pending() == 0 {
+		gQueue.ready.Wait()
+	}
+	wait := bucket.take(clock.Now(), gQueue.burst, gQueue.interval)
+	gQueue.Unlock()
+	clock.Sleep(wait)
+
+	gQueue.Lock()
+	defer gQueue.Unlock()
+	for priority := High; priority >= Low; priority-- {
+		if queue := gQueue.queued[priority]; len(queue) > 0 {
+			gQueue.queued[priority] = queue[1:]
+			gQueue.metrics.Sent++
+			gQueue.dropping = false
+			return queue[0]
+		}
+	}
+	return nil // Unreachable: a message is only dropped to make room for another.
+}
+
+// Send queued messages for as long as the program runs.
+func sendQueued() {
+	var bucket bucket
+	for {
+		if next := nextQueued(&bucket, realClock{}); next != nil {
+			next.to.send(next.text())
+		}
+	}
+}
+
+// A token bucket, holding up to a burst of tokens and gaining one each
+// interval. Each message sent takes a token.
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens were last counted.
+}
+
+// Take a token at `now`, returning how long to wait before it's there.
+// Tokens may be owed, which later takings wait on too.
+func (this *bucket) take(now time.Time, burst uint, interval time.Duration) time.Duration {
+	if interval <= 0 { return 0; }
+
+	if this.last.IsZero() {
+		this.tokens = float64(burst)
+	} else {
+		this.tokens += float64(now.Sub(this.last)) / float64(interval)
+		if this.tokens > float64(burst) { this.tokens = float64(burst); }
+	}
+	this.last = now
+
+	this.tokens--
+	if this.tokens >= 0 { return 0; }
+	return time.Duration(-this.tokens * float64(interval))
+}
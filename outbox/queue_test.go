@@ -0,0 +1,191 @@
+package outbox
+
+import "layeh.com/gumble/gumble"
+
+import "strings"
+import "testing"
+import "time"
+
+// A clock which only moves when slept on.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (this *fakeClock) Now() time.Time { return this.now; }
+
+func (this *fakeClock) Sleep(d time.Duration) {
+	this.slept = append(this.slept, d)
+	this.now = this.now.Add(d)
+}
+
+// Report errors to a list, for the rest of the test.
+func reportErrors(t *testing.T) *[]string {
+	var reported []string
+	old := LogError
+	LogError = func(message string) { reported = append(reported, message); }
+	t.Cleanup(func() { LogError = old; })
+	return &reported
+}
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var bucket bucket
+	take := func(at time.Duration) time.Duration {
+		return bucket.take(start.Add(at), 3, time.Second)
+	}
+
+	tests := []struct {
+		at   time.Duration // When a token is taken.
+		wait time.Duration // How long until it's there.
+	}{
+		// A burst, then a token a second, with the wait growing while owed.
+		{0, 0}, {0, 0}, {0, 0},
+		{0, time.Second},
+		{0, 2 * time.Second},
+		{500 * time.Millisecond, 2500 * time.Millisecond},
+		// Refilled, but to no more than a burst.
+		{time.Minute, 0}, {time.Minute, 0}, {time.Minute, 0},
+		{time.Minute, time.Second},
+	}
+	for i, test := range tests {
+		if wait := take(test.at); wait != test.wait {
+			t.Errorf("take %d, at %s: wait %s, want %s", i, test.at, wait, test.wait)
+		}
+	}
+
+	// Without an interval, there's no limit.
+	for i := 0; i < 10; i++ {
+		if wait := bucket.take(start, 0, 0); wait != 0 {
+			t.Fatalf("waiting %s, without a limit", wait)
+		}
+	}
+}
+
+// The texts of the next n messages sent, waiting on `clock`.
+func sendNext(n int, clock *fakeClock) (sent []string) {
+	var bucket bucket
+	for i := 0; i < n; i++ {
+		sent = append(sent, nextQueued(&bucket, clock).text())
+	}
+	return
+}
+
+func TestHighBeforeLow(t *testing.T) {
+	reset(t)
+	to := ToChannel(&gumble.Channel{ID:1})
+	enqueue(to, "echo 1", 0, Low)
+	enqueue(to, "reply 1", 0, High)
+	enqueue(to, "echo 2", 0, Low)
+	enqueue(to, "reply 2", 0, High)
+
+	clock := &fakeClock{now:time.Unix(1000, 0)}
+	sent := sendNext(2, clock)
+	// A reply queued while waiting still goes ahead of the echoes.
+	enqueue(to, "reply 3", 0, High)
+	sent = append(sent, sendNext(3, clock)...)
+
+	want := []string{"reply 1", "reply 2", "reply 3", "echo 1", "echo 2"}
+	if strings.Join(sent, ",") != strings.Join(want, ",") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	// The tests' limits hold back each message an hour.
+	for i, wait := range clock.slept {
+		if wait != time.Hour {
+			t.Errorf("waited %s before message %d, want an hour", wait, i)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	reset(t)
+	to, other := ToChannel(&gumble.Channel{ID:1}), ToUser(&gumble.User{Name:"alice"})
+	before := Stats().Merged
+	for _, message := range []string{"a", "a", "a", "b", "a"} {
+		enqueue(to, message, 0, Low)
+	}
+	enqueue(other, "a", 0, Low)
+	enqueue(other, "a", 0, High) // Of another priority, so queued apart.
+
+	want := []string{"a" + mergedSuffix(3), "b", "a"}
+	if got := queuedFor(to); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("queued %q, want %q", got, want)
+	}
+	if got := queuedFor(other); len(got) != 2 || got[0] != "a" || got[1] != "a" {
+		t.Errorf("queued %q for another, want two apart", got)
+	}
+	if merged := Stats().Merged - before; merged != 2 {
+		t.Errorf("counted %d merged, want 2", merged)
+	}
+
+	// Not past the length allowed, as the count grows a digit.
+	reset(t)
+	long := strings.Repeat("x", 20)
+	max := uint(len(long) + len(mergedSuffix(9)))
+	for i := 0; i < 10; i++ {
+		enqueue(to, long, max, Low)
+	}
+	want = []string{long + mergedSuffix(9), long}
+	if got := queuedFor(to); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("queued %q, want %q", got, want)
+	}
+}
+
+func TestFullQueue(t *testing.T) {
+	reset(t)
+	reported := reportErrors(t)
+	SetLimits(0, time.Hour, 3)
+	t.Cleanup(func() { SetLimits(0, time.Hour, kDefaultMaxQueued); })
+
+	to := ToChannel(&gumble.Channel{ID:1})
+	before := Stats().Dropped
+	for _, message := range []string{"echo 1", "echo 2"} {
+		enqueue(to, message, 0, Low)
+	}
+	enqueue(to, "reply 1", 0, High)
+	// Replies make room by dropping the oldest echoes, while echoes are
+	// dropped themselves, as are replies once there are no echoes.
+	enqueue(to, "reply 2", 0, High)
+	enqueue(to, "echo 3", 0, Low)
+	enqueue(to, "reply 3", 0, High)
+	enqueue(to, "reply 4", 0, High)
+
+	want := []string{"reply 1", "reply 2", "reply 3"}
+	if got := queuedFor(to); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("queued %q, want %q", got, want)
+	}
+	if dropped := Stats().Dropped - before; dropped != 4 {
+		t.Errorf("counted %d dropped, want 4", dropped)
+	}
+	// Only the first drop is reported until a message is sent.
+	if len(*reported) != 1 || !strings.Contains((*reported)[0], "{`echo 3`}") {
+		t.Errorf("reported %q, want the drop of echo 3", *reported)
+	}
+
+	sendNext(1, &fakeClock{})
+	enqueue(to, "reply 5", 0, High)
+	enqueue(to, "reply 6", 0, High)
+	if len(*reported) != 2 || !strings.Contains((*reported)[1], "{`reply 6`}") {
+		t.Errorf("reported %q, want the drop of reply 6 too", *reported)
+	}
+}
+
+func TestReportLong(t *testing.T) {
+	reset(t)
+	reported := reportErrors(t)
+	to := ToChannel(&gumble.Channel{ID:1})
+
+	enqueue(to, "<b>" + strings.Repeat("é", 100) + "</b>", 50, High)
+	if len(*reported) != 1 {
+		t.Fatalf("reported %q, want one error", *reported)
+	}
+	want := "{`&lt;b&gt;" + strings.Repeat("é", 18) + "…`} (207 bytes)"
+	if report := (*reported)[0]; !strings.Contains(report, want) ||
+		!strings.Contains(report, "maximum length 50") {
+		t.Errorf("reported %q, want it to name the message as %q", report, want)
+	}
+	// It's sent anyway.
+	if got := queuedFor(to); len(got) != 1 {
+		t.Errorf("queued %q, want the message", got)
+	}
+}
@@ -0,0 +1,203 @@
+/* Splits messages of HTML too long for the server into pages which fit. */
+package outbox
+
+import "strings"
+import "unicode"
+import "unicode/utf8"
+
+// Tags after which a new line begins.
+var lineTags = map[string]bool{
+	"br":true, "br/":true, "/p":true, "/div":true, "/li":true, "/tr":true,
+	"/h1":true, "/h2":true, "/h3":true, "/h4":true, "/pre":true,
+}
+
+// Split a message of HTML into pages of at most `max` bytes each. A page ends
+// after a line where it can, else between words, else between characters, but
+// never inside a tag or an entity. Tags left open at the end of a page are
+// closed there, and opened again at the start of the next. Something that
+// can't be split, such as a long tag, gets a page to itself however long it
+// is. No limit if max is 0.
+func Split(message string, max int) []string {
+	var pages []string
+	message = strings.TrimSpace(message)
+	for max > 0 && len(message) > max {
+		cut, open := breakPoint(message, max)
+		if page := strings.TrimSpace(message[:cut]); page != "" {
+			pages = append(pages, page + closers(open))
+		}
+		message = strings.TrimSpace(message[cut:])
+		// Tags too long to leave room on the page aren't opened again.
+		if tags := openers(open); message != "" && len(tags)+len(closers(open)) <= max/2 {
+			message = tags + message
+		}
+	}
+	if message != "" {
+		pages = append(pages, message)
+	}
+	return pages
+}
+
+// Where to end a page taken from the start of `message`, at most `max` bytes
+// in with the closing tags it needs, and the tags left open there. Ends of
+// lines and words are only used if they leave the page at least half full, so
+// as not to make many short pages. A page holds more than opening tags, so
+// that reopening them on the next page still leaves less to split.
+func breakPoint(message string, max int) (int, []openTag) {
+	type point struct {
+		end  int
+		open []openTag
+	}
+	var line, word, char point
+	var open []openTag
+	content := false
+	for i := 0; i < len(message); {
+		end := unitEnd(message, i)
+		if end > max { break; }
+
+		unit := message[i:end]
+		next := track(open, unit)
+		content = content || len(next) <= len(open)
+		open, i = next, end
+		if !content || end + len(closers(open)) > max { continue; }
+
+		switch {
+		case unit == "\n" || (unit[0] == '<' && lineTags[tagName(unit)]):
+			line = point{end, open}
+		case unit[0] != '<' && unit[0] != '&' && isSpace(unit):
+			word = point{end, open}
+		}
+		char = point{end, open}
+	}
+
+	switch {
+	case line.end > 0 && line.end >= max/2: return line.end, line.open
+	case word.end > 0 && word.end >= max/2: return word.end, word.open
+	case char.end > 0:      return char.end, char.open
+	}
+
+	// Too long to split: take any opening tags, and as much of what follows
+	// them as would fit on a page of its own.
+	open = nil
+	start := 0
+	for start < len(message) {
+		end := unitEnd(message, start)
+		next := track(open, message[start:end])
+		if len(next) <= len(open) { break; }
+		open, start = next, end
+	}
+	cut := start
+	switch {
+	case start == 0:
+		cut = unitEnd(message, 0)
+	case start < len(message):
+		rest, _ := breakPoint(message[start:], max)
+		cut += rest
+	}
+	return cut, openIn(message[:cut])
+}
+
+// The tags left open at the end of `message`.
+func openIn(message string) (open []openTag) {
+	for i := 0; i < len(message); {
+		end := unitEnd(message, i)
+		open, i = track(open, message[i:end]), end
+	}
+	return
+}
+
+// A tag not yet closed: its name, and the tag as written, to open it again.
+type openTag struct {
+	name string
+	tag  string
+}
+
+// Tags which have no closing tag.
+var voidTags = map[string]bool{
+	"area":true, "base":true, "br":true, "col":true, "embed":true, "hr":true,
+	"img":true, "input":true, "link":true, "meta":true, "source":true,
+	"track":true, "wbr":true,
+}
+
+// The tags open after `unit`, given those open before it. Returns a new slice
+// rather than changing `open`'s elements, so that earlier ones can be kept.
+func track(open []openTag, unit string) []openTag {
+	if unit[0] != '<' || !strings.HasSuffix(unit, ">") { return open; }
+	name := tagName(unit)
+	switch {
+	case name == "" || name[0] == '!' || name[0] == '?':
+		return open // Comments and declarations.
+	case name[0] == '/':
+		// Close the latest tag of the name, and any left open within it.
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i].name == name[1:] { return open[:i]; }
+		}
+		return open
+	case voidTags[strings.TrimSuffix(name, "/")] || strings.HasSuffix(unit, "/>"):
+		return open
+	}
+	return append(open[:len(open):len(open)], openTag{name, unit})
+}
+
+// The tags closing those open, innermost first.
+func closers(open []openTag) string {
+	var builder strings.Builder
+	for i := len(open) - 1; i >= 0; i-- {
+		builder.WriteString("</" + open[i].name + ">")
+	}
+	return builder.String()
+}
+
+// The tags opening those open again, outermost first.
+func openers(open []openTag) string {
+	var builder strings.Builder
+	for _, tag := range open {
+		builder.WriteString(tag.tag)
+	}
+	return builder.String()
+}
+
+// The end of the tag, entity or character starting at `i`.
+func unitEnd(message string, i int) int {
+	switch message[i] {
+	case '<':
+		if end := strings.IndexByte(message[i:], '>'); end >= 0 {
+			return i + end + 1
+		}
+	case '&':
+		if end := entityEnd(message[i+1:]); end >= 0 {
+			return i + 1 + end + 1
+		}
+	}
+	_, size := utf8.DecodeRuneInString(message[i:])
+	return i + size
+}
+
+// The index of the ';' ending an entity's name, e.g. "amp;" or "#38;", or -1.
+func entityEnd(s string) int {
+	for i := 0; i < len(s) && i < 32; i++ {
+		switch c := s[i]; {
+		case c == ';':
+			if i > 0 { return i; }
+			return -1
+		case c == '#' || c >= '0' && c <= '9' ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// The lowercase name of a tag, with any slash, e.g. "br/" or "/p".
+func tagName(tag string) string {
+	tag = strings.TrimSpace(strings.Trim(tag, "<>"))
+	if end := strings.IndexFunc(tag, unicode.IsSpace); end >= 0 {
+		tag = tag[:end]
+	}
+	return strings.ToLower(tag)
+}
+
+func isSpace(unit string) bool {
+	r, _ := utf8.DecodeRuneInString(unit)
+	return unicode.IsSpace(r)
+}
@@ -0,0 +1,106 @@
+package outbox
+
+import "regexp"
+import "strings"
+import "testing"
+
+var kTags = regexp.MustCompile(`<[^>]*>`)
+
+// The text of pages, without their tags or spaces, which may be split apart.
+func text(pages ...string) string {
+	var words []string
+	for _, page := range pages {
+		words = append(words, strings.Fields(kTags.ReplaceAllString(page, " "))...)
+	}
+	return strings.Join(words, "")
+}
+
+func TestSplit(t *testing.T) {
+	long := words("w", 30)
+	link := `<a href="https://example.com/x">`
+	tests := []struct {
+		name    string
+		message string
+		max     int
+		// What each page must start with, besides the first, if anything.
+		starts  string
+	}{
+		{"words", long, 50, ""},
+		{"bold", "<b>" + long + "</b>", 50, "<b>"},
+		{"nested", link + "<i>" + long + "</i></a> after", 100, link + "<i>"},
+		{"lines", strings.ReplaceAll(long, " ", "<br/>"), 50, ""},
+		{"void tags", "<p>" + strings.ReplaceAll(long, " ", ` <img src="x"> `) + "</p>", 60, "<p>"},
+		{"entities", strings.Repeat("&amp;", 40), 32, ""},
+	}
+	for _, test := range tests {
+		pages := Split(test.message, test.max)
+		if len(pages) < 2 {
+			t.Errorf("%s: split into %d pages, want several", test.name, len(pages))
+			continue
+		}
+		for i, page := range pages {
+			if len(page) > test.max {
+				t.Errorf("%s: page %d is %d bytes, over %d: %q", test.name, i,
+					len(page), test.max, page)
+			}
+			if open := openIn(page); len(open) > 0 {
+				t.Errorf("%s: page %d leaves %q open: %q", test.name, i,
+					openers(open), page)
+			}
+			if i > 0 && !strings.HasPrefix(page, test.starts) {
+				t.Errorf("%s: page %d doesn't start with %q: %q", test.name, i,
+					test.starts, page)
+			}
+			if strings.Count(page, "&") != strings.Count(page, ";") {
+				t.Errorf("%s: page %d splits an entity: %q", test.name, i, page)
+			}
+		}
+		if got, want := text(pages...), text(test.message); got != want {
+			t.Errorf("%s: the pages read %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestSplitShort(t *testing.T) {
+	for _, max := range []int{0, 100} {
+		if pages := Split("  <b>short</b> ", max); len(pages) != 1 || pages[0] != "<b>short</b>" {
+			t.Errorf("Split(max %d) = %q, want the message trimmed", max, pages)
+		}
+	}
+	if pages := Split("   ", 100); len(pages) != 0 {
+		t.Errorf("Split of spaces = %q, want nothing", pages)
+	}
+}
+
+// A tag longer than a page gets one of its own, with as much as fits after
+// it, and isn't opened again on later pages.
+func TestSplitLongTag(t *testing.T) {
+	tag := `<a href="https://example.com/` + strings.Repeat("x", 80) + `">`
+	message := tag + words("w", 20) + "</a>"
+	pages := Split(message, 50)
+
+	if !strings.HasPrefix(pages[0], tag) || !strings.HasSuffix(pages[0], "</a>") {
+		t.Errorf("first page %q, want the tag, then text, then its end", pages[0])
+	}
+	for i, page := range pages[1:] {
+		if strings.Contains(page, "<a ") || len(page) > 50 {
+			t.Errorf("page %d is %q, want the rest of the text alone", i+1, page)
+		}
+	}
+	if got, want := text(pages...), text(words("w", 20)); got != want {
+		t.Errorf("the pages read %q, want %q", got, want)
+	}
+}
+
+func TestSplitUnsplittable(t *testing.T) {
+	word := strings.Repeat("y", 30)
+	pages := Split("<b>"+word+" z</b>", 20)
+	if got := text(pages...); got != word+"z" {
+		t.Errorf("the pages read %q", got)
+	}
+	for i, page := range pages {
+		if len(page) > 20 || len(openIn(page)) > 0 {
+			t.Errorf("page %d is %q", i, page)
+		}
+	}
+}
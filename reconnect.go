@@ -0,0 +1,107 @@
+/* Reconnection to the server after an error, waiting longer after each failed
+   attempt, and restoring the bot's state once reconnected. */
+package main
+
+import "layeh.com/gumble/gumble"
+
+import logs "github.com/zorodc/maobot/loggers"
+import "github.com/zorodc/maobot/modules"
+
+import "math/rand"
+import "time"
+
+// Makes a single attempt at connecting to the server.
+// gumble.DialWithDialer in practice, but replaceable, e.g. to simulate failure.
+type DialFunc func() (*gumble.Client, error)
+
+// Waits between attempts; a variable so that tests needn't wait.
+var sleep = time.Sleep
+
+// How long to wait between attempts at reconnecting.
+// The delay doubles after every failure, up to Max, and is then jittered by up
+// to half, so that many bots dropped at once don't all return at once.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Tries   uint // The most attempts made, or unlimited if 0.
+}
+
+// The delay before the attempt following the `try`th, counting from 0.
+func (this Backoff) Delay(try uint) time.Duration {
+	delay := this.Initial
+	for i := uint(0); i < try && (this.Max <= 0 || delay < this.Max); i++ {
+		delay *= 2
+	}
+	if this.Max > 0 && delay > this.Max {
+		delay = this.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2) + 1))
+}
+
+// Attempt connection/reconnection until `dial` succeeds or the tries run out.
+func TryReconn(dial DialFunc, backoff Backoff) (client *gumble.Client, err error) {
+	for try := uint(0); backoff.Tries == 0 || try < backoff.Tries; try++ {
+		logs.Logf(logs.ErrorLogs, "Reconnecting... Try: %d", try+1)
+		client, err = dial()
+		if err == nil { return; }
+		if backoff.Tries > 0 && try+1 == backoff.Tries { break; }
+
+		delay := backoff.Delay(try)
+		logs.Logf(logs.DebugLogs, "Couldn't reconnect: %s. Retrying in %s.",
+			err.Error(), delay)
+		sleep(delay)
+	}; return
+}
+
+// The state of the bot's own user, which is lost with its connection.
+type selfState struct {
+	channel  []string // Names of the channels from the root to the bot's.
+	muted    bool
+	deafened bool
+	comment  string
+}
+
+func saveState(client *gumble.Client) (state selfState) {
+	self := client.Self
+	if self == nil { return; }
+
+	state.muted, state.deafened = self.SelfMuted, self.SelfDeafened
+	state.comment = self.Comment
+	// The root's name isn't part of the path.
+	for channel := self.Channel; channel != nil && channel.Parent != nil;
+		channel = channel.Parent {
+		state.channel = append([]string{channel.Name}, state.channel...)
+	}
+	return
+}
+
+// Restore the state of the bot's user, and have the player resume through the
+// new connection. Called from outside the new client's goroutine.
+func (this selfState) restore(client *gumble.Client) {
+	client.Do(func() {
+		self := client.Self
+		if len(this.channel) > 0 {
+			if channel := client.Channels.Find(this.channel...); channel != nil {
+				self.Move(channel)
+			} else {
+				logs.Logf(logs.ErrorLogs, "Channel %v is gone; staying in %s.",
+					this.channel, self.Channel.Name)
+			}
+		}
+		if self.SelfMuted != this.muted {
+			self.SetSelfMuted(this.muted)
+		}
+		if self.SelfDeafened != this.deafened {
+			self.SetSelfDeafened(this.deafened)
+		}
+		if self.Comment != this.comment {
+			self.SetComment(this.comment)
+		}
+	})
+	// The player waits on its own goroutine, so mustn't be rebound while the
+	// client is held.
+	modules.Rebind(client)
+}
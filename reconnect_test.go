@@ -0,0 +1,106 @@
+package main
+
+import "layeh.com/gumble/gumble"
+
+import "errors"
+import "testing"
+import "time"
+
+// Record the delays TryReconn waits for, instead of waiting.
+func fakeSleep(t *testing.T) *[]time.Duration {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d); }
+	t.Cleanup(func() { sleep = time.Sleep; })
+	return &slept
+}
+
+// A DialFunc failing `failures` times before succeeding.
+func flakyDial(failures int, calls *int) DialFunc {
+	return func() (*gumble.Client, error) {
+		*calls++
+		if *calls <= failures {
+			return nil, errors.New("connection refused")
+		}
+		return &gumble.Client{}, nil
+	}
+}
+
+func TestTryReconnRetries(t *testing.T) {
+	slept := fakeSleep(t)
+	var calls int
+	client, err := TryReconn(flakyDial(3, &calls),
+		Backoff{Initial:time.Second, Max:time.Minute, Tries:5})
+	if client == nil || err != nil {
+		t.Fatalf("got %v, %v, want a client", client, err)
+	}
+	if calls != 4 {
+		t.Errorf("dialled %d times, want 4", calls)
+	}
+	if len(*slept) != 3 {
+		t.Errorf("waited %d times, want 3", len(*slept))
+	}
+}
+
+func TestTryReconnGivesUp(t *testing.T) {
+	slept := fakeSleep(t)
+	var calls int
+	client, err := TryReconn(flakyDial(100, &calls),
+		Backoff{Initial:time.Second, Max:time.Minute, Tries:5})
+	if client != nil || err == nil {
+		t.Fatalf("got %v, %v, want an error", client, err)
+	}
+	if calls != 5 {
+		t.Errorf("dialled %d times, want 5", calls)
+	}
+	// There's no waiting after the last try.
+	if len(*slept) != 4 {
+		t.Errorf("waited %d times, want 4", len(*slept))
+	}
+}
+
+func TestTryReconnUnlimited(t *testing.T) {
+	fakeSleep(t)
+	var calls int
+	client, err := TryReconn(flakyDial(50, &calls),
+		Backoff{Initial:time.Millisecond, Max:time.Second, Tries:0})
+	if client == nil || err != nil || calls != 51 {
+		t.Fatalf("got %v, %v after %d calls, want a client after 51", client, err, calls)
+	}
+}
+
+// The delays double from Initial up to Max, each jittered down by up to half.
+func TestTryReconnBackoff(t *testing.T) {
+	slept := fakeSleep(t)
+	var calls int
+	TryReconn(flakyDial(100, &calls),
+		Backoff{Initial:100 * time.Millisecond, Max:time.Second, Tries:8})
+
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000, 1000}
+	if len(*slept) != len(want) {
+		t.Fatalf("waited %d times, want %d", len(*slept), len(want))
+	}
+	for i, delay := range *slept {
+		ceiling := want[i] * time.Millisecond
+		if delay < ceiling/2 || delay > ceiling {
+			t.Errorf("delay %d is %s, want %s to %s", i, delay, ceiling/2, ceiling)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	if d := (Backoff{}).Delay(3); d != 0 {
+		t.Errorf("no initial delay: got %s, want 0", d)
+	}
+	// Without a maximum, the delay keeps doubling.
+	backoff := Backoff{Initial:time.Second}
+	for i := 0; i < 100; i++ {
+		if d := backoff.Delay(4); d < 8*time.Second || d > 16*time.Second {
+			t.Fatalf("Delay(4) = %s, want 8s to 16s", d)
+		}
+	}
+	// Nor does a large try overflow past the maximum.
+	backoff.Max = time.Hour
+	if d := backoff.Delay(1000); d < 30*time.Minute || d > time.Hour {
+		t.Errorf("Delay(1000) = %s, want 30m to 1h", d)
+	}
+}
@@ -0,0 +1,257 @@
+/* Runs jobs at given times, once or repeatedly, and keeps them in a file so
+   that they survive restarts. What a job does is left to whoever creates the
+   scheduler; jobs themselves are plain data. */
+package scheduler
+
+import logs "github.com/zorodc/maobot/loggers"
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+import "time"
+
+// The source of the time, replaceable so that tests needn't wait.
+// AfterFunc must call `f` from another goroutine, as time.AfterFunc does.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// The system's clock.
+var RealClock Clock = realClock{}
+
+// Something to be done at a particular time.
+type Job struct {
+	ID      uint64        `json:"id"`
+	Owner   string        `json:"owner"`   // The name of whoever scheduled it.
+	Channel string        `json:"channel"` // The path of the channel it came from.
+	Private bool          `json:"private"` // Whether it was scheduled privately.
+	Command string        `json:"command,omitempty"` // A command to run,
+	Message string        `json:"message,omitempty"` // or else a reminder to send.
+	When    time.Time     `json:"when"`
+	Every   time.Duration `json:"every,omitempty"` // Repeats if nonzero.
+}
+
+func (this Job) Repeats() bool {
+	return this.Every > 0
+}
+
+type Scheduler struct {
+	mu     sync.Mutex
+	clock  Clock
+	run    func(Job)
+	path   string // Where jobs are saved, or "" to not save them.
+	jobs   map[uint64]*entry
+	nextID uint64
+	limit  uint // The most jobs any one owner may have, or unlimited if 0.
+}
+
+type entry struct {
+	job   Job
+	timer Timer
+}
+
+// The contents of the jobs file.
+type saved struct {
+	NextID uint64 `json:"next_id"`
+	Jobs   []Job  `json:"jobs"`
+}
+
+var ErrNoSuchJob = errors.New("no such job")
+var ErrTooManyJobs = errors.New("too many jobs scheduled")
+
+// Create a scheduler calling `run` with each job as it comes due.
+// `run` is called from a goroutine of its own.
+func New(clock Clock, run func(Job)) *Scheduler {
+	return &Scheduler{clock:clock, run:run, jobs:map[uint64]*entry{}, nextID:1}
+}
+
+// The default place to keep jobs: in the user's configuration directory.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "maobot", "jobs.json")
+}
+
+// Keep jobs in the file at `path` from now on, scheduling any already in it.
+// Jobs which came due while the bot was down run at once; repeating jobs then
+// carry on from their next occurrence.
+func (this *Scheduler) Load(path string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return this.save()
+	} else if err != nil {
+		return err
+	}
+
+	var file saved
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if file.NextID > this.nextID {
+		this.nextID = file.NextID
+	}
+	for _, job := range file.Jobs {
+		if _, ok := this.jobs[job.ID]; ok { continue; }
+		if job.ID >= this.nextID {
+			this.nextID = job.ID + 1
+		}
+		this.schedule(job)
+	}
+	return this.save()
+}
+
+// Write the jobs to the file, if any, replacing it whole.
+// The lock must be held.
+func (this *Scheduler) save() error {
+	if this.path == "" { return nil; }
+
+	file := saved{NextID:this.nextID, Jobs:this.list()}
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(this.path), 0700); err != nil {
+		return err
+	}
+	tmp := this.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, this.path)
+}
+
+// The number of jobs `owner` has. The lock must be held.
+func (this *Scheduler) owned(owner string) (n uint) {
+	for _, entry := range this.jobs {
+		if entry.job.Owner == owner { n++; }
+	}; return
+}
+
+// The jobs, soonest first. The lock must be held.
+func (this *Scheduler) list() []Job {
+	jobs := make([]Job, 0, len(this.jobs))
+	for _, entry := range this.jobs {
+		jobs = append(jobs, entry.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].When.Equal(jobs[j].When) {
+			return jobs[i].ID < jobs[j].ID
+		}
+		return jobs[i].When.Before(jobs[j].When)
+	})
+	return jobs
+}
+
+// Set a timer for the job. The lock must be held.
+func (this *Scheduler) schedule(job Job) {
+	entry := &entry{job:job}
+	this.jobs[job.ID] = entry
+	delay := job.When.Sub(this.clock.Now())
+	if delay < 0 { delay = 0; }
+	entry.timer = this.clock.AfterFunc(delay, func() { this.fire(job.ID, entry); })
+}
+
+func (this *Scheduler) fire(id uint64, fired *entry) {
+	this.mu.Lock()
+	// The job may have been cancelled as its timer went off.
+	if this.jobs[id] != fired {
+		this.mu.Unlock()
+		return
+	}
+	job := fired.job
+	delete(this.jobs, id)
+	if job.Repeats() {
+		next := job
+		now := this.clock.Now()
+		for !next.When.After(now) {
+			next.When = next.When.Add(next.Every)
+		}
+		this.schedule(next)
+	}
+	err := this.save()
+	this.mu.Unlock()
+
+	if err != nil {
+		logs.Logf(logs.ErrorLogs, "Couldn't save jobs: %s.", err.Error())
+	}
+	this.run(job)
+}
+
+// Limit how many jobs Add schedules for any one owner, or not if 0.
+// Jobs already scheduled, or loaded, are kept regardless.
+func (this *Scheduler) SetOwnerLimit(limit uint) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.limit = limit
+}
+
+// Schedule a job, returning it with its ID filled in.
+// Fails with ErrTooManyJobs if its owner already has as many as allowed.
+func (this *Scheduler) Add(job Job) (Job, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.limit > 0 && this.owned(job.Owner) >= this.limit {
+		return job, ErrTooManyJobs
+	}
+	job.ID = this.nextID
+	this.nextID++
+	this.schedule(job)
+	return job, this.save()
+}
+
+// Cancel a job by its ID, returning it.
+func (this *Scheduler) Cancel(id uint64) (Job, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entry, ok := this.jobs[id]
+	if !ok {
+		return Job{}, ErrNoSuchJob
+	}
+	entry.timer.Stop()
+	delete(this.jobs, id)
+	return entry.job, this.save()
+}
+
+// Get a job by its ID.
+func (this *Scheduler) Get(id uint64) (job Job, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entry, ok := this.jobs[id]
+	if ok { job = entry.job; }
+	return
+}
+
+// The scheduled jobs, soonest first.
+func (this *Scheduler) Jobs() []Job {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.list()
+}
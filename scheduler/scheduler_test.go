@@ -0,0 +1,285 @@
+package scheduler
+
+import "encoding/json"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+import "time"
+
+// A clock which only moves when told to, firing the timers it passes.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	f     func()
+	done  bool // Fired or stopped.
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now:time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (this *fakeClock) Now() time.Time {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.now
+}
+
+func (this *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	timer := &fakeTimer{clock:this, when:this.now.Add(d), f:f}
+	this.timers = append(this.timers, timer)
+	return timer
+}
+
+func (this *fakeTimer) Stop() bool {
+	this.clock.mu.Lock()
+	defer this.clock.mu.Unlock()
+	stopped := !this.done
+	this.done = true
+	return stopped
+}
+
+// Move the time on, firing the timers due, each from a goroutine of its own.
+func (this *fakeClock) Advance(d time.Duration) {
+	this.mu.Lock()
+	this.now = this.now.Add(d)
+	var due []*fakeTimer
+	for _, timer := range this.timers {
+		if !timer.done && !timer.when.After(this.now) {
+			timer.done = true
+			due = append(due, timer)
+		}
+	}
+	this.mu.Unlock()
+	for _, timer := range due {
+		go timer.f()
+	}
+}
+
+// A scheduler on a fake clock, sending the jobs it runs down a channel.
+func newTestScheduler() (*Scheduler, *fakeClock, chan Job) {
+	clock := newFakeClock()
+	ran := make(chan Job, 16)
+	return New(clock, func(job Job) { ran <- job; }), clock, ran
+}
+
+func expectRun(t *testing.T, ran chan Job, id uint64) Job {
+	t.Helper()
+	select {
+	case job := <-ran:
+		if job.ID != id {
+			t.Fatalf("job #%d ran, want #%d", job.ID, id)
+		}
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job #%d didn't run", id)
+	}
+	return Job{}
+}
+
+// Expect the jobs with the given IDs to run, in any order.
+func expectRuns(t *testing.T, ran chan Job, ids ...uint64) {
+	t.Helper()
+	want := map[uint64]bool{}
+	for _, id := range ids { want[id] = true; }
+	for len(want) > 0 {
+		select {
+		case job := <-ran:
+			if !want[job.ID] {
+				t.Fatalf("job #%d ran unexpectedly", job.ID)
+			}
+			delete(want, job.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("jobs %v didn't run", want)
+		}
+	}
+}
+
+func expectNone(t *testing.T, ran chan Job) {
+	t.Helper()
+	select {
+	case job := <-ran:
+		t.Fatalf("job #%d ran early", job.ID)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAddRunsWhenDue(t *testing.T) {
+	sched, clock, ran := newTestScheduler()
+	first, _  := sched.Add(Job{Owner:"a", Message:"one", When:clock.Now().Add(time.Hour)})
+	second, _ := sched.Add(Job{Owner:"a", Message:"two", When:clock.Now().Add(2*time.Hour)})
+	if first.ID != 1 || second.ID != 2 {
+		t.Fatalf("IDs %d and %d, want 1 and 2", first.ID, second.ID)
+	}
+
+	clock.Advance(59 * time.Minute)
+	expectNone(t, ran)
+	clock.Advance(time.Minute)
+	if job := expectRun(t, ran, 1); job.Message != "one" {
+		t.Errorf("ran %+v", job)
+	}
+	if jobs := sched.Jobs(); len(jobs) != 1 || jobs[0].ID != 2 {
+		t.Errorf("after running #1, jobs are %+v", jobs)
+	}
+
+	clock.Advance(time.Hour)
+	expectRun(t, ran, 2)
+	if jobs := sched.Jobs(); len(jobs) != 0 {
+		t.Errorf("jobs left after running both: %+v", jobs)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	sched, clock, ran := newTestScheduler()
+	job, _ := sched.Add(Job{Owner:"a", Message:"x", When:clock.Now().Add(time.Minute)})
+	if _, ok := sched.Get(job.ID); !ok {
+		t.Fatal("Get didn't find the job")
+	}
+	if cancelled, err := sched.Cancel(job.ID); err != nil || cancelled.ID != job.ID {
+		t.Fatalf("Cancel = %+v, %v", cancelled, err)
+	}
+	if _, err := sched.Cancel(job.ID); err != ErrNoSuchJob {
+		t.Errorf("cancelling twice: got %v, want ErrNoSuchJob", err)
+	}
+	clock.Advance(time.Hour)
+	expectNone(t, ran)
+}
+
+func TestRepeats(t *testing.T) {
+	sched, clock, ran := newTestScheduler()
+	start := clock.Now().Add(10 * time.Minute)
+	job, _ := sched.Add(Job{Owner:"a", Command:"!skip", When:start, Every:10 * time.Minute})
+
+	for i := 1; i <= 3; i++ {
+		clock.Advance(10 * time.Minute)
+		expectRun(t, ran, job.ID)
+		// The ID is kept, and the next run is one interval on.
+		next, ok := sched.Get(job.ID)
+		if !ok {
+			t.Fatalf("run %d: the job wasn't rescheduled", i)
+		}
+		if want := start.Add(time.Duration(i) * 10 * time.Minute); !next.When.Equal(want) {
+			t.Fatalf("run %d: next at %s, want %s", i, next.When, want)
+		}
+	}
+
+	// Runs missed while running late are skipped, not run all at once.
+	clock.Advance(35 * time.Minute)
+	expectRun(t, ran, job.ID)
+	expectNone(t, ran)
+	next, _ := sched.Get(job.ID)
+	if want := start.Add(60 * time.Minute); !next.When.Equal(want) {
+		t.Errorf("after missing runs, next at %s, want %s", next.When, want)
+	}
+
+	sched.Cancel(job.ID)
+	clock.Advance(time.Hour)
+	expectNone(t, ran)
+}
+
+func TestOwnerLimit(t *testing.T) {
+	sched, clock, ran := newTestScheduler()
+	sched.SetOwnerLimit(2)
+	when := clock.Now().Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := sched.Add(Job{Owner:"a", Message:"x", When:when}); err != nil {
+			t.Fatalf("job %d: %v", i+1, err)
+		}
+	}
+	if _, err := sched.Add(Job{Owner:"a", Message:"x", When:when}); err != ErrTooManyJobs {
+		t.Errorf("third job: got %v, want ErrTooManyJobs", err)
+	}
+	// Others aren't limited by a's jobs.
+	if _, err := sched.Add(Job{Owner:"b", Message:"x", When:when}); err != nil {
+		t.Errorf("b's job: %v", err)
+	}
+
+	// Once a's jobs have run, a may schedule more.
+	clock.Advance(time.Minute)
+	expectRuns(t, ran, 1, 2, 3)
+	if _, err := sched.Add(Job{Owner:"a", Message:"x", When:clock.Now().Add(time.Minute)});
+		err != nil {
+		t.Errorf("after running: %v", err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "jobs.json")
+	sched, clock, _ := newTestScheduler()
+	if err := sched.Load(path); err != nil {
+		t.Fatalf("loading a missing file: %v", err)
+	}
+	sched.Add(Job{Owner:"a", Message:"later", When:clock.Now().Add(time.Hour)})
+	cancelled, _ := sched.Add(Job{Owner:"a", Message:"gone", When:clock.Now().Add(time.Hour)})
+	sched.Cancel(cancelled.ID)
+
+	// A new scheduler, as after a restart, picks up the remaining job and
+	// carries on numbering after the cancelled one.
+	restarted, clock, ran := newTestScheduler()
+	if err := restarted.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	jobs := restarted.Jobs()
+	if len(jobs) != 1 || jobs[0].ID != 1 || jobs[0].Message != "later" {
+		t.Fatalf("loaded %+v", jobs)
+	}
+	if job, _ := restarted.Add(Job{Owner:"a", Message:"new", When:clock.Now().Add(time.Hour)});
+		job.ID != 3 {
+		t.Errorf("the next ID is %d, want 3", job.ID)
+	}
+	clock.Advance(time.Hour)
+	expectRuns(t, ran, 1, 3)
+}
+
+// Jobs that came due while the bot was down run as soon as they're loaded.
+func TestLoadLate(t *testing.T) {
+	sched, clock, ran := newTestScheduler()
+	now := clock.Now()
+	file := saved{NextID:10, Jobs:[]Job{
+		{ID:4, Owner:"a", Message:"missed", When:now.Add(-time.Hour)},
+		{ID:5, Owner:"a", Command:"!skip", When:now.Add(-25 * time.Minute),
+			Every:10 * time.Minute},
+		{ID:6, Owner:"a", Message:"future", When:now.Add(time.Hour)},
+	}}
+	data, _ := json.Marshal(file)
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sched.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(0)
+	expectRuns(t, ran, 4, 5)
+	expectNone(t, ran)
+
+	// The repeating job carries on from its next occurrence after now.
+	next, ok := sched.Get(5)
+	if want := now.Add(5 * time.Minute); !ok || !next.When.Equal(want) {
+		t.Errorf("#5 next runs at %s, want %s", next.When, want)
+	}
+	if _, ok := sched.Get(4); ok {
+		t.Error("#4 is still scheduled after running")
+	}
+	if job, _ := sched.Add(Job{Owner:"a", Message:"x", When:now.Add(time.Hour)}); job.ID != 10 {
+		t.Errorf("the next ID is %d, want 10", job.ID)
+	}
+}
+
+func TestLoadBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	os.WriteFile(path, []byte("{nonsense"), 0600)
+	sched, _, _ := newTestScheduler()
+	if err := sched.Load(path); err == nil {
+		t.Error("no error loading a corrupt file")
+	}
+}